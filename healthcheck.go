@@ -0,0 +1,120 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+type tcpHealthChecker struct {
+	mtx       sync.Mutex
+	cancelCtx context.CancelFunc
+	doneCh    chan struct{}
+}
+
+// -----------------------------------------------------------------------------
+
+// EnableTCPHealthCheck starts checking periodically if a TCP connection can be established to each server, for
+// protocols where a request level check is not available. The address to dial, in host:port form, is obtained from
+// the server user data with addrFunc, and servers with an empty address are skipped. Successful checks mark the
+// servers as online, which also ends the probing state on warmup mode, and failed ones count toward their MaxFails
+// limit. As backup servers never go offline, failures do not affect them. Calling it again replaces the current check.
+func (lb *LoadBalancer) EnableTCPHealthCheck(addrFunc func(userData interface{}) string, interval time.Duration) error {
+	if addrFunc == nil || interval <= 0 {
+		return errors.New("invalid parameter")
+	}
+
+	lb.DisableTCPHealthCheck()
+
+	// Lock access
+	lb.healthCheck.mtx.Lock()
+	defer lb.healthCheck.mtx.Unlock()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	doneCh := make(chan struct{})
+	lb.healthCheck.cancelCtx = cancelCtx
+	lb.healthCheck.doneCh = doneCh
+
+	go func() {
+		defer close(doneCh)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			lb.checkTCP(ctx, addrFunc, interval)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	// Done
+	return nil
+}
+
+// DisableTCPHealthCheck stops the TCP health check, if running, and waits until the current check completes.
+func (lb *LoadBalancer) DisableTCPHealthCheck() {
+	// Lock access
+	lb.healthCheck.mtx.Lock()
+	cancelCtx := lb.healthCheck.cancelCtx
+	doneCh := lb.healthCheck.doneCh
+	lb.healthCheck.cancelCtx = nil
+	lb.healthCheck.doneCh = nil
+	lb.healthCheck.mtx.Unlock()
+
+	if cancelCtx != nil {
+		cancelCtx()
+		<-doneCh
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// checkTCP dials all the servers concurrently and updates their status.
+func (lb *LoadBalancer) checkTCP(ctx context.Context, addrFunc func(userData interface{}) string,
+	timeout time.Duration) {
+	// Lock access
+	lb.mtx.Lock()
+	servers := make([]*Server, 0, len(lb.primaryGroup.srvList)+len(lb.backupGroup.srvList))
+	servers = append(servers, lb.primaryGroup.srvList...)
+	servers = append(servers, lb.backupGroup.srvList...)
+	lb.mtx.Unlock()
+
+	dialer := net.Dialer{
+		Timeout: timeout,
+	}
+
+	wg := sync.WaitGroup{}
+	for _, srv := range servers {
+		addr := addrFunc(srv.UserData())
+		if len(addr) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(srv *Server, addr string) {
+			defer wg.Done()
+
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err == nil {
+				_ = conn.Close()
+				srv.SetOnline()
+				return
+			}
+
+			// Ignore the failures caused by the check being stopped
+			if ctx.Err() == nil {
+				srv.SetOffline()
+			}
+		}(srv, addr)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,169 @@
+package httpclient
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// AdaptiveWeightOptions specifies how the weights of the sources are adjusted based on their observed latency and
+// error rate.
+type AdaptiveWeightOptions struct {
+	// Rate is the fraction of the distance to the target weight covered on each adjustment, between 0 and 1. Low
+	// values make the weights change slowly, damping the feedback between the weights and the observed latencies.
+	Rate float64
+
+	// MinWeight and MaxWeight bound the adapted weights. The source with the best score targets MaxWeight and the
+	// others a proportional share of it, never below MinWeight.
+	MinWeight int
+	MaxWeight int
+
+	// Interval is the minimum time between adjustments. Defaults to 10 seconds.
+	Interval time.Duration
+
+	// Window is the approximate amount of recent requests the latency and error rate of each source are averaged
+	// over. Defaults to 100.
+	Window int
+}
+
+type adaptiveTracker struct {
+	mtx     sync.Mutex
+	latency float64
+	errRate float64
+	samples int
+	weight  float64
+}
+
+// -----------------------------------------------------------------------------
+
+const (
+	defaultAdaptiveInterval = 10 * time.Second
+	defaultAdaptiveWindow   = 100
+	minAdaptiveLatency      = float64(time.Millisecond)
+)
+
+// -----------------------------------------------------------------------------
+
+// SetAdaptiveWeights enables adjusting the weights of the sources periodically, so faster and healthier sources
+// receive more traffic. The score of a source is its success rate divided by its average response time, both
+// computed as exponential moving averages of the requests executed with Exec and the RoundTripper. Sources without
+// requests keep their weight. Passing a zero rate disables the adjustments, keeping the current weights. It cannot be
+// combined with the error penalty. It must be called before executing requests.
+func (c *HttpClient) SetAdaptiveWeights(opts AdaptiveWeightOptions) error {
+	if opts.Rate == 0 {
+		c.adaptive = AdaptiveWeightOptions{}
+		return nil
+	}
+	if opts.Rate < 0 || opts.Rate > 1 || opts.MinWeight < 1 || opts.MaxWeight < opts.MinWeight ||
+		opts.Interval < 0 || opts.Window < 0 || c.errorPenalty.Penalty != 0 {
+		return errors.New("invalid parameter")
+	}
+	if opts.Interval == 0 {
+		opts.Interval = defaultAdaptiveInterval
+	}
+	if opts.Window == 0 {
+		opts.Window = defaultAdaptiveWindow
+	}
+	c.adaptive = opts
+	atomic.StoreInt64(&c.adaptiveTimestamp, time.Now().UnixNano())
+
+	// Done
+	return nil
+}
+
+// AverageLatency returns the average response time of the source. It is only computed if adaptive weights are
+// enabled.
+func (src *Source) AverageLatency() time.Duration {
+	src.adaptive.mtx.Lock()
+	defer src.adaptive.mtx.Unlock()
+	return time.Duration(src.adaptive.latency)
+}
+
+// -----------------------------------------------------------------------------
+
+// trackAdaptiveWeight accounts the result of a request and adjusts the weights of all the sources once the interval
+// elapsed.
+func (c *HttpClient) trackAdaptiveWeight(src *Source, elapsed time.Duration, failed bool) {
+	opts := c.adaptive
+	if opts.Rate == 0 {
+		return
+	}
+
+	sample := 0.0
+	if failed {
+		sample = 1.0
+	}
+	alpha := 2.0 / float64(opts.Window+1)
+
+	t := &src.adaptive
+	t.mtx.Lock()
+	if t.samples == 0 {
+		t.latency = float64(elapsed)
+	} else {
+		t.latency += alpha * (float64(elapsed) - t.latency)
+	}
+	t.errRate += alpha * (sample - t.errRate)
+	t.samples += 1
+	t.mtx.Unlock()
+
+	// Only one caller does the adjustment
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&c.adaptiveTimestamp)
+	if now-last < int64(opts.Interval) || !atomic.CompareAndSwapInt64(&c.adaptiveTimestamp, last, now) {
+		return
+	}
+	c.adjustWeights(opts)
+}
+
+func (c *HttpClient) adjustWeights(opts AdaptiveWeightOptions) {
+	sources := c.sourceList()
+
+	// Score each source
+	scores := make([]float64, len(sources))
+	sampled := make([]bool, len(sources))
+	bestScore := 0.0
+	for idx, src := range sources {
+		src.adaptive.mtx.Lock()
+		if src.adaptive.samples > 0 {
+			scores[idx] = (1 - src.adaptive.errRate) / math.Max(src.adaptive.latency, minAdaptiveLatency)
+			sampled[idx] = true
+		}
+		src.adaptive.mtx.Unlock()
+
+		if scores[idx] > bestScore {
+			bestScore = scores[idx]
+		}
+	}
+	if bestScore == 0 {
+		return
+	}
+
+	// Move each weight towards its target
+	for idx, src := range sources {
+		if !sampled[idx] {
+			continue
+		}
+		target := clampWeight(float64(opts.MaxWeight)*scores[idx]/bestScore, opts)
+
+		src.adaptive.mtx.Lock()
+		if src.adaptive.weight == 0 {
+			src.adaptive.weight = clampWeight(float64(src.srv.Weight()), opts)
+		}
+		src.adaptive.weight += opts.Rate * (target - src.adaptive.weight)
+		weight := int(math.Round(src.adaptive.weight))
+		src.adaptive.mtx.Unlock()
+
+		if weight != src.srv.Weight() {
+			_ = src.srv.SetWeight(weight)
+			c.stateChanged()
+		}
+	}
+}
+
+func clampWeight(weight float64, opts AdaptiveWeightOptions) float64 {
+	return math.Min(math.Max(weight, float64(opts.MinWeight)), float64(opts.MaxWeight))
+}
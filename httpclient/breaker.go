@@ -0,0 +1,53 @@
+package httpclient
+
+// -----------------------------------------------------------------------------
+
+// Breaker is a circuit breaker, for e.g. an adapter of an external library, that decides if a source can be used.
+type Breaker interface {
+	// Allow returns true if a request can be sent to the source. It is called once for each request attempt, after
+	// the source is selected, so it may count the requests it allows, for e.g. on the half-open state.
+	Allow() bool
+	// Success is called when a request sent to the source succeeds.
+	Success()
+	// Failure is called when a request sent to the source fails.
+	Failure()
+}
+
+// BreakerFactory creates the breaker of the source with the given base url.
+type BreakerFactory func(baseURL string) Breaker
+
+// -----------------------------------------------------------------------------
+
+// SetBreakerFactory sets the function that creates a breaker for each source added afterwards. Sources with a breaker
+// are skipped during selection while it does not allow requests, and the results of the requests are reported to it
+// instead of counting toward the MaxFails limit. The health check and the manual state changes still use the built-in
+// state. Passing nil restores the built-in breaker for the sources added afterwards. It must be called before adding
+// sources.
+func (c *HttpClient) SetBreakerFactory(factory BreakerFactory) {
+	c.breakerFactory = factory
+}
+
+// -----------------------------------------------------------------------------
+
+// reportSuccess reports a successful request to the breaker of the source.
+func (src *Source) reportSuccess() {
+	if src.breaker != nil {
+		src.breaker.Success()
+		return
+	}
+	src.srv.SetOnline()
+}
+
+// reportFailure reports a failed request to the breaker of the source.
+func (src *Source) reportFailure() {
+	if src.breaker != nil {
+		src.breaker.Failure()
+		return
+	}
+	src.srv.SetOffline()
+}
+
+// isAllowedByBreaker returns false if the source has an external breaker that does not allow requests.
+func (src *Source) isAllowedByBreaker() bool {
+	return src.breaker == nil || src.breaker.Allow()
+}
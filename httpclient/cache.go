@@ -0,0 +1,316 @@
+package httpclient
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	maxCachedBodySize = 1 << 20
+	maxDeltaSeconds   = 1<<31 - 1
+)
+
+// -----------------------------------------------------------------------------
+
+type responseCache struct {
+	mtx             sync.Mutex
+	size            int
+	withCredentials bool
+	entries         map[string]*list.Element
+	lru             *list.List
+	varies          map[string]*cacheVary
+}
+
+// cacheVary contains the request headers the responses of a url vary on and the amount of cached variants.
+type cacheVary struct {
+	names []string
+	count int
+}
+
+type cacheEntry struct {
+	key          string
+	url          string
+	varyNames    []string
+	statusCode   int
+	header       http.Header
+	body         []byte
+	storedAt     time.Time
+	maxAge       time.Duration
+	staleIfError time.Duration
+}
+
+type readerWithCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// -----------------------------------------------------------------------------
+
+// EnableCache keeps the last successful GET responses, up to the given amount, whose Cache-Control header allows it
+// through the max-age or stale-if-error directives. When no source is available or all the sources attempted by a
+// request failed, a cached response still fresh or within its stale-if-error period is passed to the request callback
+// instead of failing, like the fallback handler does, which is only called if there is no usable cached response.
+// Responses with no-store or no-cache directives, with a "Vary: *" header, or with bodies larger than 1MB, are not
+// cached. It must be called before executing requests.
+//
+// Responses are cached by the request url along with the values of the request headers listed in their Vary header.
+// Requests carrying Authorization or Cookie headers are neither cached nor served from the cache unless enabled with
+// SetCacheCredentials.
+func (c *HttpClient) EnableCache(size int) error {
+	if size <= 0 {
+		return errors.New("invalid parameter")
+	}
+	c.cache = &responseCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		varies:  make(map[string]*cacheVary),
+	}
+
+	// Done
+	return nil
+}
+
+// SetCacheCredentials sets if requests carrying Authorization or Cookie headers use the cache. If enabled, the values
+// of both headers are also part of the cache key, so the responses are only served to requests with the same
+// credentials. It has no effect if the cache is disabled. It must be called before executing requests.
+func (c *HttpClient) SetCacheCredentials(enable bool) {
+	if c.cache != nil {
+		c.cache.withCredentials = enable
+	}
+}
+
+// DisableCache removes the cached responses and stops caching them. It must be called before executing requests.
+func (c *HttpClient) DisableCache() {
+	c.cache = nil
+}
+
+// -----------------------------------------------------------------------------
+
+// capture returns a cache entry for the response to a request with the given url and headers if allowed by its
+// Cache-Control header, or nil if not. The body is read and replaced by an in-memory copy. The entry must be passed to
+// store once the response is known to be valid.
+func (rc *responseCache) capture(url string, reqHeader http.Header, resp *http.Response) *cacheEntry {
+	if resp.StatusCode != http.StatusOK || !rc.isAllowed(reqHeader) {
+		return nil
+	}
+	maxAge, staleIfError, ok := parseCacheControl(resp.Header.Values("Cache-Control"))
+	if !ok || resp.ContentLength > maxCachedBodySize {
+		return nil
+	}
+	varyNames, ok := parseVary(resp.Header.Values("Vary"))
+	if !ok {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCachedBodySize+1))
+	if err != nil || len(body) > maxCachedBodySize {
+		// Let the callback read the response as usual
+		resp.Body = &readerWithCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), resp.Body),
+			Closer: resp.Body,
+		}
+		return nil
+	}
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	// Done
+	return &cacheEntry{
+		key:          rc.cacheKey(url, varyNames, reqHeader),
+		url:          url,
+		varyNames:    varyNames,
+		statusCode:   resp.StatusCode,
+		header:       resp.Header.Clone(),
+		body:         body,
+		storedAt:     time.Now(),
+		maxAge:       maxAge,
+		staleIfError: staleIfError,
+	}
+}
+
+// store adds an entry returned by capture to the cache.
+func (rc *responseCache) store(entry *cacheEntry) {
+	varyNames := entry.varyNames
+
+	// Lock access
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+
+	// If the headers the responses vary on changed, the cached variants cannot be looked up anymore
+	vary, found := rc.varies[entry.url]
+	if found && !isSameVary(vary.names, varyNames) {
+		for elem := rc.lru.Front(); elem != nil; {
+			next := elem.Next()
+			if elem.Value.(*cacheEntry).url == entry.url {
+				rc.remove(elem)
+			}
+			elem = next
+		}
+		found = false
+	}
+	if !found {
+		vary = &cacheVary{
+			names: varyNames,
+		}
+		rc.varies[entry.url] = vary
+	}
+
+	if elem, found := rc.entries[entry.key]; found {
+		elem.Value = entry
+		rc.lru.MoveToFront(elem)
+		return
+	}
+	rc.entries[entry.key] = rc.lru.PushFront(entry)
+	vary.count += 1
+	if rc.lru.Len() > rc.size {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+// lookup returns a copy of the response cached for a request with the given url and headers if it is fresh or within
+// its stale-if-error period.
+func (rc *responseCache) lookup(url string, reqHeader http.Header) *http.Response {
+	if !rc.isAllowed(reqHeader) {
+		return nil
+	}
+
+	// Lock access
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+
+	vary, found := rc.varies[url]
+	if !found {
+		return nil
+	}
+	elem, found := rc.entries[rc.cacheKey(url, vary.names, reqHeader)]
+	if !found {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	age := time.Since(entry.storedAt)
+	if age > entry.maxAge+entry.staleIfError {
+		return nil
+	}
+	rc.lru.MoveToFront(elem)
+
+	header := entry.header.Clone()
+	header.Set("Age", strconv.Itoa(int(age/time.Second)))
+	return &http.Response{
+		Status:        strconv.Itoa(entry.statusCode) + " " + http.StatusText(entry.statusCode),
+		StatusCode:    entry.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(entry.body)),
+		ContentLength: int64(len(entry.body)),
+	}
+}
+
+// remove takes the entry out of the cache. The lock must be held.
+func (rc *responseCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	rc.lru.Remove(elem)
+	delete(rc.entries, entry.key)
+	if vary, found := rc.varies[entry.url]; found {
+		vary.count -= 1
+		if vary.count <= 0 {
+			delete(rc.varies, entry.url)
+		}
+	}
+}
+
+// isAllowed returns true if a request with the given headers can use the cache.
+func (rc *responseCache) isAllowed(reqHeader http.Header) bool {
+	return rc.withCredentials || (len(reqHeader.Get("Authorization")) == 0 && len(reqHeader.Get("Cookie")) == 0)
+}
+
+// cacheKey returns the key of the response to a request with the given url and headers. It contains the values of
+// the headers the response varies on and, if enabled, of the credentials.
+func (rc *responseCache) cacheKey(url string, varyNames []string, reqHeader http.Header) string {
+	sb := strings.Builder{}
+	sb.WriteString(url)
+	if rc.withCredentials {
+		varyNames = append([]string{"Authorization", "Cookie"}, varyNames...)
+	}
+	for _, name := range varyNames {
+		sb.WriteString("\n")
+		sb.WriteString(name)
+		sb.WriteString(": ")
+		sb.WriteString(strings.Join(reqHeader.Values(name), ", "))
+	}
+	return sb.String()
+}
+
+// parseVary returns the canonical names of the headers listed in the Vary header and if the response can be cached.
+func parseVary(values []string) ([]string, bool) {
+	var names []string
+
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if len(name) > 0 {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+func isSameVary(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCacheControl returns the max-age and stale-if-error directives and if the response can be cached.
+func parseCacheControl(values []string) (time.Duration, time.Duration, bool) {
+	var maxAge, staleIfError time.Duration
+
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache":
+				return 0, 0, false
+			case "max-age":
+				maxAge = parseDeltaSeconds(arg)
+			case "stale-if-error":
+				staleIfError = parseDeltaSeconds(arg)
+			}
+		}
+	}
+	return maxAge, staleIfError, maxAge > 0 || staleIfError > 0
+}
+
+func parseDeltaSeconds(value string) time.Duration {
+	secs, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+	if err != nil || secs < 0 {
+		return 0
+	}
+	if secs > maxDeltaSeconds {
+		secs = maxDeltaSeconds
+	}
+	return time.Duration(secs) * time.Second
+}
@@ -0,0 +1,131 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	maxCoalescedBodySize = 1 << 20
+)
+
+// -----------------------------------------------------------------------------
+
+// CoalesceKeyFunc returns the key of a request to coalesce. Requests with the same key share the response. Returning
+// an empty key disables coalescing for the request.
+type CoalesceKeyFunc func(method string, url string, header http.Header) string
+
+type flightGroup struct {
+	mtx     sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	key    string
+	doneCh chan struct{}
+	src    *Source
+	resp   *http.Response
+	body   []byte
+}
+
+// -----------------------------------------------------------------------------
+
+// Coalesce makes GET and HEAD requests share the response with an identical request already in flight, so hot
+// endpoints requested by many goroutines at the same time only receive one upstream request. Requests are identical
+// if they have the same method and url or, if a key function is given, the same key. Only the first attempt is
+// shared: each request gets its own copy of the response, read in memory, and the callback is called for each of
+// them. Only the shared attempt counts toward the source stats, metrics and state. If the shared attempt fails before
+// getting a response, its body is larger than 1MB or has an unknown length, or the callback asks for a retry, the
+// request continues on its own. As headers are not part of the default key, requests with different credentials need a
+// key function.
+func (req *Request) Coalesce(keyFunc CoalesceKeyFunc) *Request {
+	req.coalesce = true
+	req.coalesceKeyFunc = keyFunc
+	return req
+}
+
+// -----------------------------------------------------------------------------
+
+// coalesceKey returns the key to coalesce the request with or an empty string if it must not be coalesced.
+func (req *Request) coalesceKey() string {
+	if !req.coalesce || req.pinned != nil || (req.method != "GET" && req.method != "HEAD") {
+		return ""
+	}
+	if req.coalesceKeyFunc != nil {
+		return req.coalesceKeyFunc(req.method, req.url, req.headers)
+	}
+	return req.method + " " + req.url
+}
+
+// join returns the flight in progress with the given key or starts a new one. The second return value is true if the
+// caller started the flight and must finish it.
+func (g *flightGroup) join(key string) (*flight, bool) {
+	// Lock access
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if f, found := g.flights[key]; found {
+		return f, false
+	}
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f := &flight{
+		key:    key,
+		doneCh: make(chan struct{}),
+	}
+	g.flights[key] = f
+	return f, true
+}
+
+// finish reads the response body in memory to share it, replacing the body of the response, and wakes up the waiting
+// requests. A nil response, or one whose body is too large or has an unknown length, lets them continue on their own.
+func (g *flightGroup) finish(f *flight, src *Source, resp *http.Response) {
+	// Lock access
+	g.mtx.Lock()
+	delete(g.flights, f.key)
+	g.mtx.Unlock()
+
+	if resp != nil && resp.ContentLength >= 0 && resp.ContentLength <= maxCoalescedBodySize {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxCoalescedBodySize+1))
+		if err == nil && len(body) <= maxCoalescedBodySize {
+			_ = resp.Body.Close()
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+
+			f.src = src
+			f.resp = resp
+			f.body = body
+		} else {
+			// Let the caller read the rest of the body or get the same error reading it
+			resp.Body = &readerWithCloser{
+				Reader: io.MultiReader(bytes.NewReader(body), resp.Body),
+				Closer: resp.Body,
+			}
+		}
+	}
+	close(f.doneCh)
+}
+
+// wait waits for the flight to finish and returns the source and a copy of the response. It returns a nil response
+// if the flight did not get one or the context expires first.
+func (f *flight) wait(ctx context.Context) (*Source, *http.Response) {
+	select {
+	case <-f.doneCh:
+	case <-ctx.Done():
+		return nil, nil
+	}
+	if f.resp == nil {
+		return nil, nil
+	}
+
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Trailer = f.resp.Trailer.Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(f.body))
+	return f.src, &resp
+}
@@ -0,0 +1,151 @@
+package httpclient
+
+import (
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	// StrategyWeightedRoundRobin selects the sources in round-robin order according to their weights. This is the
+	// default.
+	StrategyWeightedRoundRobin = "weighted-round-robin"
+	// StrategyRoundRobin selects the sources in round-robin order ignoring their weights.
+	StrategyRoundRobin = "round-robin"
+	// StrategyFillFirst fills the sources up to their capacity in weight order.
+	StrategyFillFirst = "fill-first"
+	// StrategySticky sends all requests to the same source until it goes offline.
+	StrategySticky = "sticky"
+	// StrategyTrafficSplit sends a fixed share of the requests to some sources.
+	StrategyTrafficSplit = "traffic-split"
+	// StrategySelector uses a custom selector instead of the load balancer.
+	StrategySelector = "selector"
+)
+
+// -----------------------------------------------------------------------------
+
+// ClientConfig contains a copy of the effective configuration of the client. It can be serialized to JSON. Retry
+// policies are set per request, so they are not included.
+type ClientConfig struct {
+	Strategy               string             `json:"strategy"`
+	MinPrimary             int                `json:"minPrimary"`
+	BackupHysteresisMargin int                `json:"backupHysteresisMargin"`
+	BackupHysteresisHold   time.Duration      `json:"backupHysteresisHold"`
+	Warmup                 bool               `json:"warmup"`
+	DNSFailureWindow       time.Duration      `json:"dnsFailureWindow"`
+	HasFallback            bool               `json:"hasFallback"`
+	CacheSize              int                `json:"cacheSize"`
+	CacheCredentials       bool               `json:"cacheCredentials"`
+	RequestIDHeader        string             `json:"requestIdHeader,omitempty"`
+	ConnStats              bool               `json:"connStats"`
+	StatusErrorPolicy      StatusErrorPolicy  `json:"statusErrorPolicy"`
+	ActiveGroup            string             `json:"activeGroup,omitempty"`
+	Transport              TransportConfig    `json:"transport"`
+	HealthCheck            *HealthCheckConfig `json:"healthCheck,omitempty"`
+	Sources                SourcesConfig      `json:"sources"`
+}
+
+// TransportConfig contains the settings of the shared transport.
+type TransportConfig struct {
+	TLSHandshakeTimeout   time.Duration `json:"tlsHandshakeTimeout"`
+	ResponseHeaderTimeout time.Duration `json:"responseHeaderTimeout"`
+	ExpectContinueTimeout time.Duration `json:"expectContinueTimeout"`
+	IdleConnTimeout       time.Duration `json:"idleConnTimeout"`
+	MaxIdleConns          int           `json:"maxIdleConns"`
+	MaxIdleConnsPerHost   int           `json:"maxIdleConnsPerHost"`
+	MaxConnsPerHost       int           `json:"maxConnsPerHost"`
+	DisableKeepAlives     bool          `json:"disableKeepAlives"`
+	MaxConnAge            time.Duration `json:"maxConnAge"`
+	MaxTotalConns         int           `json:"maxTotalConns"`
+}
+
+// HealthCheckConfig contains the settings of the health check.
+type HealthCheckConfig struct {
+	Path     string        `json:"path"`
+	Interval time.Duration `json:"interval"`
+	Timeout  time.Duration `json:"timeout"`
+	Jitter   float64       `json:"jitter"`
+}
+
+// SourcesConfig contains the amount of sources of each kind.
+type SourcesConfig struct {
+	Primary int `json:"primary"`
+	Backup  int `json:"backup"`
+	Shadow  int `json:"shadow"`
+}
+
+// -----------------------------------------------------------------------------
+
+// Config returns a copy of the effective configuration of the client for diagnostics.
+func (c *HttpClient) Config() ClientConfig {
+	cfg := ClientConfig{
+		Strategy:               c.strategy(),
+		MinPrimary:             c.minPrimary,
+		BackupHysteresisMargin: c.hysteresisMargin,
+		BackupHysteresisHold:   c.hysteresisHold,
+		Warmup:                 c.warmup,
+		DNSFailureWindow:       c.dnsFailureWindow,
+		HasFallback:            c.fallback != nil,
+		RequestIDHeader:        c.requestIDHeader,
+		ConnStats:              c.connStats,
+		StatusErrorPolicy:      c.statusErrorPolicy,
+		ActiveGroup:            c.ActiveGroup(),
+		Transport: TransportConfig{
+			TLSHandshakeTimeout:   c.transport.TLSHandshakeTimeout,
+			ResponseHeaderTimeout: c.transport.ResponseHeaderTimeout,
+			ExpectContinueTimeout: c.transport.ExpectContinueTimeout,
+			IdleConnTimeout:       c.transport.IdleConnTimeout,
+			MaxIdleConns:          c.transport.MaxIdleConns,
+			MaxIdleConnsPerHost:   c.transport.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       c.transport.MaxConnsPerHost,
+			DisableKeepAlives:     c.transport.DisableKeepAlives,
+			MaxConnAge:            c.maxConnAge,
+			MaxTotalConns:         c.MaxTotalConnections(),
+		},
+	}
+	if c.cache != nil {
+		cfg.CacheSize = c.cache.size
+		cfg.CacheCredentials = c.cache.withCredentials
+	}
+
+	c.healthCheck.mtx.Lock()
+	if c.healthCheck.stopCh != nil {
+		cfg.HealthCheck = &HealthCheckConfig{
+			Path:     c.healthCheck.opts.Path,
+			Interval: c.healthCheck.opts.Interval,
+			Timeout:  c.healthCheck.opts.Timeout,
+			Jitter:   c.healthCheck.opts.Jitter,
+		}
+	}
+	c.healthCheck.mtx.Unlock()
+
+	for _, src := range c.sourceList() {
+		if src.IsBackup() {
+			cfg.Sources.Backup += 1
+		} else {
+			cfg.Sources.Primary += 1
+		}
+	}
+	cfg.Sources.Shadow = len(c.shadowSourceList())
+
+	// Done
+	return cfg
+}
+
+// -----------------------------------------------------------------------------
+
+func (c *HttpClient) strategy() string {
+	switch {
+	case c.selector != nil:
+		return StrategySelector
+	case c.loadTrafficSplit() != nil:
+		return StrategyTrafficSplit
+	case c.fillFirst:
+		return StrategyFillFirst
+	case c.stickyPrimary:
+		return StrategySticky
+	case c.ignoreWeights:
+		return StrategyRoundRobin
+	}
+	return StrategyWeightedRoundRobin
+}
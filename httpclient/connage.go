@@ -0,0 +1,61 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptrace"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// SetMaxConnAge limits the lifetime of the connections to the sources. Once a connection is older than the given
+// duration, it is closed when the request using it completes instead of being reused, so a new one is established,
+// re-resolving the source host. This spreads the load again when the sources are behind a layer 4 balancer. Zero
+// disables the limit. It must be called before executing requests.
+func (c *HttpClient) SetMaxConnAge(maxAge time.Duration) error {
+	if maxAge < 0 {
+		return errors.New("invalid parameter")
+	}
+	c.maxConnAge = maxAge
+
+	// Done
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// withConnAgeTrace returns a copy of the context that closes the connection used by the request once it is returned
+// to the idle pool if it is older than the maximum age.
+func (c *HttpClient) withConnAgeTrace(ctx context.Context) context.Context {
+	if c.maxConnAge == 0 {
+		return ctx
+	}
+
+	var sc *sourceConn
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			sc = unwrapSourceConn(info.Conn)
+		},
+		PutIdleConn: func(err error) {
+			if err == nil && sc != nil && time.Since(sc.createdAt) >= c.maxConnAge {
+				_ = sc.Close()
+			}
+		},
+	})
+}
+
+func unwrapSourceConn(conn net.Conn) *sourceConn {
+	for conn != nil {
+		switch v := conn.(type) {
+		case *sourceConn:
+			return v
+		case interface{ NetConn() net.Conn }:
+			conn = v.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
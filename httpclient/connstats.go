@@ -0,0 +1,33 @@
+package httpclient
+
+import (
+	"context"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// -----------------------------------------------------------------------------
+
+// SetConnStats enables or disables tracking, for each source, how many requests reused a connection and how many
+// needed a new one. It adds a small overhead to every request. It must be called before executing requests.
+func (c *HttpClient) SetConnStats(enable bool) {
+	c.connStats = enable
+}
+
+// -----------------------------------------------------------------------------
+
+// withConnStatsTrace returns a copy of the context that tracks the connection reuse of the source if enabled.
+func (c *HttpClient) withConnStatsTrace(ctx context.Context, src *Source) context.Context {
+	if !c.connStats {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&src.reusedConns, 1)
+			} else {
+				atomic.AddInt64(&src.newConns, 1)
+			}
+		},
+	})
+}
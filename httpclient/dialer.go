@@ -0,0 +1,348 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	// DialDualStack lets the dialer race IPv4 and IPv6 addresses (happy eyeballs). This is the default.
+	DialDualStack int = iota + 1
+	// DialPreferIPv4 tries IPv4 addresses first and falls back to IPv6 ones.
+	DialPreferIPv4
+	// DialPreferIPv6 tries IPv6 addresses first and falls back to IPv4 ones.
+	DialPreferIPv6
+	// DialIPv4Only only uses IPv4 addresses.
+	DialIPv4Only
+	// DialIPv6Only only uses IPv6 addresses.
+	DialIPv6Only
+)
+
+// -----------------------------------------------------------------------------
+
+// DialContextFunc specifies the function used to establish network connections.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// sourceConn tracks a connection opened to a source.
+type sourceConn struct {
+	net.Conn
+	src       *Source
+	createdAt time.Time
+	idle      int32
+	closeOnce sync.Once
+}
+
+// connLimiter limits the connections opened by the client to all the sources.
+type connLimiter struct {
+	mtx        sync.Mutex
+	max        int
+	open       int
+	releasedCh chan struct{}
+	closeIdle  func()
+}
+
+// -----------------------------------------------------------------------------
+
+const (
+	defaultDialTimeout = 30 * time.Second
+)
+
+var errConnLimitTimeout = errors.New("timeout waiting for a free connection slot")
+
+// -----------------------------------------------------------------------------
+
+// SetDialPreference sets which IP address family is used to connect to the sources when their hostnames resolve to
+// both IPv4 and IPv6 addresses. It must be called before executing requests.
+func (c *HttpClient) SetDialPreference(pref int) error {
+	dialContext := newPreferenceDialContext(pref)
+	if dialContext == nil {
+		return errors.New("invalid parameter")
+	}
+	c.transport.DialContext = newLimitedDialContext(dialContext)
+
+	// Done
+	return nil
+}
+
+// SetDialContext sets the function used to establish the connections to the sources. It allows the host in the base
+// url of a source to be a logical name resolved at dial time, for example, by a service discovery system. It replaces
+// the dialer installed by SetDialPreference and must be called before executing requests.
+//
+// NOTE: Connections are pooled by the host and port of the base url, not by the resolved address. If the address a
+// logical name resolves to changes, idle connections to the old address are reused until they expire. Call
+// CloseIdleConnections to force new connections to be established.
+func (c *HttpClient) SetDialContext(dialContext DialContextFunc) {
+	c.transport.DialContext = newLimitedDialContext(dialContext)
+}
+
+// SetMaxTotalConnections limits the amount of connections the client may have open to all the sources at the same
+// time, including the idle ones and the ones of the shadow sources, regardless of the per-host and per-source limits.
+// Once reached, the idle connections of the requests executed afterwards are closed to make room and, if none was idle,
+// new connections wait for another one to be closed, up to the dial timeout. Connections established with a custom
+// DialTLSContext transport function are not limited. Zero means no limit.
+func (c *HttpClient) SetMaxTotalConnections(max int) error {
+	if max < 0 {
+		return errors.New("invalid parameter")
+	}
+
+	// Lock access
+	c.totalConns.mtx.Lock()
+	c.totalConns.max = max
+	c.totalConns.closeIdle = c.closeIdleSourceConns
+	c.totalConns.wakeUpLocked()
+	c.totalConns.mtx.Unlock()
+
+	// Done
+	return nil
+}
+
+// MaxTotalConnections returns the limit of connections open to all the sources or zero if there is no limit.
+func (c *HttpClient) MaxTotalConnections() int {
+	c.totalConns.mtx.Lock()
+	defer c.totalConns.mtx.Unlock()
+	return c.totalConns.max
+}
+
+// OpenConnections returns the amount of connections currently open to all the sources.
+func (c *HttpClient) OpenConnections() int {
+	c.totalConns.mtx.Lock()
+	defer c.totalConns.mtx.Unlock()
+	return c.totalConns.open
+}
+
+// CloseIdleConnections closes the connections that are currently idle.
+func (c *HttpClient) CloseIdleConnections() {
+	c.transport.CloseIdleConnections()
+	for _, src := range c.sourceList() {
+		if src.opts.ResponseHeaderTimeout != 0 {
+			c.transportFor(src).CloseIdleConnections()
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// withIdleTrace returns a copy of the context that tracks when the connection used by the request becomes idle, so it
+// can be closed to make room if the total connections are limited.
+func (c *HttpClient) withIdleTrace(ctx context.Context) context.Context {
+	if c.MaxTotalConnections() == 0 {
+		return ctx
+	}
+
+	var sc *sourceConn
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			sc = unwrapSourceConn(info.Conn)
+			if sc != nil {
+				atomic.StoreInt32(&sc.idle, 0)
+			}
+		},
+		PutIdleConn: func(err error) {
+			if err == nil && sc != nil {
+				atomic.StoreInt32(&sc.idle, 1)
+			}
+		},
+	})
+}
+
+// closeIdleSourceConns closes the idle connections open to all the sources.
+func (c *HttpClient) closeIdleSourceConns() {
+	for _, src := range c.sourceList() {
+		src.closeIdleConns()
+	}
+	for _, src := range c.shadowSourceList() {
+		src.closeIdleConns()
+	}
+}
+
+func newPreferenceDialContext(pref int) DialContextFunc {
+	// Use the same settings than the default transport
+	dialer := &net.Dialer{
+		Timeout:   defaultDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	switch pref {
+	case DialDualStack:
+		return dialer.DialContext
+
+	case DialPreferIPv4:
+		return newFallbackDialContext(dialer, "tcp4", "tcp6")
+
+	case DialPreferIPv6:
+		return newFallbackDialContext(dialer, "tcp6", "tcp4")
+
+	case DialIPv4Only:
+		return newFallbackDialContext(dialer, "tcp4", "")
+
+	case DialIPv6Only:
+		return newFallbackDialContext(dialer, "tcp6", "")
+	}
+	return nil
+}
+
+func newFallbackDialContext(dialer *net.Dialer, primaryNetwork string, fallbackNetwork string) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// Only override the address family if the caller does not require a specific one
+		if network != "tcp" {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		conn, err := dialer.DialContext(ctx, primaryNetwork, addr)
+		if err == nil || len(fallbackNetwork) == 0 || ctx.Err() != nil {
+			return conn, err
+		}
+		conn, fallbackErr := dialer.DialContext(ctx, fallbackNetwork, addr)
+		if fallbackErr == nil {
+			return conn, nil
+		}
+
+		// Return the error of the preferred family
+		return nil, err
+	}
+}
+
+// newLimitedDialContext wraps the dial function to enforce the connection limit of the source the connection is for
+// and to track its open connections.
+func newLimitedDialContext(dial DialContextFunc) DialContextFunc {
+	if dial == nil {
+		dial = newPreferenceDialContext(DialDualStack)
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		src := sourceFromContext(ctx)
+		if src == nil {
+			return dial(ctx, network, addr)
+		}
+
+		if src.connSem != nil {
+			// Wait for a free slot. The transport does not cancel the dial if the request gets an idle connection
+			// meanwhile, so limit the wait.
+			timer := time.NewTimer(defaultDialTimeout)
+			defer timer.Stop()
+			select {
+			case src.connSem <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-timer.C:
+				return nil, errConnLimitTimeout
+			}
+		}
+
+		if src.totalConns != nil {
+			err := src.totalConns.acquire(ctx)
+			if err != nil {
+				if src.connSem != nil {
+					<-src.connSem
+				}
+				return nil, err
+			}
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			if src.connSem != nil {
+				<-src.connSem
+			}
+			if src.totalConns != nil {
+				src.totalConns.release()
+			}
+			return nil, err
+		}
+		atomic.AddInt32(&src.openConns, 1)
+		sc := &sourceConn{
+			Conn:      conn,
+			src:       src,
+			createdAt: time.Now(),
+		}
+		src.connsMtx.Lock()
+		if src.conns == nil {
+			src.conns = make(map[*sourceConn]struct{})
+		}
+		src.conns[sc] = struct{}{}
+		src.connsMtx.Unlock()
+		return sc, nil
+	}
+}
+
+func (sc *sourceConn) Close() error {
+	sc.closeOnce.Do(func() {
+		atomic.AddInt32(&sc.src.openConns, -1)
+		sc.src.connsMtx.Lock()
+		delete(sc.src.conns, sc)
+		sc.src.connsMtx.Unlock()
+		if sc.src.connSem != nil {
+			<-sc.src.connSem
+		}
+		if sc.src.totalConns != nil {
+			sc.src.totalConns.release()
+		}
+	})
+	return sc.Conn.Close()
+}
+
+// acquire waits until a new connection can be opened without exceeding the limit and counts it.
+func (l *connLimiter) acquire(ctx context.Context) error {
+	var timer *time.Timer
+
+	for {
+		// Lock access
+		l.mtx.Lock()
+		if l.max == 0 || l.open < l.max {
+			l.open += 1
+			l.mtx.Unlock()
+			break
+		}
+		if l.releasedCh == nil {
+			l.releasedCh = make(chan struct{})
+		}
+		releasedCh := l.releasedCh
+		closeIdle := l.closeIdle
+		l.mtx.Unlock()
+
+		// The transport does not cancel the dial if the request gets an idle connection meanwhile, so limit the wait
+		if timer == nil {
+			timer = time.NewTimer(defaultDialTimeout)
+			defer timer.Stop()
+
+			// Make room closing the idle connections
+			if closeIdle != nil {
+				closeIdle()
+			}
+		}
+		select {
+		case <-releasedCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return errConnLimitTimeout
+		}
+	}
+
+	// Done
+	return nil
+}
+
+func (l *connLimiter) release() {
+	// Lock access
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.open -= 1
+	l.wakeUpLocked()
+}
+
+// wakeUpLocked wakes up the dials waiting for a connection to be closed.
+func (l *connLimiter) wakeUpLocked() {
+	if l.releasedCh != nil {
+		close(l.releasedCh)
+		l.releasedCh = nil
+	}
+}
@@ -0,0 +1,147 @@
+package httpclient
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// Drain results passed to the DrainSource callback.
+const (
+	DrainCompleted int = iota + 1
+	DrainTimedOut
+	DrainCanceled
+)
+
+// -----------------------------------------------------------------------------
+
+// DrainSource stops sending new requests to the source with the given base url and calls done once the requests in
+// flight on it complete, with DrainCompleted, or once the timeout expires, with DrainTimedOut. In the latter case,
+// the connections still open to the source are closed, making the remaining requests fail. The source is not used
+// again until SetSourceOnline is called, which cancels a pending drain, leaving the connections open, and calls done
+// with DrainCanceled. The callback is called from a different goroutine.
+func (c *HttpClient) DrainSource(baseURL string, timeout time.Duration, done func(result int)) error {
+	if timeout <= 0 {
+		return errors.New("invalid parameter")
+	}
+	src := c.sourceByURL(baseURL)
+	if src == nil {
+		return errSourceNotFound
+	}
+
+	drainedCh, cancelCh := src.startDrain()
+	c.stateChanged()
+
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		result := DrainCompleted
+		select {
+		case <-drainedCh:
+		case <-cancelCh:
+			result = DrainCanceled
+		case <-timer.C:
+			result = DrainTimedOut
+			if !src.expireDrain(cancelCh) {
+				result = DrainCanceled
+			}
+		}
+		if done != nil {
+			done(result)
+		}
+	}()
+
+	// Done
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+func (src *Source) isDraining() bool {
+	return atomic.LoadInt32(&src.draining) != 0
+}
+
+// startDrain marks the source as draining and returns a channel closed once it has no requests in flight and another
+// one closed if the drain is canceled.
+func (src *Source) startDrain() (chan struct{}, chan struct{}) {
+	// Lock access
+	src.drainMtx.Lock()
+	defer src.drainMtx.Unlock()
+
+	if src.drainedCh == nil {
+		src.drainedCh = make(chan struct{})
+		src.drainCancelCh = make(chan struct{})
+		atomic.StoreInt32(&src.draining, 1)
+	}
+	drainedCh := src.drainedCh
+	src.checkDrainedLocked()
+	return drainedCh, src.drainCancelCh
+}
+
+// stopDrain lets the source be selected again, canceling the pending drain if any.
+func (src *Source) stopDrain() {
+	// Lock access
+	src.drainMtx.Lock()
+	defer src.drainMtx.Unlock()
+
+	atomic.StoreInt32(&src.draining, 0)
+	if src.drainCancelCh != nil {
+		close(src.drainCancelCh)
+	}
+	src.drainedCh = nil
+	src.drainCancelCh = nil
+}
+
+// expireDrain closes the connections still open to the source unless the drain was canceled. It returns false if it
+// was.
+func (src *Source) expireDrain(cancelCh chan struct{}) bool {
+	// Lock access
+	src.drainMtx.Lock()
+	defer src.drainMtx.Unlock()
+
+	select {
+	case <-cancelCh:
+		return false
+	default:
+	}
+	src.closeConns()
+	return true
+}
+
+// checkDrained signals the drain completion if the source has no requests in flight.
+func (src *Source) checkDrained() {
+	// Lock access
+	src.drainMtx.Lock()
+	defer src.drainMtx.Unlock()
+
+	src.checkDrainedLocked()
+}
+
+func (src *Source) checkDrainedLocked() {
+	if src.drainedCh == nil || src.InFlight() > 0 {
+		return
+	}
+	select {
+	case <-src.drainedCh:
+	default:
+		close(src.drainedCh)
+	}
+}
+
+// closeConns closes all the connections open to the source.
+func (src *Source) closeConns() {
+	// Lock access
+	src.connsMtx.Lock()
+	conns := make([]*sourceConn, 0, len(src.conns))
+	for sc := range src.conns {
+		conns = append(conns, sc)
+	}
+	src.connsMtx.Unlock()
+
+	for _, sc := range conns {
+		_ = sc.Close()
+	}
+}
@@ -11,6 +11,8 @@ import (
 const (
 	errorTypeIsTimeout = 1
 	errorTypeIsCanceled = 2
+	errorTypeIsProxy = 3
+	errorTypeIsTLS = 4
 )
 
 // -----------------------------------------------------------------------------
@@ -37,6 +39,18 @@ func (c *HttpClient) newError(wrappedErr error, message string, url string, stat
 	return &err
 }
 
+func (c *HttpClient) newTimeoutError(wrappedErr error, message string, url string) *Error {
+	err := c.newError(wrappedErr, message, url, 0)
+	err.errType = errorTypeIsTimeout
+	return err
+}
+
+func (c *HttpClient) newProxyError(wrappedErr error, url string) *Error {
+	err := c.newError(wrappedErr, errProxyConnectFailed, url, 0)
+	err.errType = errorTypeIsProxy
+	return err
+}
+
 // -----------------------------------------------------------------------------
 
 func (e *Error) URL() string {
@@ -62,6 +76,22 @@ func (e *Error) Error() string {
 	return s
 }
 
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrTimeout:
+		fallthrough
+	case ErrTransportTimeout:
+		return e.IsTimeout()
+	case ErrCanceled:
+		return e.IsCanceled()
+	case ErrProxyConnect:
+		return e.IsProxyError()
+	case ErrTLSCertificate:
+		return e.IsTLSError()
+	}
+	return false
+}
+
 func (e *Error) IsTimeout() bool {
 	return e.errType == errorTypeIsTimeout
 }
@@ -70,6 +100,16 @@ func (e *Error) IsCanceled() bool {
 	return e.errType == errorTypeIsCanceled
 }
 
+// IsProxyError returns true if the request failed while connecting through the source proxy.
+func (e *Error) IsProxyError() bool {
+	return e.errType == errorTypeIsProxy
+}
+
+// IsTLSError returns true if the request failed because the source certificate was rejected.
+func (e *Error) IsTLSError() bool {
+	return e.errType == errorTypeIsTLS
+}
+
 func (e *Error) IsNetworkError() bool {
 	if e.err != nil {
 		var netErr net.Error
@@ -82,3 +122,14 @@ func (e *Error) IsNetworkError() bool {
 	}
 	return false
 }
+
+func (e *Error) IsDNSError() bool {
+	if e.err != nil {
+		var netDnsErr *net.DNSError
+
+		if errors.As(e.err, &netDnsErr) {
+			return true
+		}
+	}
+	return false
+}
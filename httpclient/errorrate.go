@@ -0,0 +1,105 @@
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+// ErrorRateOptions specifies when a source is considered degraded based on its error rate.
+type ErrorRateOptions struct {
+	// Threshold is the error rate, between 0 and 1, above which the source is considered degraded.
+	Threshold float64
+
+	// RecoveryThreshold is the error rate below which a degraded source is considered recovered. It must be lower
+	// than Threshold to avoid flapping. Defaults to half of Threshold.
+	RecoveryThreshold float64
+
+	// Window is the approximate amount of recent requests the error rate is computed over. The rate is an
+	// exponential moving average and no event is raised until Window requests were executed.
+	Window int
+}
+
+// DegradedError is passed to the event handler along with the ServerDegradedEvent and ServerRecoveredEvent events.
+type DegradedError struct {
+	// Rate is the current error rate of the source, between 0 and 1.
+	Rate float64
+}
+
+type errorRateTracker struct {
+	mtx      sync.Mutex
+	rate     float64
+	samples  int
+	degraded bool
+}
+
+// -----------------------------------------------------------------------------
+
+// SetErrorRateThreshold enables raising a ServerDegradedEvent when the error rate of a source crosses the threshold
+// and a ServerRecoveredEvent when it goes back below the recovery threshold. These events do not affect the source
+// online status. Passing a zero threshold disables them. It must be called before executing requests.
+func (c *HttpClient) SetErrorRateThreshold(opts ErrorRateOptions) error {
+	if opts.RecoveryThreshold == 0 {
+		opts.RecoveryThreshold = opts.Threshold / 2
+	}
+	if opts.Threshold < 0 || opts.Threshold > 1 || opts.RecoveryThreshold < 0 ||
+		(opts.Threshold > 0 && (opts.RecoveryThreshold >= opts.Threshold || opts.Window <= 0)) {
+		return errors.New("invalid parameter")
+	}
+	c.errorRate = opts
+	return nil
+}
+
+func (e *DegradedError) Error() string {
+	return fmt.Sprintf("source error rate is %.2f%%", e.Rate*100)
+}
+
+// -----------------------------------------------------------------------------
+
+// trackErrorRate updates the error rate of the source and raises the degraded and recovered events if needed.
+func (c *HttpClient) trackErrorRate(src *Source, failed bool) {
+	opts := c.errorRate
+	if opts.Threshold == 0 {
+		return
+	}
+
+	sample := 0.0
+	if failed {
+		sample = 1.0
+	}
+	alpha := 2.0 / float64(opts.Window+1)
+
+	t := &src.errorRate
+	t.mtx.Lock()
+	t.rate += alpha * (sample - t.rate)
+	t.samples += 1
+	rate := t.rate
+
+	eventType := 0
+	if t.samples >= opts.Window {
+		if !t.degraded && rate > opts.Threshold {
+			t.degraded = true
+			eventType = ServerDegradedEvent
+		} else if t.degraded && rate < opts.RecoveryThreshold {
+			t.degraded = false
+			eventType = ServerRecoveredEvent
+		}
+	}
+	t.mtx.Unlock()
+
+	if eventType != 0 {
+		c.raiseEvent(eventType, src.ID(), &DegradedError{
+			Rate: rate,
+		})
+	}
+}
+
+// ErrorRate returns the current error rate of the source, between 0 and 1. It is only computed if an error rate
+// threshold is set.
+func (src *Source) ErrorRate() float64 {
+	src.errorRate.mtx.Lock()
+	defer src.errorRate.mtx.Unlock()
+	return src.errorRate.rate
+}
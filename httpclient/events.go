@@ -0,0 +1,104 @@
+package httpclient
+
+import (
+	"errors"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	// EventDeliverySync calls the event handler in the goroutine raising the event, before it continues, so each
+	// event is delivered exactly once and the events of a request are delivered in order. Events raised by concurrent
+	// requests can be delivered concurrently and in any order, so the handler must be safe for concurrent use. A slow
+	// handler delays the requests. This is the default.
+	EventDeliverySync int = iota + 1
+
+	// EventDeliveryAsync queues the events and calls the event handler from a single goroutine, one event at a time,
+	// in the order they were raised, keeping the handler off the request path. The queue is not bounded, so a slow
+	// handler increases the memory usage. Events are delivered at most once: the ones still queued are lost if the
+	// process exits.
+	EventDeliveryAsync
+)
+
+// -----------------------------------------------------------------------------
+
+type eventQueue struct {
+	mtx     sync.Mutex
+	events  []queuedEvent
+	running bool
+}
+
+type queuedEvent struct {
+	handler   EventHandler
+	eventType int
+	sourceID  int
+	err       error
+}
+
+// -----------------------------------------------------------------------------
+
+// SetEventDelivery sets how the events are delivered to the event handler, EventDeliverySync or EventDeliveryAsync.
+// It must be called before executing requests.
+func (c *HttpClient) SetEventDelivery(mode int) error {
+	if mode != EventDeliverySync && mode != EventDeliveryAsync {
+		return errors.New("invalid parameter")
+	}
+	c.asyncEvents = mode == EventDeliveryAsync
+
+	// Done
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// raiseEvent delivers the event to the event handler, if any, according to the delivery mode.
+func (c *HttpClient) raiseEvent(eventType int, sourceID int, err error) {
+	handler := c.eventHandler
+	if handler == nil {
+		return
+	}
+	if !c.asyncEvents {
+		handler(eventType, sourceID, err)
+		return
+	}
+	c.events.push(queuedEvent{
+		handler:   handler,
+		eventType: eventType,
+		sourceID:  sourceID,
+		err:       err,
+	})
+}
+
+// push queues the event and starts the delivery goroutine if it is not running. The goroutine exits once the queue
+// is empty, so idle clients do not keep it alive.
+func (q *eventQueue) push(ev queuedEvent) {
+	// Lock access
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.events = append(q.events, ev)
+	if !q.running {
+		q.running = true
+		go q.deliver()
+	}
+}
+
+func (q *eventQueue) deliver() {
+	for {
+		// Lock access
+		q.mtx.Lock()
+		events := q.events
+		q.events = nil
+		if len(events) == 0 {
+			q.running = false
+			q.mtx.Unlock()
+			return
+		}
+		q.mtx.Unlock()
+
+		for _, ev := range events {
+			ev.handler(ev.eventType, ev.sourceID, ev.err)
+		}
+	}
+}
@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/randlabs/go-loadbalancer/v2"
 )
 
 // -----------------------------------------------------------------------------
@@ -15,6 +20,18 @@ import (
 const (
 	errUnableToExecuteRequest = "failed to execute http request"
 	errNoAvailableServer      = "no available upstream server"
+	errTransportTimeout       = "transport timeout"
+	errDNSResolutionFailed    = "failed to resolve source hostname"
+	errExpectationFailed      = "source rejected the expect header"
+	errMissingResponseHeader  = "response lacks the required header"
+	errInvalidResponse        = "response rejected by the source validator"
+	errRedirectLoop           = "source redirected too many times"
+)
+
+const (
+	maxRedirects       = 10
+	maxDrainBodySize   = 64 << 10
+	maxMirrorsInFlight = 64
 )
 
 // -----------------------------------------------------------------------------
@@ -70,55 +87,142 @@ func (c *HttpClient) exec(req *Request) error {
 		}
 	}
 
-	// Initialize retry counter
+	// Join an identical request in flight, if any, to share its response. The requests that share it do not send a
+	// copy to the shadow sources, as the one that gets it already did.
+	coalesceKey := req.coalesceKey()
+	var leadFlight *flight
+	var joinedFlight *flight
+	if len(coalesceKey) > 0 {
+		f, isLeader := c.flights.join(coalesceKey)
+		if isLeader {
+			leadFlight = f
+		} else {
+			joinedFlight = f
+		}
+	}
+	defer func() {
+		// Unblock the requests waiting for this one if it ends before getting a response
+		if leadFlight != nil {
+			c.flights.finish(leadFlight, nil, nil)
+		}
+	}()
+
+	// Send a copy of the request to the shadow sources
+	if req.pinned == nil && joinedFlight == nil {
+		c.mirrorRequest(req, getBody)
+	}
+
+	req.timings = nil
+	req.selectionTrace = nil
+	reqCtx := withRequestID(req.ctx, req.requestID)
+
+	// Initialize retry counters
 	retryCounter := 0
+	silentRetryCounter := 0
+	var staleSource *Source
+	var zone string
+
+	// Skip the excluded sources and the ones already attempted
+	excluded := make([]*Source, 0, len(req.excludeSources))
+	for _, baseURL := range req.excludeSources {
+		if src := c.sourceByURL(baseURL); src != nil {
+			excluded = append(excluded, src)
+		}
+	}
+	var lastErr error
 
 	// Loop
 	for {
 		var netErr net.Error
+		var dnsErr *net.DNSError
+
+		// Share the response of the joined request on the first attempt
+		var sharedSrc *Source
+		var sharedResp *http.Response
+		if joinedFlight != nil {
+			sharedSrc, sharedResp = joinedFlight.wait(req.ctx)
+			joinedFlight = nil
+		}
 
 		// Get next available server
-		srv := c.lb.Next()
-		if srv == nil {
-			return c.newError(nil, errNoAvailableServer, req.url, 0)
+		var srv *loadbalancer.Server
+		var nextErr error
+		var trace *SelectionAttempt
+		if req.traceSelection {
+			trace = &SelectionAttempt{}
+		}
+		if req.pinned != nil {
+			// The source was already selected
+			srv = req.pinned.srv
+		} else if sharedResp != nil {
+			// The source was selected by the shared request
+			srv = sharedSrc.srv
+		} else if staleSource != nil {
+			// Retry on the source whose connection was stale
+			srv = staleSource.srv
+		} else {
+			srv, nextErr = c.nextServerInZone(req.intent, excluded, zone, trace)
+			if req.waitForSlot && errors.Is(nextErr, ErrOverloaded) {
+				srv, nextErr = c.waitForSlot(req.ctx, req.intent, req.priority, excluded)
+				if nextErr == ErrTimeout || nextErr == ErrCanceled {
+					return nextErr
+				}
+			}
+		}
+		if trace != nil {
+			var selected *Source
+			if srv != nil {
+				selected = srv.UserData().(*Source)
+			}
+			trace.finish(selected, c.sourceList())
+			req.selectionTrace = append(req.selectionTrace, *trace)
+		}
+		if nextErr != nil {
+			if lastErr != nil {
+				// All the allowed sources were attempted, so return the error of the last one
+				req.setAttemptResult(nil, lastErr)
+				if (c.fallback != nil || c.cache != nil) && req.ctx.Err() == nil {
+					return c.execFallback(req, getBody(), lastErr)
+				}
+				return lastErr
+			}
+			err = c.newError(nextErr, errNoAvailableServer, req.url, 0)
+			req.setAttemptResult(nil, err)
+			if c.fallback != nil || c.cache != nil {
+				return c.execFallback(req, getBody(), err)
+			}
+			return err
 		}
 
 		src := srv.UserData().(*Source)
+		excluded = append(excluded, src)
+		if req.zoneAffinity && len(zone) == 0 {
+			// Retries prefer the zone of the first source
+			zone = src.opts.Zone
+		}
 
 		// Create the final url
-		url := src.baseURL + req.url
+		url := src.BaseURL() + req.url
 
 		// Create a new http request
-		httpReq, err = http.NewRequest(req.method, url, getBody())
+		httpReq, err = c.newHttpRequest(req, src, getBody())
 		if err != nil {
 			err = c.newError(err, errUnableToExecuteRequest, url, 0)
-			src.setLastError(err)
+			c.setSourceLastError(src, err)
+			req.setAttemptResult(src, err)
 			return err
 		}
 
-		// Add load balancer source headers
-		httpReq.Header = src.header.Clone()
-
-		// Add request headers
-		if req.headers != nil {
-			for k, v := range req.headers {
-				vLen := len(v)
-				if vLen > 0 {
-					httpReq.Header.Set(k, v[0])
-					for vIdx := 1; vIdx < vLen; vIdx++ {
-						httpReq.Header.Add(k, v[vIdx])
-					}
-				}
-			}
-		}
-
 		// Create http client requester
 		client := http.Client{
-			Transport: c.transport,
+			Transport:     c.transportFor(src),
+			CheckRedirect: checkRedirect,
 		}
 
 		// Build callback info
 		upstreamOffline := false
+		redirectLoop := false
+		tlsFailure := false
 		retry := false
 		execResult := Response{
 			fullUrl:         url,
@@ -126,39 +230,178 @@ func (c *HttpClient) exec(req *Request) error {
 			retryCount:      retryCounter,
 			upstreamOffline: &upstreamOffline,
 			retry:           &retry,
+			requestID:       req.requestID,
 		}
 
 		// Establish a new context with the timeout
-		ctx, cancelCtx := context.WithTimeout(req.ctx, req.timeout)
+		ctx, cancelCtx := context.WithTimeout(reqCtx, req.timeout)
+
+		// Set up the timings recorder if requested
+		attemptCtx := c.withIdleTrace(c.withConnAgeTrace(c.withConnStatsTrace(withSource(ctx, src), src)))
+		attemptCtx, usage := c.withConnUsageTrace(attemptCtx)
+		var recorder *timingsRecorder
+		if req.captureTimings {
+			recorder = newTimingsRecorder(src.ID())
+			attemptCtx = recorder.withTrace(attemptCtx)
+		}
 
-		// Execute real request
-		execResult.Response, err = client.Do(httpReq.WithContext(ctx))
-		if err != nil {
-			if errors.Is(err, context.DeadlineExceeded) {
-				// Deadline exceeded?
-				err = ErrTimeout
+		// Execute real request. A shared response was already accounted for by the request that got it, so it does not
+		// count toward the source stats and state.
+		accounted := sharedResp == nil
+		if accounted {
+			atomic.AddInt32(&src.inFlight, 1)
+			if retryCounter+silentRetryCounter > 0 {
+				atomic.AddInt64(&src.retries, 1)
+			}
+		}
+		startTime := time.Now()
+		if sharedResp != nil {
+			execResult.Response, err = sharedResp, nil
+		} else {
+			execResult.Response, err = client.Do(httpReq.WithContext(attemptCtx))
+		}
+		if staleSource == nil && ctx.Err() == nil && usage.isStale(err, isIdempotentMethod(req.method)) {
+			// The source closed the reused connection, so retry once on a new one
+			cancelCtx()
+			src.releaseSlot()
+			src.closeIdleConns()
+			req.setAttemptResult(src, err)
+
+			staleSource = src
+			continue
+		}
+		staleSource = nil
+		if leadFlight != nil {
+			c.flights.finish(leadFlight, src, execResult.Response)
+			leadFlight = nil
+		}
+		if recorder != nil {
+			timings := recorder.finish()
+			req.timings = append(req.timings, timings)
+			execResult.timings = &timings
+		}
+		elapsed := time.Since(startTime)
+		if accounted {
+			src.trackSLA(elapsed, err)
+		}
+		isSlow := err == nil && src.slowThreshold > 0 && elapsed > src.slowThreshold
+		execResult.notSent = err != nil && isRequestNotSent(attemptCtx, err)
+		if err == nil {
+			if accounted {
+				atomic.StoreInt64(&c.lastReachableTimestamp, time.Now().UnixNano())
+				src.resetDNSFailures()
+			}
+		} else {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				// The request deadline or the caller's context expired first
+				if errors.Is(ctxErr, context.DeadlineExceeded) {
+					err = ErrTimeout
+				} else {
+					err = ErrCanceled
+				}
+			} else if isProxyConnectError(attemptCtx, err) {
+				// The proxy is to blame, not the source
+				err = c.newProxyError(err, url)
+			} else if isTLSCertificateError(err) {
+				// A configuration problem that retrying does not fix
+				tlsFailure = true
+
+				err = c.newTLSError(err, url)
+				c.raiseEvent(TLSErrorEvent, src.ID(), err)
+			} else if errors.Is(err, ErrRedirectLoop) {
+				// The source is likely misconfigured
+				upstreamOffline = true
+				redirectLoop = true
+
+				err = c.newError(err, errRedirectLoop, url, 0)
+			} else if errors.As(err, &dnsErr) {
+				// DNS failures are usually transient and affect all the sources, so they only count as a source
+				// failure if other sources were reachable since they started and none of them is failing too.
+				if c.isIsolatedDNSFailure(src) {
+					upstreamOffline = true
+				}
+
+				err = c.newError(err, errDNSResolutionFailed, url, 0)
 			} else if errors.As(err, &netErr) && netErr.Timeout() {
-				// Network timeout?
-				srv.SetOffline()
+				// Transport timeout (dial, response headers, etc.)
+				upstreamOffline = true
 
-				err = ErrTimeout
+				err = c.newTimeoutError(err, errTransportTimeout, url)
 			} else if errors.Is(err, context.Canceled) {
 				// Canceled?
 				err = ErrCanceled
 			} else {
 				// Other type of error
-				srv.SetOffline()
+				upstreamOffline = true
 
 				err = c.newError(err, errUnableToExecuteRequest, url, 0)
 			}
 		}
 
+		// A source rejecting the Expect header did not receive the body, so the request can be sent to another one
+		expectFailed := err == nil && execResult.StatusCode == http.StatusExpectationFailed &&
+			len(httpReq.Header.Get("Expect")) > 0
+		invalidResponse := false
+		if expectFailed {
+			err = c.newError(nil, errExpectationFailed, url, execResult.StatusCode)
+		} else if err == nil && !src.hasRequiredHeader(execResult.Response) {
+			// The source is likely misconfigured or the request was misrouted
+			upstreamOffline = !c.statusErrorPolicy.NoMarkDown
+
+			err = c.newError(nil, errMissingResponseHeader, url, execResult.StatusCode)
+		} else if err == nil {
+			// Let the source validator reject an otherwise valid response
+			healthy, retryOther := src.validateResponse(execResult.Response)
+			upstreamOffline = !healthy
+			if retryOther {
+				invalidResponse = true
+
+				err = c.newError(nil, errInvalidResponse, url, execResult.StatusCode)
+			}
+		}
+
+		// Keep a copy of the response to use if the sources become unavailable. It is only stored once the callback
+		// accepts it.
+		var cached *cacheEntry
+		if err == nil && accounted && c.cache != nil && req.method == "GET" {
+			cached = c.cache.capture(req.url, c.callerHeader(req), execResult.Response)
+		}
+
 		// Set error in callback
 		execResult.err = err
 
+		// If the request was not sent, silently retry on the next server if allowed. Idempotent requests are also
+		// retried if the source is stuck in a redirect loop. Transport errors are retried if they match the request
+		// retry predicate and responses rejected by the source validator if it asks so.
+		retryableErr := err != nil && execResult.Response == nil && req.retryIf != nil && req.retryIf(err)
+		if ((execResult.notSent && req.retryIfNotSent) || expectFailed || invalidResponse || retryableErr ||
+			(redirectLoop && isIdempotentMethod(req.method))) && !tlsFailure && ctx.Err() == nil &&
+			silentRetryCounter < c.SourcesCount()-1 && req.canRetry(retryCounter+silentRetryCounter) {
+			if execResult.Response != nil {
+				drainBody(execResult.Response.Body)
+			}
+			cancelCtx()
+			if accounted {
+				src.releaseSlot()
+				c.setSourceLastError(src, err)
+				c.raiseRequestEvent(srv, err)
+				if upstreamOffline {
+					src.reportFailure()
+				}
+			}
+			req.setAttemptResult(src, err)
+			lastErr = err
+
+			silentRetryCounter += 1
+			continue
+		}
+
 		// Call the callback
 		err = req.callback(ctx, execResult)
-		if err != nil {
+		if cached != nil && err == nil && !retry {
+			c.cache.store(cached)
+		}
+		if err != nil && !isOwnError(err) {
 			if errors.Is(err, context.DeadlineExceeded) {
 				err = ErrTimeout
 			} else if errors.As(err, &netErr) && netErr.Timeout() {
@@ -168,29 +411,41 @@ func (c *HttpClient) exec(req *Request) error {
 			}
 		}
 
-		// To avoid defer calling inside a for loop and warnings, we call it here
-		cancelCtx()
-
-		// Close the response body if one exist
+		// Drain and close the response body if one exist, so the connection can be reused by the next attempt. It must
+		// be done before canceling the context, which would close the connection.
 		if execResult.Response != nil {
-			_ = execResult.Response.Body.Close()
+			drainBody(execResult.Response.Body)
 		}
 
-		// Set the last error (even success)
-		src.setLastError(err)
-
-		// Raise callback
-		c.raiseRequestEvent(srv, err)
+		// To avoid defer calling inside a for loop and warnings, we call it here
+		cancelCtx()
+		req.setAttemptResult(src, err)
+		lastErr = err
+		if accounted {
+			src.releaseSlot()
+
+			// Set the last error (even success)
+			c.setSourceLastError(src, err)
+
+			// Raise callback
+			c.raiseRequestEvent(srv, err)
+			if !errors.Is(err, ErrCanceled) {
+				c.trackErrorRate(src, err != nil)
+				c.trackAdaptiveWeight(src, elapsed, err != nil)
+				c.trackErrorPenalty(src, err != nil)
+			}
 
-		// Set server online/offline based on the callback response
-		if !upstreamOffline {
-			srv.SetOnline()
-		} else {
-			srv.SetOffline()
+			// Set server online/offline based on the callback response. Slow responses also count as failures and
+			// certificate errors as neither.
+			if upstreamOffline || isSlow {
+				src.reportFailure()
+			} else if !tlsFailure {
+				src.reportSuccess()
+			}
 		}
 
-		// Should we retry on next server?
-		if !retry {
+		// Should we retry on next server? Certificate errors are never retried.
+		if !(retry && !tlsFailure && req.canRetry(retryCounter+silentRetryCounter)) {
 			break
 		}
 
@@ -201,3 +456,147 @@ func (c *HttpClient) exec(req *Request) error {
 	// Done
 	return err
 }
+
+// checkRedirect limits the amount of redirects and returns an error containing the redirect chain once exceeded.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) < maxRedirects {
+		return nil
+	}
+	chain := make([]string, 0, len(via)+1)
+	for _, r := range via {
+		chain = append(chain, r.URL.String())
+	}
+	chain = append(chain, req.URL.String())
+	return fmt.Errorf("%w [chain=%s]", ErrRedirectLoop, strings.Join(chain, " -> "))
+}
+
+// execFallback passes a cached response or the one provided by the fallback handler to the callback.
+func (c *HttpClient) execFallback(req *Request, body io.ReadCloser, noServerErr error) error {
+	httpReq, err := http.NewRequest(req.method, req.url, body)
+	if err != nil {
+		return c.newError(err, errUnableToExecuteRequest, req.url, 0)
+	}
+	httpReq.Header = c.callerHeader(req)
+	if len(req.requestID) > 0 {
+		httpReq.Header.Set(c.requestIDHeader, req.requestID)
+	}
+	ctx := withRequestID(req.ctx, req.requestID)
+	httpReq = httpReq.WithContext(ctx)
+
+	// Prefer a cached response
+	var resp *http.Response
+	if c.cache != nil && req.method == "GET" {
+		resp = c.cache.lookup(req.url, httpReq.Header)
+	}
+	if resp == nil && c.fallback != nil {
+		resp, err = c.fallback(httpReq)
+		if err != nil {
+			return err
+		}
+	}
+	if resp == nil {
+		return noServerErr
+	}
+	defer func() {
+		if resp.Body != nil {
+			_ = resp.Body.Close()
+		}
+	}()
+
+	// Pass the fallback response to the callback
+	upstreamOffline := false
+	retry := false
+	return req.callback(ctx, Response{
+		Response:        resp,
+		fullUrl:         req.url,
+		isFallback:      true,
+		upstreamOffline: &upstreamOffline,
+		retry:           &retry,
+		requestID:       req.requestID,
+	})
+}
+
+// callerHeader returns the default headers merged with the request ones, leaving out the source headers.
+func (c *HttpClient) callerHeader(req *Request) http.Header {
+	header := c.defaultHeader.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	mergeHeader(header, req.headers)
+	return header
+}
+
+func (c *HttpClient) newHttpRequest(req *Request, src *Source, body io.ReadCloser) (*http.Request, error) {
+	// Create a new http request
+	httpReq, err := http.NewRequest(req.method, src.BaseURL()+req.url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add headers with the following precedence: request > source > client defaults
+	httpReq.Header = c.defaultHeader.Clone()
+	if httpReq.Header == nil {
+		httpReq.Header = make(http.Header)
+	}
+	mergeHeader(httpReq.Header, src.header)
+	mergeHeader(httpReq.Header, req.headers)
+	if len(req.requestID) > 0 {
+		httpReq.Header.Set(c.requestIDHeader, req.requestID)
+	}
+
+	// The shared transport keeps connections alive so ask to close it after the request if needed
+	httpReq.Close = src.opts.DisableKeepAlive
+
+	// Let the source reject the request before the body is sent
+	if src.opts.ExpectContinue && body != nil {
+		httpReq.Header.Set("Expect", "100-continue")
+	}
+
+	// Done
+	return httpReq, nil
+}
+
+func (c *HttpClient) mirrorRequest(req *Request, getBody func() io.ReadCloser) {
+	// Only idempotent requests are mirrored
+	shadowSources := c.shadowSourceList()
+	if len(shadowSources) == 0 || !isIdempotentMethod(req.method) {
+		return
+	}
+
+	for _, src := range shadowSources {
+		// Drop the copy if the shadow source is too slow to keep up
+		select {
+		case src.mirrorSem <- struct{}{}:
+		default:
+			continue
+		}
+
+		httpReq, err := c.newHttpRequest(req, src, getBody())
+		if err != nil {
+			<-src.mirrorSem
+			src.setLastError(err)
+			continue
+		}
+
+		// Send the request in the background and discard the response. The shadow request is not bound to the
+		// original request context so canceling it does not affect the mirrored one.
+		go func(src *Source, httpReq *http.Request) {
+			client := http.Client{
+				Transport: c.transportFor(src),
+			}
+
+			ctx, cancelCtx := context.WithTimeout(context.Background(), req.timeout)
+			defer cancelCtx()
+
+			atomic.AddInt32(&src.inFlight, 1)
+			resp, err := client.Do(httpReq.WithContext(withSource(ctx, src)))
+			if err == nil {
+				drainBody(resp.Body)
+			}
+			src.releaseSlot()
+			<-src.mirrorSem
+
+			src.setLastError(err)
+		}(src, httpReq)
+	}
+}
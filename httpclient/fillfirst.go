@@ -0,0 +1,52 @@
+package httpclient
+
+import (
+	"sort"
+
+	"github.com/randlabs/go-loadbalancer/v2"
+)
+
+// -----------------------------------------------------------------------------
+
+// SetFillFirst enables or disables the fill-first mode. On fill-first mode, requests are sent to the source with the
+// highest weight until its in-flight requests reach its Capacity, then they overflow to the next one, so fewer
+// sources are kept busy under low load. Sources without a capacity are never considered full. If all the sources are
+// full, requests are spread with the weighted round-robin. The traffic split and custom selector take precedence.
+func (c *HttpClient) SetFillFirst(enable bool) {
+	c.fillFirst = enable
+}
+
+// -----------------------------------------------------------------------------
+
+// selectFillFirst selects the first source with free capacity in weight order. On read intent, read-only sources are
+// filled first. The sources are tried in a single selection, each of them as a preference.
+func (c *HttpClient) selectFillFirst(intent int, accept loadbalancer.SelectFilter) (*loadbalancer.Server, error) {
+	sources := c.sourceList()
+	ordered := make([]*Source, len(sources))
+	copy(ordered, sources)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if intent == requestIntentRead {
+			if readOnly := isReadOnlySource(ordered[i].srv); readOnly != isReadOnlySource(ordered[j].srv) {
+				return readOnly
+			}
+		}
+		return ordered[i].srv.Weight() > ordered[j].srv.Weight()
+	})
+
+	// If all the sources are full or unavailable, any of them is selected
+	prefer := make([]loadbalancer.SelectFilter, 0, len(ordered))
+	for _, src := range ordered {
+		if src.isFull() {
+			continue
+		}
+		target := src.srv
+		prefer = append(prefer, func(srv *loadbalancer.Server) bool {
+			return srv == target
+		})
+	}
+	return c.selectServer(intent, accept, prefer...)
+}
+
+func (src *Source) isFull() bool {
+	return src.opts.Capacity > 0 && src.InFlight() >= src.opts.Capacity
+}
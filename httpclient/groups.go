@@ -0,0 +1,82 @@
+package httpclient
+
+import (
+	"errors"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+type sourceGroups struct {
+	mtx      sync.Mutex
+	previous string
+}
+
+// -----------------------------------------------------------------------------
+
+var errGroupNotFound = errors.New("group not found")
+
+// -----------------------------------------------------------------------------
+
+// ActivateGroup sends all the requests to the sources of the given group, set with the Group source option, for e.g.
+// to switch from a blue to a green deployment at once. The sources of the other groups and the ones without a group
+// are held in reserve: they are not selected but are still health checked. The previously active group is
+// remembered, so RollbackGroup can switch back to it. Passing an empty name uses all the sources again.
+func (c *HttpClient) ActivateGroup(name string) error {
+	if len(name) > 0 && !c.hasGroup(name) {
+		return errGroupNotFound
+	}
+
+	// Lock access
+	c.groups.mtx.Lock()
+	defer c.groups.mtx.Unlock()
+
+	active := c.ActiveGroup()
+	if active != name {
+		c.groups.previous = active
+		c.activeGroup.Store(name)
+	}
+
+	// Done
+	return nil
+}
+
+// ActiveGroup returns the name of the group receiving all the requests or an empty string if no group was activated.
+func (c *HttpClient) ActiveGroup() string {
+	name, _ := c.activeGroup.Load().(string)
+	return name
+}
+
+// RollbackGroup activates again the group that was active before the last call to ActivateGroup.
+func (c *HttpClient) RollbackGroup() error {
+	// Lock access
+	c.groups.mtx.Lock()
+	defer c.groups.mtx.Unlock()
+
+	active := c.ActiveGroup()
+	if active == c.groups.previous {
+		return errGroupNotFound
+	}
+	c.activeGroup.Store(c.groups.previous)
+	c.groups.previous = active
+
+	// Done
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+func (c *HttpClient) hasGroup(name string) bool {
+	for _, src := range c.sourceList() {
+		if src.opts.Group == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isInActiveGroup returns true if the source belongs to the active group or no group is active.
+func (c *HttpClient) isInActiveGroup(src *Source) bool {
+	active := c.ActiveGroup()
+	return len(active) == 0 || src.opts.Group == active
+}
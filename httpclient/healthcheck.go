@@ -0,0 +1,271 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	errHealthCheckFailed = "health check failed"
+)
+
+// -----------------------------------------------------------------------------
+
+// HealthCheckOptions specifies how the sources are actively checked.
+type HealthCheckOptions struct {
+	// Path is the resource requested on each source, for e.g. "/health". A 2xx status code marks the source as
+	// healthy.
+	Path string
+
+	// Interval sets the time between checks.
+	Interval time.Duration
+
+	// Timeout sets the maximum time to wait for a check to complete. Defaults to the interval.
+	Timeout time.Duration
+
+	// Validator, if set, is called with the responses having a 2xx status code so it can inspect the headers or the
+	// body. Returning an error marks the source as unhealthy. The body is closed after the call.
+	Validator func(resp *http.Response) error
+
+	// Jitter, from 0 to 1, randomly varies the time between checks by up to the given fraction of the interval, and
+	// delays the first check by up to the same amount, so many clients checking the same sources do not do it in
+	// lockstep. Zero disables it.
+	Jitter float64
+}
+
+type healthChecker struct {
+	mtx    sync.Mutex
+	opts   HealthCheckOptions
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// -----------------------------------------------------------------------------
+
+// EnableHealthCheck starts checking the sources periodically. Healthy sources are marked as online and unhealthy ones
+// count as failures toward their MaxFails limit. On warmup mode, a successful check promotes a probing source. The
+// first check is executed immediately unless a jitter is set.
+func (c *HttpClient) EnableHealthCheck(opts HealthCheckOptions) error {
+	// Check options
+	if len(opts.Path) == 0 || opts.Path[0] != '/' || opts.Interval <= 0 || opts.Timeout < 0 || opts.Jitter < 0 ||
+		opts.Jitter > 1 {
+		return errors.New("invalid parameter")
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = opts.Interval
+	}
+
+	// Stop the current checker if any
+	c.DisableHealthCheck()
+
+	c.healthCheck.mtx.Lock()
+	defer c.healthCheck.mtx.Unlock()
+
+	c.healthCheck.opts = opts
+	c.healthCheck.stopCh = make(chan struct{})
+
+	c.healthCheck.wg.Add(1)
+	go c.healthCheckLoop(opts, c.healthCheck.stopCh)
+
+	// Done
+	return nil
+}
+
+// DisableHealthCheck stops checking the sources.
+func (c *HttpClient) DisableHealthCheck() {
+	c.healthCheck.mtx.Lock()
+	if c.healthCheck.stopCh != nil {
+		close(c.healthCheck.stopCh)
+		c.healthCheck.stopCh = nil
+	}
+	c.healthCheck.mtx.Unlock()
+
+	c.healthCheck.wg.Wait()
+}
+
+// ProbeSource runs the health check against the source with the given base url right now, updates its state the same
+// way the background checker does and returns the result. The health check must be enabled.
+func (c *HttpClient) ProbeSource(baseURL string) error {
+	src := c.sourceByURL(baseURL)
+	if src == nil {
+		return errSourceNotFound
+	}
+
+	c.healthCheck.mtx.Lock()
+	enabled := c.healthCheck.stopCh != nil
+	opts := c.healthCheck.opts
+	c.healthCheck.mtx.Unlock()
+	if !enabled {
+		return errHealthCheckDisabled
+	}
+
+	return c.probeSource(context.Background(), src, opts)
+}
+
+// Warm checks all the sources concurrently, opening a connection to each one, and returns the result of each check
+// keyed by base url. If the health check is enabled, a health check is done, else a HEAD request of the root path is
+// sent and any response is considered a success. The state of the sources is not modified.
+func (c *HttpClient) Warm(ctx context.Context) map[string]error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	c.healthCheck.mtx.Lock()
+	enabled := c.healthCheck.stopCh != nil
+	opts := c.healthCheck.opts
+	c.healthCheck.mtx.Unlock()
+
+	sources := c.sourceList()
+
+	results := make(map[string]error, len(sources))
+	resultsMtx := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src *Source) {
+			defer wg.Done()
+
+			var err error
+			if enabled {
+				err = c.checkSource(ctx, src, opts)
+			} else {
+				err = c.pingSource(ctx, src)
+			}
+
+			resultsMtx.Lock()
+			results[src.BaseURL()] = err
+			resultsMtx.Unlock()
+		}(src)
+	}
+	wg.Wait()
+
+	// Done
+	return results
+}
+
+// -----------------------------------------------------------------------------
+
+func (c *HttpClient) healthCheckLoop(opts HealthCheckOptions, stopCh chan struct{}) {
+	defer c.healthCheck.wg.Done()
+
+	// Each client uses its own seed so their checks spread out
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	maxJitter := opts.Jitter * float64(opts.Interval)
+
+	timer := time.NewTimer(time.Duration(rnd.Float64() * maxJitter))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-timer.C:
+		}
+
+		// Schedule the next check from the start of this one, varied within +/- the jitter
+		next := time.Now().Add(opts.Interval + time.Duration((rnd.Float64()*2-1)*maxJitter))
+
+		c.checkAllSources(opts, stopCh)
+
+		timer.Reset(time.Until(next))
+	}
+}
+
+func (c *HttpClient) checkAllSources(opts HealthCheckOptions, stopCh chan struct{}) {
+	// Cancel pending checks if the health checker is stopped
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	go func() {
+		select {
+		case <-stopCh:
+			cancelCtx()
+		case <-ctx.Done():
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for _, src := range c.sourceList() {
+		wg.Add(1)
+		go func(src *Source) {
+			defer wg.Done()
+
+			_ = c.probeSource(ctx, src, opts)
+		}(src)
+	}
+	wg.Wait()
+}
+
+// probeSource checks the source and updates its state with the result unless the context was canceled.
+func (c *HttpClient) probeSource(ctx context.Context, src *Source, opts HealthCheckOptions) error {
+	err := c.checkSource(ctx, src, opts)
+	if ctx.Err() != nil {
+		return err
+	}
+	if err == nil {
+		src.srv.SetOnline()
+	} else {
+		src.srv.SetOffline()
+	}
+	c.setSourceLastError(src, err)
+
+	// Done
+	return err
+}
+
+func (c *HttpClient) checkSource(ctx context.Context, src *Source, opts HealthCheckOptions) error {
+	url := src.BaseURL() + opts.Path
+
+	ctx, cancelCtx := context.WithTimeout(ctx, opts.Timeout)
+	defer cancelCtx()
+
+	httpReq, err := c.newHttpRequest(&Request{method: "GET", url: opts.Path}, src, nil)
+	if err != nil {
+		return c.newError(err, errHealthCheckFailed, url, 0)
+	}
+
+	client := http.Client{
+		Transport: c.transportFor(src),
+	}
+	resp, err := client.Do(httpReq.WithContext(withSource(ctx, src)))
+	if err != nil {
+		return c.newError(err, errHealthCheckFailed, url, 0)
+	}
+	defer drainBody(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return c.newError(nil, errHealthCheckFailed, url, resp.StatusCode)
+	}
+	if opts.Validator != nil {
+		err = opts.Validator(resp)
+		if err != nil {
+			return c.newError(err, errHealthCheckFailed, url, resp.StatusCode)
+		}
+	}
+
+	// Done
+	return nil
+}
+
+func (c *HttpClient) pingSource(ctx context.Context, src *Source) error {
+	url := src.BaseURL() + "/"
+
+	httpReq, err := c.newHttpRequest(&Request{method: "HEAD", url: "/"}, src, nil)
+	if err != nil {
+		return c.newError(err, errUnableToExecuteRequest, url, 0)
+	}
+
+	resp, err := c.transportFor(src).RoundTrip(httpReq.WithContext(withSource(ctx, src)))
+	if err != nil {
+		return c.newError(err, errUnableToExecuteRequest, url, 0)
+	}
+	_ = resp.Body.Close()
+
+	// Done
+	return nil
+}
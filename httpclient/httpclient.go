@@ -2,9 +2,11 @@ package httpclient
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
-	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/randlabs/go-loadbalancer/v2"
@@ -17,6 +19,14 @@ const (
 	ServerDownEvent
 	RequestSucceededEvent
 	RequestFailedEvent
+	SourceErrorEvent
+	ServerDegradedEvent
+	ServerRecoveredEvent
+	TLSErrorEvent
+)
+
+const (
+	defaultDNSFailureWindow = 30 * time.Second
 )
 
 // -----------------------------------------------------------------------------
@@ -24,14 +34,77 @@ const (
 var ErrCanceled = errors.New("canceled")
 var ErrTimeout = errors.New("timeout")
 
+// ErrTransportTimeout is matched by errors caused by a transport timeout, like the response header timeout, instead of
+// the request deadline. These errors also match ErrTimeout.
+var ErrTransportTimeout = errors.New("transport timeout")
+
+// ErrProxyConnect is matched by errors caused by a failure connecting through the proxy of a source. These failures
+// do not count toward the MaxFails limit of the source.
+var ErrProxyConnect = errors.New("proxy connect failed")
+
+// ErrRedirectLoop is matched by errors caused by a source redirecting too many times. These failures count toward the
+// MaxFails limit of the source and idempotent requests are retried on the next source.
+var ErrRedirectLoop = errors.New("too many redirects")
+
+// ErrOverloaded is matched by errors caused by all the available sources being busy because of their MaxConcurrent
+// limit. Unlike loadbalancer.ErrNoServersAvailable, it indicates the sources are up, so the request can be retried
+// soon.
+var ErrOverloaded = errors.New("all sources are overloaded")
+
+// ErrPending is set as the error of the ExecN results of the sources that did not respond before the request
+// context expired.
+var ErrPending = errors.New("request still pending")
+
 // -----------------------------------------------------------------------------
 
 // HttpClient is a load-balancer http client requester object.
 type HttpClient struct {
 	lb            *loadbalancer.LoadBalancer
 	transport    *http.Transport
+	sourcesMtx   sync.RWMutex
 	sources      []*Source
 	eventHandler EventHandler
+	asyncEvents  bool
+	events       eventQueue
+
+	shadowSources []*Source
+	defaultHeader http.Header
+	healthCheck   healthChecker
+	selector      Selector
+	selectFilter  func(state *SourceState) bool
+	fallback      FallbackHandler
+	cache         *responseCache
+	trafficSplit  atomic.Value
+	activeGroup   atomic.Value
+	groups        sourceGroups
+	stateWatcher  stateWatcher
+	slots         slotQueue
+	totalConns    connLimiter
+	flights       flightGroup
+	connStats     bool
+	errorRate     ErrorRateOptions
+
+	requestIDHeader    string
+	requestIDGenerator func() string
+	defaultSourceOpts  SourceOptions
+	breakerFactory     BreakerFactory
+	statusErrorPolicy  StatusErrorPolicy
+	maxConnAge         time.Duration
+	retryStaleConns    bool
+	adaptive           AdaptiveWeightOptions
+	adaptiveTimestamp  int64
+	errorPenalty       ErrorPenaltyOptions
+
+	dnsFailureWindow       time.Duration
+	lastReachableTimestamp int64
+
+	minPrimary       int
+	hysteresisMargin int
+	hysteresisHold   time.Duration
+	stickyPrimary    bool
+	warmup           bool
+	ignoreWeights    bool
+	fillFirst        bool
 }
 
 // SourceState indicates the state of a server.
@@ -44,77 +117,353 @@ type SourceState struct {
 
 type EventHandler func(eventType int, sourceId int, err error)
 
+// FallbackHandler provides a response, for e.g. a cached one, when no source is available or all the sources
+// attempted by a request failed. The request url only contains the resource path. Returning a nil response and error
+// keeps the original error.
+type FallbackHandler func(req *http.Request) (*http.Response, error)
+
+// StatusErrorPolicy specifies how the error responses detected by the client are handled. These are the responses with
+// a 502, 503 or 504 status code received through the RoundTripper, the ones with an error status code received when
+// streaming events or upgrading a connection, and the ones lacking the header required by the source. The responses
+// passed to the Exec callback are handled by the callback itself. Connection failures are not affected.
+type StatusErrorPolicy struct {
+	// NoMarkDown stops error responses from counting toward the MaxFails limit of the source, so only connection
+	// failures put it offline.
+	NoMarkDown bool
+
+	// NoRetry stops retrying idempotent requests on the next source when an error response is received.
+	NoRetry bool
+}
+
+// Selector picks the source to use for each request attempt instead of the load balancer. It is intended for tests
+// that need a deterministic selection. The returned source must be one of the given ones, or nil if none is available.
+type Selector interface {
+	Select(sources []*Source) *Source
+}
+
 // -----------------------------------------------------------------------------
 
+// New creates a load-balanced http client requester object with the specified options.
+func New(opts ...Option) (*HttpClient, error) {
+	cfg := config{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	transport := cfg.transport
+	if transport == nil {
+		transport = newDefaultTransport()
+	}
+
+	c := HttpClient{
+		lb:           loadbalancer.Create(),
+		transport:    transport.Clone(),
+		sources:      make([]*Source, 0),
+		eventHandler: cfg.eventHandler,
+		selector:     cfg.selector,
+		fallback:     cfg.fallback,
+		connStats:    cfg.connStats,
+
+		requestIDHeader:    cfg.requestIDHeader,
+		requestIDGenerator: cfg.requestIDGenerator,
+
+		dnsFailureWindow: defaultDNSFailureWindow,
+	}
+	c.lb.SetEventHandler(c.balancerEventHandler)
+	setupSourceProxy(c.transport)
+	c.transport.DialContext = newLimitedDialContext(c.transport.DialContext)
+
+	// Apply settings
+	if cfg.dialPreference != 0 {
+		err := c.SetDialPreference(cfg.dialPreference)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.dialContext != nil {
+		c.SetDialContext(cfg.dialContext)
+	}
+	err := c.SetMinPrimary(cfg.minPrimary)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.backupHysteresis != nil {
+		err = c.SetBackupHysteresis(cfg.backupHysteresis.margin, cfg.backupHysteresis.hold)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.SetStickyPrimary(cfg.stickyPrimary)
+	c.SetWarmup(cfg.warmup)
+	c.SetIgnoreWeights(cfg.ignoreWeights)
+	c.SetFillFirst(cfg.fillFirst)
+	if cfg.defaultHeader != nil {
+		c.SetDefaultHeaders(cfg.defaultHeader)
+	}
+	if len(cfg.userAgent) > 0 {
+		c.SetUserAgent(cfg.userAgent)
+	}
+	if cfg.defaultSourceOpts != nil {
+		c.SetDefaultSourceOptions(*cfg.defaultSourceOpts)
+	}
+	c.SetBreakerFactory(cfg.breakerFactory)
+	c.SetStatusErrorPolicy(cfg.statusErrorPolicy)
+	if cfg.eventDelivery != 0 {
+		err = c.SetEventDelivery(cfg.eventDelivery)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.SetRetryStaleConns(cfg.retryStaleConns)
+	err = c.SetMaxConnAge(cfg.maxConnAge)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.adaptive != nil {
+		err = c.SetAdaptiveWeights(*cfg.adaptive)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.errorPenalty != nil {
+		err = c.SetErrorPenalty(*cfg.errorPenalty)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.dnsFailureWindow != nil {
+		err = c.SetDNSFailureWindow(*cfg.dnsFailureWindow)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.errorRate != nil {
+		err = c.SetErrorRateThreshold(*cfg.errorRate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.healthCheck != nil {
+		err = c.EnableHealthCheck(*cfg.healthCheck)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Done
+	return &c, nil
+}
+
 // Create creates a load-balanced http client requester object.
 func Create() *HttpClient {
-	// From: https://www.loginradius.com/blog/async/tune-the-go-http-client-for-high-performance/
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.MaxIdleConns = 100
-	transport.MaxConnsPerHost = 100
-	transport.IdleConnTimeout = 60 * time.Second
-	transport.MaxIdleConnsPerHost = 100
-	transport.ResponseHeaderTimeout = 5 * time.Second
-	return CreateWithTransport(transport)
+	c, _ := New()
+	return c
 }
 
 // CreateWithTransport creates a load-balanced http client requester object that uses the specified transport.
 func CreateWithTransport(transport *http.Transport) *HttpClient {
-	c := HttpClient{
-		lb:        loadbalancer.Create(),
-		transport: transport.Clone(),
-		sources:   make([]*Source, 0),
+	c, _ := New(WithTransport(transport))
+	return c
+}
+
+// Clone creates a new http client requester object with the same sources and settings but independent state.
+//
+// The transport is cloned, so the new client has its own connection pool, and the sources are added again with the
+// options they currently have, so breakers, counters and last errors start fresh. Headers and settings are copied.
+// The event handler, the selector, the select filter, the fallback handler, the breaker factory and the dial context
+// function, if any, are shared. If the health check is enabled, the clone runs its own health checker with the same
+// options. If the cache is enabled, the clone starts with an empty one.
+func (c *HttpClient) Clone() (*HttpClient, error) {
+	clone := HttpClient{
+		lb:            loadbalancer.Create(),
+		transport:     c.transport.Clone(),
+		sources:       make([]*Source, 0, c.SourcesCount()),
+		eventHandler:  c.eventHandler,
+		asyncEvents:   c.asyncEvents,
+		defaultHeader: c.defaultHeader.Clone(),
+		selector:      c.selector,
+		fallback:      c.fallback,
+		connStats:     c.connStats,
+		errorRate:     c.errorRate,
+
+		requestIDHeader:    c.requestIDHeader,
+		requestIDGenerator: c.requestIDGenerator,
+		defaultSourceOpts:  c.defaultSourceOpts,
+		breakerFactory:     c.breakerFactory,
+		statusErrorPolicy:  c.statusErrorPolicy,
+		maxConnAge:         c.maxConnAge,
+		retryStaleConns:    c.retryStaleConns,
+		adaptive:           c.adaptive,
+		errorPenalty:       c.errorPenalty,
+
+		dnsFailureWindow: c.dnsFailureWindow,
+	}
+	clone.lb.SetEventHandler(clone.balancerEventHandler)
+
+	// Apply settings
+	err := clone.SetMinPrimary(c.minPrimary)
+	if err != nil {
+		return nil, err
+	}
+	err = clone.SetBackupHysteresis(c.hysteresisMargin, c.hysteresisHold)
+	if err != nil {
+		return nil, err
+	}
+	clone.SetStickyPrimary(c.stickyPrimary)
+	clone.SetWarmup(c.warmup)
+	clone.SetIgnoreWeights(c.ignoreWeights)
+	clone.SetFillFirst(c.fillFirst)
+	c.slots.mtx.Lock()
+	slotQueueLimit := c.slots.limit
+	c.slots.mtx.Unlock()
+	_ = clone.SetSlotQueueLimit(slotQueueLimit)
+	_ = clone.SetMaxTotalConnections(c.MaxTotalConnections())
+	clone.SetSelectFilter(c.selectFilter)
+	if c.cache != nil {
+		_ = clone.EnableCache(c.cache.size)
+		clone.SetCacheCredentials(c.cache.withCredentials)
+	}
+
+	// Add the sources again
+	for _, src := range c.sourceList() {
+		err = clone.AddSourceWithOptions(src.BaseURL(), src.options())
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, src := range c.shadowSourceList() {
+		err = clone.AddSourceWithOptions(src.BaseURL(), src.options())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Copy the traffic split
+	if ts := c.loadTrafficSplit(); ts != nil {
+		split := make(map[string]float64, len(ts.shares))
+		for _, share := range ts.shares {
+			split[share.src.BaseURL()] = share.percent
+		}
+		err = clone.SetTrafficSplit(split)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Copy the active group
+	if active := c.ActiveGroup(); len(active) > 0 {
+		err = clone.ActivateGroup(active)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Start the health checker if enabled
+	c.healthCheck.mtx.Lock()
+	healthCheckEnabled := c.healthCheck.stopCh != nil
+	healthCheckOpts := c.healthCheck.opts
+	c.healthCheck.mtx.Unlock()
+	if healthCheckEnabled {
+		err = clone.EnableHealthCheck(healthCheckOpts)
+		if err != nil {
+			return nil, err
+		}
 	}
-	c.lb.SetEventHandler(c.balancerEventHandler)
 
 	// Done
-	return &c
+	return &clone, nil
 }
 
 // AddSource adds a new source to the load-balanced http client object.
 func (c *HttpClient) AddSource(baseURL string, header http.Header, opts loadbalancer.ServerOptions) error {
+	return c.AddSourceWithOptions(baseURL, SourceOptions{
+		ServerOptions: opts,
+		Header:        header,
+	})
+}
+
+// AddSourceWithOptions adds a new source to the load-balanced http client object using the specified options. Options
+// left at their zero value take the default ones set with SetDefaultSourceOptions.
+func (c *HttpClient) AddSourceWithOptions(baseURL string, opts SourceOptions) error {
+	opts = mergeSourceOptions(opts, c.defaultSourceOpts)
+
+	// Check options
+	err := checkSourceOptions(opts)
+	if err != nil {
+		return err
+	}
+
 	// Check base url
-	match, _ := regexp.MatchString(`https?://([^:/?#]+)(:\d+)?/?$`, baseURL)
-	if !match {
-		return errors.New("missing base url")
+	baseURL, err = normalizeBaseURL(baseURL)
+	if err != nil {
+		return err
 	}
 
-	// Remove trailing slash
-	baseURL = strings.TrimSuffix(baseURL, "/")
+	// Lock access
+	c.sourcesMtx.Lock()
+	defer c.sourcesMtx.Unlock()
 
-	// Add source to list
-	src := newSource(len(c.sources) + 1, baseURL, header, opts.IsBackup)
-	c.sources = append(c.sources, src)
+	return c.addSourceLocked(baseURL, opts)
+}
 
-	// Add source to the load balancer
-	err := c.lb.Add(opts, src)
+// AddSourcesFromURLs adds a source for each base url using the same options. All the urls are checked first, so
+// either all the sources are added, with consecutive identifiers, or none of them is. Each source gets its own copy
+// of the options, so changing them later does not affect the added sources.
+func (c *HttpClient) AddSourcesFromURLs(baseURLs []string, opts SourceOptions) error {
+	if len(baseURLs) == 0 {
+		return errors.New("invalid parameter")
+	}
+	opts = mergeSourceOptions(opts, c.defaultSourceOpts)
+
+	// Check options
+	err := checkSourceOptions(opts)
 	if err != nil {
-		// On error, remove the source from the source list
-		c.sources = c.sources[0:len(c.sources)-1]
 		return err
 	}
 
+	// Check base urls
+	normalizedURLs := make([]string, len(baseURLs))
+	invalidURLs := make([]string, 0)
+	for idx, baseURL := range baseURLs {
+		normalizedURLs[idx], err = normalizeBaseURL(baseURL)
+		if err != nil {
+			invalidURLs = append(invalidURLs, baseURL)
+		}
+	}
+	if len(invalidURLs) > 0 {
+		return fmt.Errorf("invalid base urls [urls=%v]", strings.Join(invalidURLs, ", "))
+	}
+
+	// Lock access
+	c.sourcesMtx.Lock()
+	defer c.sourcesMtx.Unlock()
+
+	for _, baseURL := range normalizedURLs {
+		// As the options are the same, only the first source can be rejected by the load balancer
+		err = c.addSourceLocked(baseURL, opts)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Done
 	return nil
 }
 
 // SourcesCount retrieves the number of sources
 func (c *HttpClient) SourcesCount() int {
-	return len(c.sources)
+	return len(c.sourceList())
 }
 
 // SourceState retrieves source details
 func (c *HttpClient) SourceState(index int) *SourceState {
-	if index < 0 || index >= len(c.sources) {
+	sources := c.sourceList()
+	if index < 0 || index >= len(sources) {
 		return nil
 	}
-	ss := SourceState{
-		BaseURL:   c.sources[index].BaseURL(),
-		IsOnline:  c.sources[index].IsOnline(),
-		LastError: c.sources[index].Err(),
-		IsBackup:  c.sources[index].IsBackup(),
-	}
-	return &ss
+	return newSourceState(sources[index])
 }
 
 // SourceStateByID retrieves source details for the given source ID
@@ -123,7 +472,312 @@ func (c *HttpClient) SourceStateByID(id int) *SourceState {
 	return c.SourceState(id - 1)
 }
 
+// ForEachSource calls the callback with the state of each source. The source list is copied before iterating, so the
+// callback can safely add new sources.
+func (c *HttpClient) ForEachSource(cb func(state *SourceState)) {
+	for _, src := range c.sourceList() {
+		cb(newSourceState(src))
+	}
+}
+
 // SetEventHandler sets a new notification handler callback
 func (c *HttpClient) SetEventHandler(handler EventHandler) {
 	c.eventHandler = handler
 }
+
+// SetSourceFailPolicy changes the maximum amount of failures and the fail timeout of the source with the given base url
+func (c *HttpClient) SetSourceFailPolicy(baseURL string, maxFails int, failTimeout time.Duration) error {
+	src := c.sourceByURL(baseURL)
+	if src == nil {
+		return errSourceNotFound
+	}
+	err := src.srv.SetFailPolicy(maxFails, failTimeout)
+	if err != nil {
+		return err
+	}
+
+	// Keep the new policy so clones use it
+	src.optsMtx.Lock()
+	src.opts.MaxFails = maxFails
+	src.opts.FailTimeout = failTimeout
+	src.optsMtx.Unlock()
+	return nil
+}
+
+// PromoteSourceToPrimary turns the backup source with the given base url into a primary one, keeping its state. Like
+// a backup source, it never goes offline until a fail policy is set with SetSourceFailPolicy.
+func (c *HttpClient) PromoteSourceToPrimary(baseURL string) error {
+	src := c.sourceByURL(baseURL)
+	if src == nil {
+		return errSourceNotFound
+	}
+	err := src.srv.PromoteToPrimary()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&src.isBackup, 0)
+	c.stateChanged()
+
+	// Keep the new role so clones use it
+	src.optsMtx.Lock()
+	src.opts.IsBackup = false
+	src.optsMtx.Unlock()
+	return nil
+}
+
+// DemoteSourceToBackup turns the primary source with the given base url into a backup one. Its fail policy is removed
+// and, if it was offline, it is put online.
+func (c *HttpClient) DemoteSourceToBackup(baseURL string) error {
+	src := c.sourceByURL(baseURL)
+	if src == nil {
+		return errSourceNotFound
+	}
+	err := src.srv.DemoteToBackup()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&src.isBackup, 1)
+	c.stateChanged()
+
+	// Keep the new role so clones use it
+	src.optsMtx.Lock()
+	src.opts.IsBackup = true
+	src.opts.MaxFails = 0
+	src.opts.FailTimeout = 0
+	src.optsMtx.Unlock()
+	return nil
+}
+
+// SetSourceOfflineFor puts the source with the given base url offline for the specified duration, for e.g. during a
+// scheduled maintenance, regardless of its fail policy. The source is used again once the duration expires.
+func (c *HttpClient) SetSourceOfflineFor(baseURL string, d time.Duration) error {
+	src := c.sourceByURL(baseURL)
+	if src == nil {
+		return errSourceNotFound
+	}
+	return src.srv.SetOfflineFor(d)
+}
+
+// SetStickyPrimary enables or disables the sticky mode. On sticky mode, all requests are sent to the same source until
+// it goes offline, then a new source is selected and pinned.
+func (c *HttpClient) SetStickyPrimary(enable bool) {
+	c.lb.SetStickyPrimary(enable)
+	c.stickyPrimary = enable
+}
+
+// Unstick releases the pinned source so the next request selects a new one.
+func (c *HttpClient) Unstick() {
+	c.lb.Unstick()
+}
+
+// RecoverAll puts all the sources marked as offline online again immediately, for e.g. once the upstream servers were
+// fixed, instead of waiting for their fail timeout to expire. A ServerUpEvent is raised for each recovered source.
+func (c *HttpClient) RecoverAll() {
+	c.lb.RecoverAll()
+}
+
+// BreakerState returns the circuit breaker state of the source with the given base url
+func (c *HttpClient) BreakerState(baseURL string) *loadbalancer.BreakerState {
+	src := c.sourceByURL(baseURL)
+	if src == nil {
+		return nil
+	}
+	state := src.srv.BreakerState()
+	return &state
+}
+
+// RoundRobinState returns the current position of the round-robin cursor. See SetRoundRobinState.
+func (c *HttpClient) RoundRobinState() loadbalancer.RoundRobinState {
+	return c.lb.RoundRobinState()
+}
+
+// SetRoundRobinState restores the position of the round-robin cursor so the distribution continues where another
+// client left it. Sources must be added in the same order and before calling this method.
+func (c *HttpClient) SetRoundRobinState(state loadbalancer.RoundRobinState) error {
+	return c.lb.SetRoundRobinState(state)
+}
+
+// SetMinPrimary sets the minimum amount of online primary sources below which backup sources are also used.
+func (c *HttpClient) SetMinPrimary(minPrimary int) error {
+	err := c.lb.SetMinPrimary(minPrimary)
+	if err == nil {
+		c.minPrimary = minPrimary
+	}
+	return err
+}
+
+// SetBackupHysteresis sets the hysteresis applied to stop using the backup sources. Once engaged, backup sources are
+// used until the online primary sources reach the minimum plus the margin and stay so for, at least, the hold time.
+func (c *HttpClient) SetBackupHysteresis(margin int, hold time.Duration) error {
+	err := c.lb.SetBackupHysteresis(margin, hold)
+	if err == nil {
+		c.hysteresisMargin = margin
+		c.hysteresisHold = hold
+	}
+	return err
+}
+
+// SetDNSFailureWindow sets the time window used to decide if a DNS resolution failure affects a single source. A DNS
+// failure only counts toward the MaxFails limit of a source if a response was received from any source within the
+// window and after the failures of the source started, and no other source failed to resolve within the window. Else
+// it is considered a transient resolver failure affecting all the sources.
+func (c *HttpClient) SetDNSFailureWindow(window time.Duration) error {
+	if window < 0 {
+		return errors.New("invalid parameter")
+	}
+	c.dnsFailureWindow = window
+	return nil
+}
+
+// SetDefaultHeaders sets the headers to add to the requests sent to all the sources, replacing the previous ones.
+// Source headers and request headers take precedence over them. It must be called before executing requests.
+func (c *HttpClient) SetDefaultHeaders(header http.Header) {
+	c.defaultHeader = header.Clone()
+}
+
+// SetUserAgent sets the default User-Agent header sent to all the sources. It must be called before executing
+// requests.
+func (c *HttpClient) SetUserAgent(userAgent string) {
+	if c.defaultHeader == nil {
+		c.defaultHeader = make(http.Header)
+	}
+	c.defaultHeader.Set("User-Agent", userAgent)
+}
+
+// SetDefaultSourceOptions sets the options used as the base of the sources added afterwards. Each option a source
+// leaves at its zero value takes the default one. To set an option back to its zero value, for e.g. to disable a
+// boolean option enabled by default, use SourceOptions.Overrides.
+func (c *HttpClient) SetDefaultSourceOptions(opts SourceOptions) {
+	opts.Header = opts.Header.Clone()
+	c.defaultSourceOpts = opts
+}
+
+// SetStatusErrorPolicy sets how the error responses detected by the client are handled. By default, they count as
+// source failures and idempotent requests are retried on the next source. It must be called before executing
+// requests.
+func (c *HttpClient) SetStatusErrorPolicy(policy StatusErrorPolicy) {
+	c.statusErrorPolicy = policy
+}
+
+// SetWarmup enables or disables the warmup mode. On warmup mode, sources added afterwards are not used until a health
+// check succeeds or they are marked as online.
+func (c *HttpClient) SetWarmup(enable bool) {
+	c.lb.SetWarmup(enable)
+	c.warmup = enable
+}
+
+// SetIgnoreWeights enables or disables ignoring the source weights. When ignored, all eligible sources receive the
+// same amount of requests.
+func (c *HttpClient) SetIgnoreWeights(ignore bool) {
+	c.lb.SetIgnoreWeights(ignore)
+	c.ignoreWeights = ignore
+}
+
+// SetSelectFilter sets a filter to veto sources during selection, for e.g. based on external state. Vetoed sources
+// are skipped without marking them as offline. If all the available sources are vetoed, requests fail with an error
+// matching loadbalancer.ErrAllVetoed. Passing nil removes the filter. The filter is not used with a custom selector.
+func (c *HttpClient) SetSelectFilter(filter func(state *SourceState) bool) {
+	c.selectFilter = filter
+	if filter == nil {
+		c.lb.SetSelectFilter(nil)
+		return
+	}
+	c.lb.SetSelectFilter(func(srv *loadbalancer.Server) bool {
+		return filter(newSourceState(srv.UserData().(*Source)))
+	})
+}
+
+// UpdateSourceURL changes the base url of a source, for e.g. after an address change, keeping its settings, state and
+// position in the balancing order. Requests already in progress are not affected.
+func (c *HttpClient) UpdateSourceURL(oldURL string, newURL string) error {
+	newURL, err := normalizeBaseURL(newURL)
+	if err != nil {
+		return err
+	}
+
+	oldURL = strings.TrimSuffix(oldURL, "/")
+
+	// Lock access
+	c.sourcesMtx.Lock()
+	defer c.sourcesMtx.Unlock()
+
+	for _, src := range c.sources {
+		if src.BaseURL() == oldURL {
+			src.baseURL.Store(newURL)
+			return nil
+		}
+	}
+	for _, src := range c.shadowSources {
+		if src.BaseURL() == oldURL {
+			src.baseURL.Store(newURL)
+			return nil
+		}
+	}
+	return errSourceNotFound
+}
+
+// SetSourceOnline marks the source with the given base url as online. On warmup mode, it also promotes the source if
+// it is being probed. A drained source starts receiving requests again.
+func (c *HttpClient) SetSourceOnline(baseURL string) error {
+	src := c.sourceByURL(baseURL)
+	if src == nil {
+		return errSourceNotFound
+	}
+	src.stopDrain()
+	src.srv.SetOnline()
+	c.stateChanged()
+	return nil
+}
+
+// SetSelector sets a custom source selector to use instead of the load balancer. Passing nil restores the load
+// balancer selection. It must be called before executing requests.
+func (c *HttpClient) SetSelector(selector Selector) {
+	c.selector = selector
+}
+
+// SetFallback sets a handler to call when no source is available or all the sources attempted by a request failed.
+// Its response is passed to the request callback, where Response.IsFallback can be used to know it is not a live
+// response. Passing nil removes the handler. It must be called before executing requests.
+func (c *HttpClient) SetFallback(handler FallbackHandler) {
+	c.fallback = handler
+}
+
+// -----------------------------------------------------------------------------
+
+// addSourceLocked adds a source with already checked options. It must be called while the sources lock is held.
+func (c *HttpClient) addSourceLocked(baseURL string, opts SourceOptions) error {
+	opts = cloneSourceOptions(opts)
+
+	// Shadow sources are not added to the load balancer
+	if opts.IsShadow {
+		src := newSource(0, baseURL, opts)
+		src.totalConns = &c.totalConns
+		c.shadowSources = append(c.shadowSources, src)
+		return nil
+	}
+
+	// Add source to list
+	src := newSource(len(c.sources) + 1, baseURL, opts)
+	src.slots = &c.slots
+	src.totalConns = &c.totalConns
+	if c.breakerFactory != nil {
+		src.breaker = c.breakerFactory(baseURL)
+	}
+	c.sources = append(c.sources, src)
+
+	// Add source to the load balancer
+	srv, err := c.lb.AddServer(opts.ServerOptions, src)
+	if err != nil {
+		// On error, remove the source from the source list
+		c.sources = c.sources[0:len(c.sources)-1]
+		return err
+	}
+	src.srv = srv
+	if srv.IsProbing() {
+		src.setOnlineStatus(false)
+	}
+	c.stateChanged()
+
+	// Done
+	return nil
+}
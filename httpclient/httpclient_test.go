@@ -1,19 +1,27 @@
 package httpclient_test
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/randlabs/go-loadbalancer/v2"
 	"github.com/randlabs/go-loadbalancer/v2/httpclient"
+	"github.com/randlabs/go-loadbalancer/v2/httpclient/httpclienttest"
+	"github.com/randlabs/go-loadbalancer/v2/httpclient/reverseproxy"
 )
 
 // -----------------------------------------------------------------------------
@@ -154,8 +162,6 @@ func TestHttpClientPostRetry(t *testing.T) {
 			retryCount := res.RetryCount()
 			switch retryCount {
 			case 0:
-				fallthrough
-			case 2:
 				if res.Header.Get("x-server") != "server1" {
 					return errors.New("expected server to be `server1`")
 				}
@@ -164,17 +170,11 @@ func TestHttpClientPostRetry(t *testing.T) {
 				res.RetryOnNextServer()
 
 			case 1:
-				fallthrough
-			case 3:
 				if res.Header.Get("x-server") != "server2" {
 					return errors.New("expected server to be `server2`")
 				}
 
-				// Retry on the next available server
-				res.RetryOnNextServer()
-
-			case 4:
-				// When we hit the fourth retry, check if the body was received correctly
+				// When we hit the retry, check if the body was received correctly
 				// by inspecting the expected response.
 				m := make(map[string]interface{})
 				err := json.NewDecoder(res.Body).Decode(&m)
@@ -199,6 +199,441 @@ func TestHttpClientPostRetry(t *testing.T) {
 	}
 }
 
+func TestHttpClientSlowResponse(t *testing.T) {
+	// Create mock servers
+	server1 := createMockTimestampServer("server1")
+	defer server1.Destroy()
+	server2 := createMockTimestampServer("server2")
+	defer server2.Destroy()
+
+	// Every response from the first server will be considered slow
+	hc := httpclient.Create()
+	err := hc.AddSourceWithOptions(server1.URL(), httpclient.SourceOptions{
+		ServerOptions: loadbalancer.ServerOptions{
+			Weight:      1,
+			MaxFails:    1,
+			FailTimeout: 10 * time.Second,
+		},
+		SlowThreshold: time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+	err = hc.AddSourceWithOptions(server2.URL(), httpclient.SourceOptions{
+		ServerOptions: loadbalancer.ServerOptions{
+			Weight:      1,
+			MaxFails:    1,
+			FailTimeout: 10 * time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	// The first request succeeds but puts the first server offline, the rest must go to the second one
+	for _, expectedServer := range []string{"server1", "server2", "server2"} {
+		err = hc.NewRequest(context.Background(), "/test").
+			Method("GET").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if res.StatusCode != 200 {
+					return fmt.Errorf("unexpected status code %v", res.StatusCode)
+				}
+				if res.Header.Get("x-server") != expectedServer {
+					return fmt.Errorf("expected server to be `%v`", expectedServer)
+				}
+
+				// Done
+				return nil
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestHttpClientStateSnapshot(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	// Put the first server offline
+	err := hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			res.SetOffline()
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snapshot := hc.StateSnapshot()
+	if len(snapshot.Sources) != 2 {
+		t.Fatalf("unexpected sources count [count=%v]", len(snapshot.Sources))
+	}
+	if !snapshot.Sources[0].IsDown || snapshot.Sources[0].RecoversIn <= 0 || snapshot.Sources[0].BaseURL != server1.URL() {
+		t.Fatal("expected first source to be down")
+	}
+	if snapshot.Sources[1].IsDown {
+		t.Fatal("expected second source to be up")
+	}
+
+	_, err = json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpClientDialPreference(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	if hc.SetDialPreference(0) == nil {
+		t.Fatal("expected invalid dial preference to fail")
+	}
+
+	// Mock servers listen on IPv4 addresses
+	err := hc.SetDialPreference(httpclient.DialIPv4Only)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = hc.NewRequest(context.Background(), "/test").
+		Method("GET").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			if res.StatusCode != 200 {
+				return fmt.Errorf("unexpected status code %v", res.StatusCode)
+			}
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpClientTimeouts(t *testing.T) {
+	// Create a slow server
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 100 * time.Millisecond
+
+	hc := httpclient.CreateWithTransport(transport)
+	err := hc.AddSource(srv.URL, nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	exec := func(timeout time.Duration) error {
+		return hc.NewRequest(context.Background(), "/test").
+			Timeout(timeout).
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+	}
+
+	// A request deadline shorter than the transport timeout
+	err = exec(20 * time.Millisecond)
+	if !errors.Is(err, httpclient.ErrTimeout) || errors.Is(err, httpclient.ErrTransportTimeout) {
+		t.Fatalf("expected a request timeout [err=%v]", err)
+	}
+
+	// A request deadline longer than the transport timeout
+	err = exec(time.Second)
+	if !errors.Is(err, httpclient.ErrTimeout) || !errors.Is(err, httpclient.ErrTransportTimeout) {
+		t.Fatalf("expected a transport timeout [err=%v]", err)
+	}
+}
+
+func TestHttpClientNew(t *testing.T) {
+	_, err := httpclient.New(httpclient.WithMinPrimary(-1))
+	if err == nil {
+		t.Fatal("expected invalid option to fail")
+	}
+
+	hc, err := httpclient.New(
+		httpclient.WithTransport(http.DefaultTransport.(*http.Transport)),
+		httpclient.WithDialPreference(httpclient.DialPreferIPv4),
+		httpclient.WithStickyPrimary(),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if hc.SourcesCount() != 0 {
+		t.Fatal("expected no sources")
+	}
+}
+
+func TestHttpClientDNSFailure(t *testing.T) {
+	server1 := createMockTimestampServer("server1")
+	defer server1.Destroy()
+
+	// Simulate a resolver error for one of the hosts
+	dialer := &net.Dialer{}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(addr, "unresolvable.test:") {
+			return nil, &net.DNSError{
+				Err:  "no such host",
+				Name: "unresolvable.test",
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	hc := httpclient.CreateWithTransport(transport)
+	for _, baseURL := range []string{"http://unresolvable.test", server1.URL()} {
+		err := hc.AddSource(baseURL, nil, loadbalancer.ServerOptions{
+			Weight:      1,
+			MaxFails:    1,
+			FailTimeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+
+	exec := func() error {
+		return hc.NewRequest(context.Background(), "/test").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+	}
+
+	// No source was reachable yet, so the failure must not put the source offline
+	err := exec()
+	var httpErr *httpclient.Error
+	if !errors.As(err, &httpErr) || !httpErr.IsDNSError() {
+		t.Fatalf("expected a dns error [err=%v]", err)
+	}
+	if !hc.SourceState(0).IsOnline {
+		t.Fatal("expected source to remain online")
+	}
+
+	// After a successful request, the failure only affects one source
+	err = exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = exec()
+	if hc.SourceState(0).IsOnline {
+		t.Fatal("expected source to be offline")
+	}
+}
+
+func TestHttpClientDNSOutage(t *testing.T) {
+	server1 := createMockTimestampServer("server1")
+	defer server1.Destroy()
+	server2 := createMockTimestampServer("server2")
+	defer server2.Destroy()
+
+	// Simulate a resolver outage affecting all the hosts once enabled
+	var resolverDown int32
+	dialer := &net.Dialer{}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = true
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if atomic.LoadInt32(&resolverDown) != 0 {
+			return nil, &net.DNSError{
+				Err:  "server misbehaving",
+				Name: addr,
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	hc := httpclient.CreateWithTransport(transport)
+	for _, baseURL := range []string{server1.URL(), server2.URL()} {
+		err := hc.AddSource(baseURL, nil, loadbalancer.ServerOptions{
+			Weight:      1,
+			MaxFails:    1,
+			FailTimeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+		}
+	}
+
+	exec := func() error {
+		return hc.NewRequest(context.Background(), "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+	}
+
+	for idx := 0; idx < 2; idx++ {
+		err := exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// The outage starts after the successful requests, so it must not put any source offline
+	atomic.StoreInt32(&resolverDown, 1)
+	for idx := 0; idx < 4; idx++ {
+		_ = exec()
+	}
+	if !hc.SourceState(0).IsOnline || !hc.SourceState(1).IsOnline {
+		t.Fatal("expected sources to remain online")
+	}
+
+	// Once the resolver is back, the sources work as usual
+	atomic.StoreInt32(&resolverDown, 0)
+	err := exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpClientShadowSource(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	// Create a failing shadow server
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.Method + " " + r.URL.Path
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	err := hc.AddSourceWithOptions(shadow.URL, httpclient.SourceOptions{
+		IsShadow: true,
+	})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+	if hc.SourcesCount() != 2 {
+		t.Fatal("shadow sources must not be counted")
+	}
+
+	for _, method := range []string{"POST", "GET"} {
+		path := "/test"
+		if method == "POST" {
+			path = "/bodytest"
+		}
+		err = hc.NewRequest(context.Background(), path).
+			Method(method).
+			BodyBytes([]byte("body")).
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if res.StatusCode != 200 {
+					return fmt.Errorf("unexpected status code %v", res.StatusCode)
+				}
+				return nil
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// Only the idempotent request must be mirrored
+	select {
+	case req := <-mirrored:
+		if req != "GET /test" {
+			t.Fatalf("unexpected mirrored request [req=%v]", req)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+}
+
+func TestHttpClientDefaultHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	hc, _ := httpclient.New(
+		httpclient.WithUserAgent("test-agent/1.0"),
+		httpclient.WithDefaultHeaders(http.Header{
+			"X-Client":  {"client"},
+			"X-Source":  {"client"},
+			"X-Request": {"client"},
+		}),
+	)
+	err := hc.AddSourceWithOptions(srv.URL, httpclient.SourceOptions{
+		Header: http.Header{
+			"X-Source":  {"source"},
+			"X-Request": {"source"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	err = hc.NewRequest(context.Background(), "/test").
+		Headers(http.Header{
+			"X-Request": {"request"},
+		}).
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			return res.Err()
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	header := <-received
+	if header.Get("User-Agent") != "test-agent/1.0" || header.Get("X-Client") != "client" ||
+		header.Get("X-Source") != "source" || header.Get("X-Request") != "request" {
+		t.Fatalf("unexpected headers [headers=%v]", header)
+	}
+}
+
+func TestHttpClientDialContext(t *testing.T) {
+	server1 := createMockTimestampServer("server1")
+	defer server1.Destroy()
+
+	// Resolve a logical name to the mock server address
+	dialer := &net.Dialer{}
+	hc, _ := httpclient.New(httpclient.WithDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "backend.service:80" {
+			addr = strings.TrimPrefix(server1.URL(), "http://")
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}))
+	err := hc.AddSource("http://backend.service", nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatalf("unable to add source to load balancer [err=%v]", err.Error())
+	}
+
+	err = hc.NewRequest(context.Background(), "/test").
+		Callback(func (ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			if res.Header.Get("x-server") != "server1" {
+				return errors.New("expected server to be `server1`")
+			}
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
 // -----------------------------------------------------------------------------
 
 func createTestEnvironment(t *testing.T) (*MockServer, *MockServer, *httpclient.HttpClient) {
@@ -321,3 +756,3607 @@ func (ms *MockServer) SetOffline(offline bool) {
 		_ = atomic.SwapInt32(&ms.simulateDown, 0)
 	}
 }
+
+func TestHttpClientSourceErrorEvent(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	errorEventsCount := 0
+	hc.SetEventHandler(func(eventType int, sourceId int, err error) {
+		if eventType == httpclient.SourceErrorEvent && sourceId == 1 {
+			errorEventsCount += 1
+		}
+	})
+
+	server1.SetOffline(true)
+
+	// Requests are alternated between both servers, only those sent to the first one fail
+	for idx := 0; idx < 6; idx++ {
+		_ = hc.NewRequest(context.Background(), "/test").
+			Method("GET").
+			Callback(func (ctx context.Context, res httpclient.Response) error {
+				if res.StatusCode != 200 {
+					if idx >= 4 {
+						return fmt.Errorf("unexpected status code %v on a later request", res.StatusCode)
+					}
+					return fmt.Errorf("unexpected status code %v", res.StatusCode)
+				}
+
+				// Done
+				return nil
+			}).
+			Exec()
+	}
+
+	// Identical consecutive errors must be notified only once
+	if errorEventsCount != 2 {
+		t.Fatalf("unexpected error events count [count=%v]", errorEventsCount)
+	}
+}
+
+func TestHttpClientHealthCheck(t *testing.T) {
+	server1 := createMockTimestampServer("server1")
+	defer server1.Destroy()
+	server2 := createMockTimestampServer("server2")
+	defer server2.Destroy()
+
+	hc, err := httpclient.New(httpclient.WithWarmup())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer hc.DisableHealthCheck()
+
+	for _, ms := range []*MockServer{server1, server2} {
+		err = hc.AddSource(ms.URL(), nil, loadbalancer.ServerOptions{
+			MaxFails:    1,
+			FailTimeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// Sources are not used until a health check succeeds
+	err = hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			return res.Err()
+		}).
+		Exec()
+	if err == nil {
+		t.Fatal("expected no available source while warming up")
+	}
+
+	server2.SetOffline(true)
+	err = hc.EnableHealthCheck(httpclient.HealthCheckOptions{
+		Path:     "/test",
+		Interval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if !hc.SourceState(0).IsOnline || hc.SourceState(1).IsOnline {
+		t.Fatal("unexpected source online status after health check")
+	}
+
+	// Only the healthy source is used
+	for idx := 0; idx < 4; idx++ {
+		err = hc.NewRequest(context.Background(), "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				if res.Err() != nil {
+					return res.Err()
+				}
+				if res.Header.Get("x-server") != "server1" {
+					return fmt.Errorf("unexpected source %v", res.Header.Get("x-server"))
+				}
+				return nil
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestHttpClientClone(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	hc.SetUserAgent("clone-test")
+
+	// Put the first source offline in the original client
+	err := hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			res.SetOffline()
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if hc.SourceState(0).IsOnline {
+		t.Fatal("expected the first source to be offline")
+	}
+
+	clone, err := hc.Clone()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The clone has the same sources with fresh state
+	if clone.SourcesCount() != hc.SourcesCount() {
+		t.Fatalf("unexpected sources count [count=%v]", clone.SourcesCount())
+	}
+	for idx := 0; idx < clone.SourcesCount(); idx++ {
+		state := clone.SourceState(idx)
+		if state.BaseURL != hc.SourceState(idx).BaseURL || !state.IsOnline || state.LastError != nil {
+			t.Fatalf("unexpected source state [index=%v]", idx)
+		}
+	}
+
+	// Settings are copied
+	err = clone.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			if res.Request.Header.Get("User-Agent") != "clone-test" {
+				return errors.New("user agent not copied")
+			}
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The original client is not affected
+	if hc.SourceState(0).IsOnline {
+		t.Fatal("expected the first source to remain offline in the original client")
+	}
+}
+
+func TestHttpClientRetryIfNotSent(t *testing.T) {
+	server := createMockTimestampServer("server")
+	defer server.Destroy()
+
+	// Get the address of a closed port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	deadURL := "http://" + l.Addr().String()
+	_ = l.Close()
+
+	hc := httpclient.Create()
+	for _, baseURL := range []string{deadURL, server.URL()} {
+		err = hc.AddSource(baseURL, nil, loadbalancer.ServerOptions{
+			MaxFails:    1,
+			FailTimeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// The first source refuses the connection so the request is sent to the second one without calling the callback
+	callbackCount := 0
+	err = hc.NewRequest(context.Background(), "/bodytest").
+		Method("POST").
+		BodyBytes([]byte("not sent")).
+		RetryIfNotSent().
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			callbackCount += 1
+			if res.Err() != nil {
+				return res.Err()
+			}
+			if res.SourceID() != 2 || res.StatusCode != 200 {
+				return fmt.Errorf("unexpected response [source=%v] [status=%v]", res.SourceID(), res.StatusCode)
+			}
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if callbackCount != 1 {
+		t.Fatalf("unexpected callback count [count=%v]", callbackCount)
+	}
+	if hc.SourceState(0).IsOnline {
+		t.Fatal("expected the dead source to be offline")
+	}
+
+	// Without the option, the callback receives the error
+	hc2 := httpclient.Create()
+	_ = hc2.AddSource(deadURL, nil, loadbalancer.ServerOptions{})
+	err = hc2.NewRequest(context.Background(), "/bodytest").
+		Method("POST").
+		BodyBytes([]byte("not sent")).
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if !res.RequestNotSent() {
+				return errors.New("expected the request to be reported as not sent")
+			}
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpClientForEachSource(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	urls := make([]string, 0)
+	hc.ForEachSource(func(state *httpclient.SourceState) {
+		if !state.IsOnline {
+			t.Errorf("unexpected offline source [url=%v]", state.BaseURL)
+		}
+		urls = append(urls, state.BaseURL)
+	})
+	if len(urls) != 2 || urls[0] != server1.URL() || urls[1] != server2.URL() {
+		t.Fatalf("unexpected sources [urls=%v]", urls)
+	}
+}
+
+func TestHttpClientSourceProxy(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	// Create a simple CONNECT proxy that requires authorization
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" || r.Header.Get("Proxy-Authorization") != "Basic secret" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = upstream.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+			_ = upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		_ = conn.Close()
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	execRequest := func(proxyAuth string) error {
+		hc := httpclient.CreateWithTransport(backend.Client().Transport.(*http.Transport))
+		err := hc.AddSourceWithOptions(backend.URL, httpclient.SourceOptions{
+			ServerOptions: loadbalancer.ServerOptions{
+				MaxFails:    1,
+				FailTimeout: 10 * time.Second,
+			},
+			Proxy: proxyURL,
+			ProxyHeader: http.Header{
+				"Proxy-Authorization": []string{proxyAuth},
+			},
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		err = hc.NewRequest(context.Background(), "/").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				if res.Err() != nil {
+					return res.Err()
+				}
+				if res.StatusCode != 200 {
+					return fmt.Errorf("unexpected status code %v", res.StatusCode)
+				}
+				return nil
+			}).
+			Exec()
+
+		// Proxy failures must not blame the source
+		if !hc.SourceState(0).IsOnline {
+			t.Fatal("expected the source to remain online")
+		}
+		return err
+	}
+
+	err := execRequest("Basic secret")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = execRequest("Basic wrong")
+	if !errors.Is(err, httpclient.ErrProxyConnect) {
+		t.Fatalf("expected a proxy error [err=%v]", err)
+	}
+}
+
+func TestHttpClientSelector(t *testing.T) {
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+
+	selector := httpclienttest.NewSequenceSelector(2, 1)
+	hc, err := httpclient.New(httpclient.WithSelector(selector))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, fs := range []*httpclienttest.FakeSource{source1, source2} {
+		err = hc.AddSource(fs.URL(), nil, loadbalancer.ServerOptions{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// The second source fails so the request is retried on the first one
+	source2.Enqueue(httpclienttest.FakeResponse{
+		StatusCode: http.StatusServiceUnavailable,
+	})
+	err = hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			if res.StatusCode != 200 {
+				res.RetryOnNextServer()
+				return fmt.Errorf("unexpected status code %v", res.StatusCode)
+			}
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	picked := selector.Picked()
+	if len(picked) != 2 || picked[0] != 2 || picked[1] != 1 {
+		t.Fatalf("unexpected picked sources [picked=%v]", picked)
+	}
+	if source1.Hits() != 1 || source2.Hits() != 1 {
+		t.Fatalf("unexpected hits [source1=%v] [source2=%v]", source1.Hits(), source2.Hits())
+	}
+}
+
+func TestHttpClientStreamEvents(t *testing.T) {
+	var connCount int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		switch atomic.AddInt32(&connCount, 1) {
+		case 1:
+			// Send one event and drop the connection
+			_, _ = w.Write([]byte(": comment\nid: 1\nevent: sample\ndata: first\n\n"))
+		default:
+			if r.Header.Get("Last-Event-ID") != "1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte("id: 2\ndata: second\ndata: line\n\n"))
+		}
+	}))
+	defer srv.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSource(srv.URL, nil, loadbalancer.ServerOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	errStop := errors.New("stop")
+	events := make([]httpclient.SSEEvent, 0)
+	err = hc.StreamEvents(context.Background(), "/events", httpclient.SSEOptions{
+		ReconnectDelay: 10 * time.Millisecond,
+		MaxReconnects:  3,
+	}, func(ev httpclient.SSEEvent) error {
+		events = append(events, ev)
+		if len(events) == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("unexpected error [err=%v]", err)
+	}
+	if events[0].ID != "1" || events[0].Event != "sample" || events[0].Data != "first" {
+		t.Fatalf("unexpected first event [event=%+v]", events[0])
+	}
+	if events[1].ID != "2" || events[1].Data != "second\nline" {
+		t.Fatalf("unexpected second event [event=%+v]", events[1])
+	}
+}
+
+func TestHttpClientDisableKeepAlive(t *testing.T) {
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSourceWithOptions(source1.URL(), httpclient.SourceOptions{
+		DisableKeepAlive: true,
+	})
+	_ = hc.AddSource(source2.URL(), nil, loadbalancer.ServerOptions{})
+
+	for idx := 0; idx < 2; idx++ {
+		err := hc.NewRequest(context.Background(), "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if !source1.Requests()[0].Close {
+		t.Fatal("expected the connection to be closed after the request")
+	}
+	if source2.Requests()[0].Close {
+		t.Fatal("expected the connection to be kept alive")
+	}
+}
+
+func TestHttpClientReverseProxy(t *testing.T) {
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+
+	// The second source echoes the upgraded connections
+	source2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.Header().Set("x-server", "source2")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = brw.Flush()
+		_, _ = io.Copy(conn, brw)
+	}))
+	defer source2.Close()
+
+	hc := httpclient.Create()
+	for _, baseURL := range []string{source1.URL(), source2.URL} {
+		_ = hc.AddSource(baseURL, nil, loadbalancer.ServerOptions{
+			MaxFails:    1,
+			FailTimeout: 10 * time.Second,
+		})
+	}
+
+	rp, err := reverseproxy.New(hc, reverseproxy.Options{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	frontend := httptest.NewServer(rp)
+	defer frontend.Close()
+
+	// The first source drops the connection so the request is retried on the second one
+	source1.Enqueue(httpclienttest.FakeResponse{
+		Fail: true,
+	})
+	req, _ := http.NewRequest("PUT", frontend.URL+"/test", strings.NewReader("sample body"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("x-server") != "source2" {
+		t.Fatalf("unexpected response [status=%v] [server=%v]", resp.StatusCode, resp.Header.Get("x-server"))
+	}
+
+	// Upgraded connections are tunneled
+	conn, err := net.Dial("tcp", strings.TrimPrefix(frontend.URL, "http://"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status code %v", resp.StatusCode)
+	}
+	_, _ = conn.Write([]byte("ping\n"))
+	line, err := br.ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("unexpected echo [line=%v] [err=%v]", line, err)
+	}
+}
+
+func TestHttpClientDial(t *testing.T) {
+	// The first source is unavailable
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+	source1.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusServiceUnavailable,
+	})
+
+	source2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" || r.Header.Get("Connection") != "Upgrade" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = brw.Flush()
+		_, _ = io.Copy(conn, brw)
+	}))
+	defer source2.Close()
+
+	// The unavailable source has a higher weight, so the round-robin would pick it again on the retry
+	hc := httpclient.Create()
+	_ = hc.AddSource(source1.URL(), nil, loadbalancer.ServerOptions{
+		Weight: 3,
+	})
+	_ = hc.AddSource(source2.URL, nil, loadbalancer.ServerOptions{
+		Weight: 1,
+	})
+
+	conn, resp, err := hc.Dial(context.Background(), "/echo", http.Header{
+		"Upgrade": []string{"echo"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	if resp.Request.URL.Host != strings.TrimPrefix(source2.URL, "http://") {
+		t.Fatalf("unexpected source [url=%v]", resp.Request.URL)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write([]byte("ping\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("unexpected echo [line=%v] [err=%v]", line, err)
+	}
+	if source1.Hits() != 1 {
+		t.Fatalf("unexpected hits on the first source [hits=%v]", source1.Hits())
+	}
+}
+
+func TestHttpClientDialRejected(t *testing.T) {
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+	source1.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusUnauthorized,
+	})
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+
+	hc := httpclient.Create()
+	for _, baseURL := range []string{source1.URL(), source2.URL()} {
+		_ = hc.AddSource(baseURL, nil, loadbalancer.ServerOptions{})
+	}
+
+	// A rejected handshake is not retried on other sources
+	_, resp, err := hc.Dial(context.Background(), "/echo", http.Header{
+		"Upgrade": []string{"echo"},
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected response [resp=%v]", resp)
+	}
+	if source1.Hits() != 1 || source2.Hits() != 0 {
+		t.Fatalf("unexpected hits [first=%v] [second=%v]", source1.Hits(), source2.Hits())
+	}
+}
+
+func TestHttpClientHealthySourceURLs(t *testing.T) {
+	hc := httpclient.Create()
+	for idx, weight := range []int{1, 3, 1, 2} {
+		_ = hc.AddSource(fmt.Sprintf("http://source%v.test", idx+1), nil, loadbalancer.ServerOptions{
+			Weight:      weight,
+			MaxFails:    1,
+			FailTimeout: 10 * time.Second,
+		})
+	}
+	_ = hc.SetSourceOfflineFor("http://source4.test", time.Minute)
+
+	urls := hc.HealthySourceURLs()
+	expected := []string{"http://source2.test", "http://source1.test", "http://source3.test"}
+	if strings.Join(urls, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected urls [urls=%v]", urls)
+	}
+}
+
+func TestHttpClientErrorRate(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	events := make([]int, 0)
+	hc, err := httpclient.New(
+		httpclient.WithErrorRateThreshold(httpclient.ErrorRateOptions{
+			Threshold: 0.5,
+			Window:    4,
+		}),
+		httpclient.WithEventHandler(func(eventType int, sourceId int, err error) {
+			if eventType == httpclient.ServerDegradedEvent || eventType == httpclient.ServerRecoveredEvent {
+				var degradedErr *httpclient.DegradedError
+				if !errors.As(err, &degradedErr) {
+					t.Errorf("expected the error rate in the event")
+				}
+				events = append(events, eventType)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+
+	execRequests := func(count int) {
+		for idx := 0; idx < count; idx++ {
+			_ = hc.NewRequest(context.Background(), "/test").
+				Callback(func(ctx context.Context, res httpclient.Response) error {
+					if res.Err() != nil {
+						return res.Err()
+					}
+					if res.StatusCode != 200 {
+						return fmt.Errorf("unexpected status code %v", res.StatusCode)
+					}
+					return nil
+				}).
+				Exec()
+		}
+	}
+
+	source.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusInternalServerError,
+	})
+	execRequests(3)
+	if len(events) != 0 {
+		t.Fatal("unexpected event before the window is filled")
+	}
+	execRequests(1)
+	if len(events) != 1 || events[0] != httpclient.ServerDegradedEvent {
+		t.Fatalf("expected a degraded event [events=%v]", events)
+	}
+
+	// Recovering requires the rate to go below the recovery threshold
+	source.SetDefault(httpclienttest.FakeResponse{})
+	execRequests(2)
+	if len(events) != 1 {
+		t.Fatalf("unexpected recovery [events=%v]", events)
+	}
+	execRequests(1)
+	if len(events) != 2 || events[1] != httpclient.ServerRecoveredEvent {
+		t.Fatalf("expected a recovered event [events=%v]", events)
+	}
+}
+
+func TestHttpClientSelectFilter(t *testing.T) {
+	// Create mock servers and http client requester
+	server1, server2, hc := createTestEnvironment(t)
+	defer server1.Destroy()
+	defer server2.Destroy()
+
+	hc.SetSelectFilter(func(state *httpclient.SourceState) bool {
+		return false
+	})
+	err := hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			return res.Err()
+		}).
+		Exec()
+	if !errors.Is(err, loadbalancer.ErrAllVetoed) {
+		t.Fatalf("expected all sources to be vetoed [err=%v]", err)
+	}
+	if !hc.SourceState(0).IsOnline || !hc.SourceState(1).IsOnline {
+		t.Fatal("vetoed sources must remain online")
+	}
+}
+
+func TestHttpClientCaptureTimings(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+	source.Enqueue(httpclienttest.FakeResponse{
+		StatusCode: http.StatusServiceUnavailable,
+		Delay:      20 * time.Millisecond,
+	})
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(source2.URL(), nil, loadbalancer.ServerOptions{})
+
+	req := hc.NewRequest(context.Background(), "/test").
+		CaptureTimings().
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if res.Timings() == nil {
+				return errors.New("expected timings in the response")
+			}
+			if res.StatusCode != 200 {
+				res.RetryOnNextServer()
+			}
+			return res.Err()
+		})
+	err := req.Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	timings := req.Timings()
+	if len(timings) != 2 {
+		t.Fatalf("unexpected timings count [count=%v]", len(timings))
+	}
+	if timings[0].SourceID != 1 || timings[0].TTFB < 20*time.Millisecond || timings[0].Total < timings[0].TTFB {
+		t.Fatalf("unexpected first attempt timings [timings=%+v]", timings[0])
+	}
+	if timings[1].SourceID != 2 || timings[1].ConnReused || timings[1].Connect <= 0 {
+		t.Fatalf("expected a new connection to the next source [timings=%+v]", timings[1])
+	}
+}
+
+func TestHttpClientFailFast(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+	_ = hc.SetSourceOfflineFor(source.URL(), time.Minute)
+
+	// With all sources down, requests fail immediately without reaching any source
+	start := time.Now()
+	err := hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			return res.Err()
+		}).
+		Exec()
+	if !errors.Is(err, loadbalancer.ErrNoServersAvailable) {
+		t.Fatalf("expected no servers available [err=%v]", err)
+	}
+	if time.Since(start) > 100*time.Millisecond || source.Hits() != 0 {
+		t.Fatal("expected the request to fail fast")
+	}
+}
+
+func TestHttpClientReadWriteRoles(t *testing.T) {
+	writer := httpclienttest.NewFakeSource()
+	defer writer.Close()
+	replica := httpclienttest.NewFakeSource()
+	defer replica.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(writer.URL(), nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+	_ = hc.AddSourceWithOptions(replica.URL(), httpclient.SourceOptions{
+		ServerOptions: loadbalancer.ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		},
+		ReadOnly: true,
+	})
+
+	exec := func(req *httpclient.Request) error {
+		return req.Callback(func(ctx context.Context, res httpclient.Response) error {
+			return res.Err()
+		}).Exec()
+	}
+
+	for idx := 0; idx < 4; idx++ {
+		_ = exec(hc.NewRequest(context.Background(), "/write").Method("POST").ForWrite())
+		_ = exec(hc.NewRequest(context.Background(), "/read").ForRead())
+	}
+	if writer.Hits() != 4 || replica.Hits() != 4 {
+		t.Fatalf("unexpected hits [writer=%v] [replica=%v]", writer.Hits(), replica.Hits())
+	}
+
+	// Reads fall back to the writable sources if no replica is available
+	_ = hc.SetSourceOfflineFor(replica.URL(), time.Minute)
+	err := exec(hc.NewRequest(context.Background(), "/read").ForRead())
+	if err != nil || writer.Hits() != 5 {
+		t.Fatalf("expected the read to fall back to the writer [err=%v]", err)
+	}
+
+	// Writes never land on replicas
+	hc2 := httpclient.Create()
+	_ = hc2.AddSource(writer.URL(), nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+	_ = hc2.AddSourceWithOptions(replica.URL(), httpclient.SourceOptions{
+		ReadOnly: true,
+	})
+	_ = hc2.SetSourceOfflineFor(writer.URL(), time.Minute)
+	err = exec(hc2.NewRequest(context.Background(), "/write").Method("POST").ForWrite())
+	if !errors.Is(err, loadbalancer.ErrNoServersAvailable) {
+		t.Fatalf("expected no servers available [err=%v]", err)
+	}
+}
+
+func TestHttpClientExpectContinue(t *testing.T) {
+	var bodyRead int32
+	source1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}))
+	defer source1.Close()
+	source2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Expect") == "100-continue" && string(body) == "large body" {
+			atomic.StoreInt32(&bodyRead, 1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer source2.Close()
+
+	hc := httpclient.Create()
+	for _, baseURL := range []string{source1.URL, source2.URL} {
+		_ = hc.AddSourceWithOptions(baseURL, httpclient.SourceOptions{
+			ExpectContinue: true,
+		})
+	}
+
+	callbackCount := 0
+	err := hc.NewRequest(context.Background(), "/upload").
+		Method("POST").
+		BodyBytes([]byte("large body")).
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			callbackCount += 1
+			if res.Err() != nil {
+				return res.Err()
+			}
+			if res.SourceID() != 2 {
+				return fmt.Errorf("unexpected source [id=%v]", res.SourceID())
+			}
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if callbackCount != 1 || atomic.LoadInt32(&bodyRead) == 0 {
+		t.Fatal("expected the request to be sent to the second source")
+	}
+}
+
+func TestHttpClientFallback(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	hc, err := httpclient.New(httpclient.WithFallback(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/test" {
+			return nil, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("stale")),
+		}, nil
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+
+	exec := func(url string, expectFallback bool) error {
+		return hc.NewRequest(context.Background(), url).
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				if res.Err() != nil {
+					return res.Err()
+				}
+				if res.IsFallback() != expectFallback {
+					return fmt.Errorf("unexpected fallback flag [fallback=%v]", res.IsFallback())
+				}
+				if expectFallback {
+					body, _ := io.ReadAll(res.Body)
+					if string(body) != "stale" {
+						return fmt.Errorf("unexpected body [body=%v]", string(body))
+					}
+				}
+				return nil
+			}).
+			Exec()
+	}
+
+	err = exec("/test", false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Once the source is down, the fallback provides the response
+	_ = hc.SetSourceOfflineFor(source.URL(), time.Minute)
+	err = exec("/test", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// If the fallback has no response, the original error is returned
+	err = exec("/other", true)
+	if !errors.Is(err, loadbalancer.ErrNoServersAvailable) {
+		t.Fatalf("expected no servers available [err=%v]", err)
+	}
+
+	// The fallback also provides the response once all the sources were attempted and failed
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+	source2.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusServiceUnavailable,
+	})
+	hc2, err := httpclient.New(httpclient.WithFallback(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("stale")),
+		}, nil
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc2.AddSource(source2.URL(), nil, loadbalancer.ServerOptions{})
+	fallbackUsed := false
+	err = hc2.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if res.IsFallback() {
+				fallbackUsed = true
+				return nil
+			}
+			res.RetryOnNextServer()
+			return fmt.Errorf("unexpected status code [status=%v]", res.StatusCode)
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !fallbackUsed || source2.Hits() != 1 {
+		t.Fatalf("expected the fallback after the failed attempt [fallback=%v] [hits=%v]", fallbackUsed, source2.Hits())
+	}
+}
+
+func TestHttpClientMaxConns(t *testing.T) {
+	var activeConns, maxActiveConns int32
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			active := atomic.AddInt32(&activeConns, 1)
+			for {
+				maxActive := atomic.LoadInt32(&maxActiveConns)
+				if active <= maxActive || atomic.CompareAndSwapInt32(&maxActiveConns, maxActive, active) {
+					break
+				}
+			}
+		case http.StateClosed, http.StateHijacked:
+			atomic.AddInt32(&activeConns, -1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	hc := httpclient.Create()
+	err := hc.AddSourceWithOptions(srv.URL, httpclient.SourceOptions{
+		MaxConns: 1,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	errCh := make(chan error, 4)
+	for idx := 0; idx < 4; idx++ {
+		go func() {
+			errCh <- hc.NewRequest(context.Background(), "/test").
+				Callback(func(ctx context.Context, res httpclient.Response) error {
+					return res.Err()
+				}).
+				Exec()
+		}()
+	}
+	for idx := 0; idx < 4; idx++ {
+		err = <-errCh
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if atomic.LoadInt32(&maxActiveConns) != 1 {
+		t.Fatalf("unexpected amount of concurrent connections [max=%v]", atomic.LoadInt32(&maxActiveConns))
+	}
+
+	err = hc.AddSourceWithOptions("http://127.0.0.1:1", httpclient.SourceOptions{
+		MaxConns: -1,
+	})
+	if err == nil {
+		t.Fatal("expected an invalid parameter error")
+	}
+}
+
+func TestHttpClientHealthCheckValidator(t *testing.T) {
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+	source1.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Body:       []byte(`{"status":"ok"}`),
+	})
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+	source2.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Body:       []byte(`{"status":"degraded"}`),
+	})
+
+	hc := httpclient.Create()
+	defer hc.DisableHealthCheck()
+	for _, source := range []*httpclienttest.FakeSource{source1, source2} {
+		_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{
+			MaxFails:    1,
+			FailTimeout: 10 * time.Second,
+		})
+	}
+
+	errDegraded := errors.New("degraded")
+	err := hc.EnableHealthCheck(httpclient.HealthCheckOptions{
+		Path:     "/health",
+		Interval: 50 * time.Millisecond,
+		Validator: func(resp *http.Response) error {
+			var body struct {
+				Status string `json:"status"`
+			}
+			err := json.NewDecoder(resp.Body).Decode(&body)
+			if err != nil {
+				return err
+			}
+			if body.Status != "ok" {
+				return errDegraded
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if !hc.SourceState(0).IsOnline {
+		t.Fatal("expected the healthy source to be online")
+	}
+	state := hc.SourceState(1)
+	if state.IsOnline || !errors.Is(state.LastError, errDegraded) {
+		t.Fatalf("expected the degraded source to be offline [err=%v]", state.LastError)
+	}
+}
+
+func TestHttpClientWriteMetrics(t *testing.T) {
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+	source1.Enqueue(httpclienttest.FakeResponse{
+		StatusCode: http.StatusServiceUnavailable,
+	})
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(source1.URL(), nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+	_ = hc.AddSource(source2.URL(), nil, loadbalancer.ServerOptions{})
+
+	err := hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if res.Err() == nil && res.StatusCode == http.StatusServiceUnavailable {
+				res.SetOffline()
+				res.RetryOnNextServer()
+				return errors.New("unavailable")
+			}
+			return res.Err()
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	sb := strings.Builder{}
+	err = hc.WriteMetrics(&sb)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	metrics := sb.String()
+
+	labels1 := `id="1",source="` + source1.URL() + `",role="primary"`
+	labels2 := `id="2",source="` + source2.URL() + `",role="primary"`
+	for _, line := range []string{
+		"# TYPE loadbalancer_source_requests_total counter",
+		"loadbalancer_source_up{" + labels1 + "} 0",
+		"loadbalancer_source_up{" + labels2 + "} 1",
+		"loadbalancer_source_requests_total{" + labels1 + "} 1",
+		"loadbalancer_source_failures_total{" + labels1 + "} 1",
+		"loadbalancer_source_requests_total{" + labels2 + "} 1",
+		"loadbalancer_source_failures_total{" + labels2 + "} 0",
+		"loadbalancer_source_retries_total{" + labels2 + "} 1",
+		"loadbalancer_source_state{" + labels1 + `,state="offline"} 1`,
+		"loadbalancer_source_state{" + labels1 + `,state="online"} 0`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Fatalf("missing metric line [line=%v]", line)
+		}
+	}
+}
+
+func TestHttpClientExcludeSources(t *testing.T) {
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+	source3 := httpclienttest.NewFakeSource()
+	defer source3.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(source1.URL(), nil, loadbalancer.ServerOptions{
+		Weight: 5,
+	})
+	_ = hc.AddSource(source2.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(source3.URL(), nil, loadbalancer.ServerOptions{})
+
+	// Retries never go back to an attempted source while there are others left
+	var picked []int
+	err := hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			picked = append(picked, res.SourceID())
+			if res.RetryCount() < 2 {
+				res.RetryOnNextServer()
+			}
+			return res.Err()
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fmt.Sprint(picked) != "[1 2 3]" {
+		t.Fatalf("unexpected sources [picked=%v]", picked)
+	}
+
+	// Once all the sources were attempted, the error of the last attempt is returned
+	errUnavailable := errors.New("unavailable")
+	picked = nil
+	err = hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			picked = append(picked, res.SourceID())
+			res.RetryOnNextServer()
+			return errUnavailable
+		}).
+		Exec()
+	if !errors.Is(err, errUnavailable) {
+		t.Fatalf("expected the last attempt error [err=%v]", err)
+	}
+	if fmt.Sprint(picked) != "[1 2 3]" {
+		t.Fatalf("unexpected sources [picked=%v]", picked)
+	}
+
+	// Excluded sources are never used
+	for idx := 0; idx < 4; idx++ {
+		err = hc.NewRequest(context.Background(), "/test").
+			ExcludeSources(source1.URL(), source3.URL()).
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				if res.SourceID() != 2 {
+					return fmt.Errorf("unexpected source [id=%v]", res.SourceID())
+				}
+				return res.Err()
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestHttpClientMaxAttempts(t *testing.T) {
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+	source3 := httpclienttest.NewFakeSource()
+	defer source3.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(source1.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(source2.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(source3.URL(), nil, loadbalancer.ServerOptions{})
+
+	errUnavailable := errors.New("unavailable")
+	attempts := 0
+	err := hc.NewRequest(context.Background(), "/test").
+		MaxAttempts(2).
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			attempts += 1
+			res.RetryOnNextServer()
+			return errUnavailable
+		}).
+		Exec()
+	if !errors.Is(err, errUnavailable) {
+		t.Fatalf("expected the last attempt error [err=%v]", err)
+	}
+	if attempts != 2 || source1.Hits()+source2.Hits()+source3.Hits() != 2 {
+		t.Fatalf("unexpected number of attempts [attempts=%v]", attempts)
+	}
+}
+
+func TestHttpClientConnStats(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	hc, err := httpclient.New(httpclient.WithConnStats())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+
+	for idx := 0; idx < 3; idx++ {
+		err = hc.NewRequest(context.Background(), "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	ss := hc.StateSnapshot().Sources[0]
+	if ss.NewConns != 1 || ss.ReusedConns != 2 || ss.OpenConns != 1 {
+		t.Fatalf("unexpected connection stats [new=%v] [reused=%v] [open=%v]", ss.NewConns, ss.ReusedConns,
+			ss.OpenConns)
+	}
+}
+
+func TestHttpClientProbeSource(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	hc := httpclient.Create()
+	defer hc.DisableHealthCheck()
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+
+	err := hc.ProbeSource(source.URL())
+	if err == nil {
+		t.Fatal("expected an error with the health check disabled")
+	}
+
+	err = hc.EnableHealthCheck(httpclient.HealthCheckOptions{
+		Path:     "/health",
+		Interval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	source.Enqueue(httpclienttest.FakeResponse{
+		StatusCode: http.StatusServiceUnavailable,
+	})
+	err = hc.ProbeSource(source.URL())
+	if err == nil || hc.SourceState(0).IsOnline {
+		t.Fatal("expected the source to be offline after a failed probe")
+	}
+
+	err = hc.ProbeSource(source.URL())
+	if err != nil || !hc.SourceState(0).IsOnline {
+		t.Fatalf("expected the source to be online after a successful probe [err=%v]", err)
+	}
+}
+
+func TestHttpClientOverloaded(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+	source.Enqueue(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Delay:      200 * time.Millisecond,
+	})
+
+	hc := httpclient.Create()
+	_ = hc.AddSourceWithOptions(source.URL(), httpclient.SourceOptions{
+		MaxConcurrent: 1,
+	})
+
+	exec := func() error {
+		return hc.NewRequest(context.Background(), "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- exec()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The source is busy with the slow request
+	err := exec()
+	if !errors.Is(err, httpclient.ErrOverloaded) || errors.Is(err, loadbalancer.ErrNoServersAvailable) {
+		t.Fatalf("expected an overloaded error [err=%v]", err)
+	}
+
+	err = <-errCh
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpClientRequireResponseHeader(t *testing.T) {
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+	source2.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"X-Backend": []string{"api"}},
+	})
+
+	hc := httpclient.Create()
+	for _, source := range []*httpclienttest.FakeSource{source1, source2} {
+		_ = hc.AddSourceWithOptions(source.URL(), httpclient.SourceOptions{
+			ServerOptions: loadbalancer.ServerOptions{
+				MaxFails:    1,
+				FailTimeout: time.Minute,
+			},
+			RequireResponseHeader: &httpclient.HeaderRequirement{
+				Name:  "X-Backend",
+				Value: "api",
+			},
+		})
+	}
+
+	// The first source lacks the header, so it is marked as offline and the request is retried
+	err := hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				res.RetryOnNextServer()
+			}
+			return res.Err()
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if hc.SourceState(0).IsOnline || !hc.SourceState(1).IsOnline {
+		t.Fatal("expected only the source lacking the header to be offline")
+	}
+}
+
+func TestHttpClientRedirectLoop(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+	}))
+	defer srv.Close()
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(srv.URL, nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+
+	// Idempotent requests fail over to the next source
+	err := hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if res.SourceID() != 2 {
+				return fmt.Errorf("unexpected source [id=%v]", res.SourceID())
+			}
+			return res.Err()
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if hc.SourceState(0).IsOnline {
+		t.Fatal("expected the redirecting source to be offline")
+	}
+
+	// Other requests report the redirect chain
+	_ = hc.SetSourceOnline(srv.URL)
+	err = hc.NewRequest(context.Background(), "/test").
+		Method("POST").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			return res.Err()
+		}).
+		Exec()
+	if !errors.Is(err, httpclient.ErrRedirectLoop) || !strings.Contains(err.Error(), srv.URL+"/test -> ") {
+		t.Fatalf("expected a redirect loop error [err=%v]", err)
+	}
+}
+
+func TestHttpClientCache(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+	source.Enqueue(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Cache-Control": []string{"max-age=0, stale-if-error=60"}},
+		Body:       []byte("cached"),
+	}, httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Cache-Control": []string{"no-store"}},
+		Body:       []byte("live"),
+	}, httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Cache-Control": []string{"max-age=0, stale-if-error=60"}},
+		Body:       []byte("rejected"),
+	})
+
+	hc := httpclient.Create()
+	err := hc.EnableCache(10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+
+	exec := func(url string, expectedBody string, expectFallback bool) error {
+		return hc.NewRequest(context.Background(), url).
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				if res.Err() != nil {
+					return res.Err()
+				}
+				body, _ := io.ReadAll(res.Body)
+				if string(body) != expectedBody || res.IsFallback() != expectFallback {
+					return fmt.Errorf("unexpected response [body=%v] [fallback=%v]", string(body), res.IsFallback())
+				}
+				return nil
+			}).
+			Exec()
+	}
+
+	// Live responses are used while the source is up
+	err = exec("/cached", "cached", false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = exec("/live", "live", false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Responses rejected by the callback are not cached
+	errRejected := errors.New("rejected")
+	err = hc.NewRequest(context.Background(), "/rejected").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			return errRejected
+		}).
+		Exec()
+	if !errors.Is(err, errRejected) {
+		t.Fatalf("expected the callback error [err=%v]", err)
+	}
+
+	// Once down, only the accepted cacheable response is served
+	_ = hc.SetSourceOfflineFor(source.URL(), time.Minute)
+	err = exec("/cached", "cached", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = exec("/live", "", true)
+	if !errors.Is(err, loadbalancer.ErrNoServersAvailable) {
+		t.Fatalf("expected no servers available [err=%v]", err)
+	}
+	err = exec("/rejected", "", true)
+	if !errors.Is(err, loadbalancer.ErrNoServersAvailable) {
+		t.Fatalf("expected no servers available [err=%v]", err)
+	}
+}
+
+func TestHttpClientWarm(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+	source.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusNotFound,
+	})
+	down := httpclienttest.NewFakeSource()
+	down.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(down.URL(), nil, loadbalancer.ServerOptions{})
+
+	results := hc.Warm(context.Background())
+	if len(results) != 2 || results[source.URL()] != nil || results[down.URL()] == nil {
+		t.Fatalf("unexpected warm results [results=%v]", results)
+	}
+	if source.Requests()[0].Method != "HEAD" || hc.StateSnapshot().Sources[0].OpenConns != 1 {
+		t.Fatal("expected a connection to be opened with a HEAD request")
+	}
+}
+
+func TestHttpClientRetryOnErrors(t *testing.T) {
+	down := httpclienttest.NewFakeSource()
+	down.Close()
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(down.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+
+	exec := func(target error) error {
+		return hc.NewRequest(context.Background(), "/test").
+			RetryOnErrors(target).
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+	}
+
+	// Only matching errors are retried
+	err := exec(syscall.ECONNREFUSED)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if source.Hits() != 1 {
+		t.Fatal("expected the request to be retried on the second source")
+	}
+	err = exec(io.EOF)
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected a connection refused error [err=%v]", err)
+	}
+}
+
+func TestHttpClientTrafficSplit(t *testing.T) {
+	stable1 := httpclienttest.NewFakeSource()
+	defer stable1.Close()
+	stable2 := httpclienttest.NewFakeSource()
+	defer stable2.Close()
+	canary := httpclienttest.NewFakeSource()
+	defer canary.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(stable1.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(stable2.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(canary.URL(), nil, loadbalancer.ServerOptions{
+		Weight: 10,
+	})
+
+	err := hc.SetTrafficSplit(map[string]float64{canary.URL(): 60, stable1.URL(): 50})
+	if err == nil {
+		t.Fatal("expected an error with shares exceeding 100%")
+	}
+	err = hc.SetTrafficSplit(map[string]float64{canary.URL(): 5})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for idx := 0; idx < 100; idx++ {
+		err = hc.NewRequest(context.Background(), "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if canary.Hits() != 5 || stable1.Hits() < 40 || stable2.Hits() < 40 {
+		t.Fatalf("unexpected traffic split [canary=%v] [stable1=%v] [stable2=%v]", canary.Hits(), stable1.Hits(),
+			stable2.Hits())
+	}
+}
+
+func TestHttpClientUpdateSourceURL(t *testing.T) {
+	oldSource := httpclienttest.NewFakeSource()
+	defer oldSource.Close()
+	newSource := httpclienttest.NewFakeSource()
+	defer newSource.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(oldSource.URL(), nil, loadbalancer.ServerOptions{
+		Weight: 3,
+	})
+
+	err := hc.UpdateSourceURL(oldSource.URL(), "invalid")
+	if err == nil {
+		t.Fatal("expected an error with an invalid url")
+	}
+	err = hc.UpdateSourceURL(oldSource.URL(), newSource.URL()+"/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = hc.UpdateSourceURL(oldSource.URL(), newSource.URL())
+	if err == nil {
+		t.Fatal("expected an error with an unknown source")
+	}
+
+	err = hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if res.SourceID() != 1 || res.SourceBaseURL() != newSource.URL() {
+				return fmt.Errorf("unexpected source [id=%v] [url=%v]", res.SourceID(), res.SourceBaseURL())
+			}
+			return res.Err()
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if oldSource.Hits() != 0 || newSource.Hits() != 1 || hc.StateSnapshot().Sources[0].Weight != 3 {
+		t.Fatal("expected the request to be sent to the new url keeping the source settings")
+	}
+}
+
+func TestHttpClientExecN(t *testing.T) {
+	hc := httpclient.Create()
+	for idx := 0; idx < 3; idx++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.Copy(w, r.Body)
+		}))
+		defer srv.Close()
+		_ = hc.AddSource(srv.URL, nil, loadbalancer.ServerOptions{})
+	}
+
+	results, err := hc.NewRequest(context.Background(), "/test").
+		Method("POST").
+		Body(strings.NewReader("payload")).
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != "payload" {
+				return fmt.Errorf("unexpected body [body=%v]", string(body))
+			}
+			return nil
+		}).
+		ExecN(2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(results) != 2 || results[0].SourceID == results[1].SourceID {
+		t.Fatalf("expected two distinct sources [results=%+v]", results)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Fatal(result.Err.Error())
+		}
+	}
+
+	// Only the available sources are used
+	results, err = hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			return res.Err()
+		}).
+		ExecN(5)
+	if err != nil || len(results) != 3 {
+		t.Fatalf("expected three results [count=%v] [err=%v]", len(results), err)
+	}
+}
+
+func TestHttpClientSourceResponseHeaderTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 50 * time.Millisecond
+
+	hc := httpclient.CreateWithTransport(transport)
+	_ = hc.AddSourceWithOptions(srv.URL, httpclient.SourceOptions{
+		ResponseHeaderTimeout: -1,
+	})
+
+	// The long-polling source is not affected by the transport timeout
+	err := hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			return res.Err()
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpClientRequestID(t *testing.T) {
+	receivedIDs := make(chan string, 4)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedIDs <- r.Header.Get("X-Request-Id")
+		w.WriteHeader(http.StatusOK)
+	})
+	srv1 := httptest.NewServer(handler)
+	defer srv1.Close()
+	srv2 := httptest.NewServer(handler)
+	defer srv2.Close()
+
+	hc, err := httpclient.New(httpclient.WithRequestIDHeader("X-Request-Id", nil))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource(srv1.URL, nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(srv2.URL, nil, loadbalancer.ServerOptions{})
+
+	// The same id is sent on retries
+	requestID := ""
+	err = hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			if id := httpclient.RequestIDFromContext(ctx); id != res.RequestID() {
+				return fmt.Errorf("context id mismatch [id=%v]", id)
+			}
+			requestID = res.RequestID()
+			if res.RetryCount() == 0 {
+				res.RetryOnNextServer()
+			}
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(requestID) != 36 {
+		t.Fatalf("unexpected request id [id=%v]", requestID)
+	}
+	for i := 0; i < 2; i++ {
+		if id := <-receivedIDs; id != requestID {
+			t.Fatalf("unexpected request id sent [id=%v]", id)
+		}
+	}
+
+	// An id set by the caller is kept
+	err = hc.NewRequest(context.Background(), "/test").
+		Headers(http.Header{"X-Request-Id": []string{"caller-id"}}).
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if res.RequestID() != "caller-id" {
+				return fmt.Errorf("unexpected request id [id=%v]", res.RequestID())
+			}
+			return res.Err()
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if id := <-receivedIDs; id != "caller-id" {
+		t.Fatalf("unexpected request id sent [id=%v]", id)
+	}
+}
+
+func TestHttpClientSourceSLA(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSourceWithOptions(srv.URL, httpclient.SourceOptions{
+		SLA: 50 * time.Millisecond,
+	})
+
+	for _, path := range []string{"/fast", "/fast", "/fast", "/slow"} {
+		err := hc.NewRequest(context.Background(), path).
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	ss := hc.StateSnapshot().Sources[0]
+	if ss.SLAMet != 3 || ss.SLAMissed != 1 {
+		t.Fatalf("unexpected sla counters [met=%v] [missed=%v]", ss.SLAMet, ss.SLAMissed)
+	}
+}
+
+func TestHttpClientWaitForSlot(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+	source.Enqueue(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Delay:      200 * time.Millisecond,
+	})
+
+	hc := httpclient.Create()
+	_ = hc.AddSourceWithOptions(source.URL(), httpclient.SourceOptions{
+		MaxConcurrent: 1,
+	})
+
+	exec := func(ctx context.Context) error {
+		return hc.NewRequest(ctx, "/test").
+			WaitForSlot().
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- exec(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The wait expires before the slow request completes
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err := exec(ctx)
+	cancelCtx()
+	if !errors.Is(err, httpclient.ErrTimeout) {
+		t.Fatalf("expected a timeout error [err=%v]", err)
+	}
+
+	// The request is sent once the slow one completes
+	err = exec(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = <-errCh
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpClientDefaultSourceOptions(t *testing.T) {
+	hc, err := httpclient.New(httpclient.WithDefaultSourceOptions(httpclient.SourceOptions{
+		ServerOptions: loadbalancer.ServerOptions{
+			Weight:      3,
+			MaxFails:    5,
+			FailTimeout: time.Minute,
+		},
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSourceWithOptions("http://127.0.0.1:1", httpclient.SourceOptions{})
+	_ = hc.AddSourceWithOptions("http://127.0.0.1:2", httpclient.SourceOptions{
+		ServerOptions: loadbalancer.ServerOptions{
+			Weight: 1,
+		},
+	})
+
+	// Only the options left unset take the default value
+	snapshot := hc.StateSnapshot()
+	if snapshot.Sources[0].Weight != 3 || snapshot.Sources[1].Weight != 1 {
+		t.Fatalf("unexpected weights [first=%v] [second=%v]", snapshot.Sources[0].Weight, snapshot.Sources[1].Weight)
+	}
+}
+
+func TestHttpClientDefaultSourceOptionsOverrides(t *testing.T) {
+	hc, err := httpclient.New(httpclient.WithDefaultSourceOptions(httpclient.SourceOptions{
+		ServerOptions: loadbalancer.ServerOptions{
+			IsBackup: true,
+		},
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSourceWithOptions("http://127.0.0.1:1", httpclient.SourceOptions{})
+
+	// Zero values cannot override the defaults, explicit ones can
+	disabled := false
+	_ = hc.AddSourceWithOptions("http://127.0.0.1:2", httpclient.SourceOptions{
+		Overrides: httpclient.SourceOverrides{
+			IsBackup: &disabled,
+		},
+	})
+
+	snapshot := hc.StateSnapshot()
+	if !snapshot.Sources[0].IsBackup || snapshot.Sources[1].IsBackup {
+		t.Fatalf("unexpected backup roles [first=%v] [second=%v]", snapshot.Sources[0].IsBackup,
+			snapshot.Sources[1].IsBackup)
+	}
+}
+
+func TestHttpClientDrainSource(t *testing.T) {
+	slowSource := httpclienttest.NewFakeSource()
+	defer slowSource.Close()
+	slowSource.Enqueue(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Delay:      200 * time.Millisecond,
+	})
+	otherSource := httpclienttest.NewFakeSource()
+	defer otherSource.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(slowSource.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(otherSource.URL(), nil, loadbalancer.ServerOptions{})
+
+	exec := func() (int, error) {
+		sourceID := 0
+		err := hc.NewRequest(context.Background(), "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				sourceID = res.SourceID()
+				return res.Err()
+			}).
+			Exec()
+		return sourceID, err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := exec()
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	doneCh := make(chan int, 1)
+	err := hc.DrainSource(slowSource.URL(), time.Second, func(result int) {
+		doneCh <- result
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// New requests go to the other source while the in-flight one completes
+	for i := 0; i < 3; i++ {
+		sourceID, err := exec()
+		if err != nil || sourceID != 2 {
+			t.Fatalf("unexpected source [id=%v] [err=%v]", sourceID, err)
+		}
+	}
+	if result := <-doneCh; result != httpclient.DrainCompleted {
+		t.Fatalf("expected a clean drain [result=%v]", result)
+	}
+	if err = <-errCh; err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The source is used again once set online
+	_ = hc.SetSourceOnline(slowSource.URL())
+	usedIDs := make(map[int]bool)
+	for i := 0; i < 2; i++ {
+		sourceID, _ := exec()
+		usedIDs[sourceID] = true
+	}
+	if !usedIDs[1] {
+		t.Fatal("expected the drained source to be used again")
+	}
+}
+
+func TestHttpClientDrainSourceCanceled(t *testing.T) {
+	slowSource := httpclienttest.NewFakeSource()
+	defer slowSource.Close()
+	slowSource.Enqueue(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Delay:      300 * time.Millisecond,
+	})
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(slowSource.URL(), nil, loadbalancer.ServerOptions{})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- hc.NewRequest(context.Background(), "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	doneCh := make(chan int, 1)
+	err := hc.DrainSource(slowSource.URL(), 100*time.Millisecond, func(result int) {
+		doneCh <- result
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Setting the source online cancels the drain, so the in-flight request is not aborted once the timeout expires
+	_ = hc.SetSourceOnline(slowSource.URL())
+	if result := <-doneCh; result != httpclient.DrainCanceled {
+		t.Fatalf("expected a canceled drain [result=%v]", result)
+	}
+	if err = <-errCh; err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpClientHealthCheckJitter(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	hc, err := httpclient.New(httpclient.WithWarmup())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer hc.DisableHealthCheck()
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+
+	err = hc.EnableHealthCheck(httpclient.HealthCheckOptions{
+		Path:     "/health",
+		Interval: 50 * time.Millisecond,
+		Jitter:   1.5,
+	})
+	if err == nil {
+		t.Fatal("expected an invalid jitter to be rejected")
+	}
+
+	// The first check is delayed by up to the jitter
+	err = hc.EnableHealthCheck(httpclient.HealthCheckOptions{
+		Path:     "/health",
+		Interval: 50 * time.Millisecond,
+		Jitter:   0.5,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if !hc.SourceState(0).IsOnline {
+		t.Fatal("expected the source to be online after a health check")
+	}
+}
+
+type testBreaker struct {
+	mtx       sync.Mutex
+	open      bool
+	asked     int
+	successes int
+	failures  int
+}
+
+func (b *testBreaker) Allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.asked += 1
+	return !b.open
+}
+
+func (b *testBreaker) Success() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.successes += 1
+}
+
+func (b *testBreaker) Failure() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.failures += 1
+	b.open = true
+}
+
+func TestHttpClientBreakerFactory(t *testing.T) {
+	failingSource := httpclienttest.NewFakeSource()
+	defer failingSource.Close()
+	failingSource.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusServiceUnavailable,
+	})
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	breakers := make(map[string]*testBreaker)
+	hc, err := httpclient.New(httpclient.WithBreakerFactory(func(baseURL string) httpclient.Breaker {
+		b := &testBreaker{}
+		breakers[baseURL] = b
+		return b
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource(failingSource.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+
+	for i := 0; i < 4; i++ {
+		err = hc.NewRequest(context.Background(), "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				if res.Err() != nil {
+					return res.Err()
+				}
+				if res.StatusCode != http.StatusOK {
+					res.SetOffline()
+					res.RetryOnNextServer()
+				}
+				return nil
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// The failing source is skipped once its breaker opens
+	if b := breakers[failingSource.URL()]; b.failures != 1 || b.successes != 0 {
+		t.Fatalf("unexpected failing source breaker counters [failures=%v] [successes=%v]", b.failures, b.successes)
+	}
+	if b := breakers[source.URL()]; b.successes != 4 {
+		t.Fatalf("unexpected source breaker counters [successes=%v]", b.successes)
+	}
+	if !hc.SourceState(0).IsOnline {
+		t.Fatal("expected the built-in state to be left untouched")
+	}
+}
+
+type firstSourceSelector struct{}
+
+func (firstSourceSelector) Select(sources []*httpclient.Source) *httpclient.Source {
+	if len(sources) == 0 {
+		return nil
+	}
+	return sources[0]
+}
+
+func TestHttpClientBreakerAskedOnce(t *testing.T) {
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+
+	breakers := make(map[string]*testBreaker)
+	hc, err := httpclient.New(httpclient.WithBreakerFactory(func(baseURL string) httpclient.Breaker {
+		b := &testBreaker{}
+		breakers[baseURL] = b
+		return b
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource(source1.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(source2.URL(), nil, loadbalancer.ServerOptions{})
+	hc.SetSelector(firstSourceSelector{})
+
+	execRequests := func() {
+		for i := 0; i < 4; i++ {
+			err = hc.NewRequest(context.Background(), "/test").
+				Callback(func(ctx context.Context, res httpclient.Response) error {
+					return res.Err()
+				}).
+				Exec()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+
+	// Only the breaker of the selected source is asked
+	execRequests()
+	if breakers[source1.URL()].asked != 4 || breakers[source2.URL()].asked != 0 {
+		t.Fatalf("unexpected breaker calls [first=%v] [second=%v]", breakers[source1.URL()].asked,
+			breakers[source2.URL()].asked)
+	}
+
+	// Once the breaker refuses, the next source is selected
+	breakers[source1.URL()].open = true
+	execRequests()
+	if breakers[source1.URL()].asked != 8 || breakers[source2.URL()].asked != 4 || source2.Hits() != 4 {
+		t.Fatalf("unexpected breaker calls [first=%v] [second=%v] [hits=%v]", breakers[source1.URL()].asked,
+			breakers[source2.URL()].asked, source2.Hits())
+	}
+}
+
+func TestHttpClientExecNPartialResults(t *testing.T) {
+	fastSource := httpclienttest.NewFakeSource()
+	defer fastSource.Close()
+	slowSource := httpclienttest.NewFakeSource()
+	defer slowSource.Close()
+	slowSource.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Delay:      time.Second,
+	})
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(fastSource.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(slowSource.URL(), nil, loadbalancer.ServerOptions{})
+
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelCtx()
+
+	startTime := time.Now()
+	results, err := hc.NewRequest(ctx, "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			return res.Err()
+		}).
+		ExecN(2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if elapsed := time.Since(startTime); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected to return when the context expired [elapsed=%v]", elapsed)
+	}
+
+	// The slow source result is still pending, unless its attempt noticed the expired context first
+	for _, result := range results {
+		if result.BaseURL == slowSource.URL() {
+			if !errors.Is(result.Err, httpclient.ErrPending) && !errors.Is(result.Err, httpclient.ErrTimeout) {
+				t.Fatalf("expected a pending result [err=%v]", result.Err)
+			}
+		} else if result.Err != nil {
+			t.Fatal(result.Err.Error())
+		}
+	}
+}
+
+func TestHttpClientConfig(t *testing.T) {
+	hc, err := httpclient.New(httpclient.WithStickyPrimary(), httpclient.WithMinPrimary(1))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource("http://127.0.0.1:1", nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource("http://127.0.0.1:2", nil, loadbalancer.ServerOptions{IsBackup: true})
+	_ = hc.AddSourceWithOptions("http://127.0.0.1:3", httpclient.SourceOptions{IsShadow: true})
+
+	cfg := hc.Config()
+	if cfg.Strategy != httpclient.StrategySticky || cfg.MinPrimary != 1 || cfg.HealthCheck != nil {
+		t.Fatalf("unexpected config [config=%+v]", cfg)
+	}
+	if cfg.Sources.Primary != 1 || cfg.Sources.Backup != 1 || cfg.Sources.Shadow != 1 {
+		t.Fatalf("unexpected source counts [sources=%+v]", cfg.Sources)
+	}
+	if cfg.Transport.ResponseHeaderTimeout != 5*time.Second {
+		t.Fatalf("unexpected transport config [transport=%+v]", cfg.Transport)
+	}
+	if _, err = json.Marshal(cfg); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	hc.SetSelector(nil)
+	hc.SetStickyPrimary(false)
+	if strategy := hc.Config().Strategy; strategy != httpclient.StrategyWeightedRoundRobin {
+		t.Fatalf("unexpected strategy [strategy=%v]", strategy)
+	}
+}
+
+func TestHttpClientStatusErrorPolicy(t *testing.T) {
+	failingSource := httpclienttest.NewFakeSource()
+	defer failingSource.Close()
+	failingSource.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusServiceUnavailable,
+	})
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	hc, err := httpclient.New(httpclient.WithStatusErrorPolicy(httpclient.StatusErrorPolicy{
+		NoMarkDown: true,
+		NoRetry:    true,
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource(failingSource.URL(), nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+
+	client := http.Client{
+		Transport: hc.RoundTripper(),
+	}
+
+	// The error response is neither retried nor blamed on the source
+	resp, err := client.Get("http://backend/test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || source.Hits() != 0 {
+		t.Fatalf("unexpected response [status=%v] [hits=%v]", resp.StatusCode, source.Hits())
+	}
+	if !hc.SourceState(0).IsOnline {
+		t.Fatal("expected the source to remain online")
+	}
+}
+
+func TestHttpClientPromoteSourceToPrimary(t *testing.T) {
+	hc := httpclient.Create()
+	_ = hc.AddSource("http://127.0.0.1:1", nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource("http://127.0.0.1:2", nil, loadbalancer.ServerOptions{IsBackup: true})
+
+	err := hc.PromoteSourceToPrimary("http://127.0.0.1:2")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if hc.SourceState(1).IsBackup || hc.Config().Sources.Primary != 2 {
+		t.Fatal("expected the source to be promoted")
+	}
+
+	err = hc.DemoteSourceToBackup("http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !hc.SourceState(0).IsBackup || !hc.StateSnapshot().Sources[0].IsBackup {
+		t.Fatal("expected the source to be demoted")
+	}
+	if err = hc.DemoteSourceToBackup("http://127.0.0.1:1"); err == nil {
+		t.Fatal("expected an error demoting a backup source")
+	}
+
+	// Changing the role while cloning the client is safe
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for idx := 0; idx < 50; idx++ {
+			_ = hc.PromoteSourceToPrimary("http://127.0.0.1:1")
+			_ = hc.SetSourceFailPolicy("http://127.0.0.1:1", 3, time.Second)
+			_ = hc.DemoteSourceToBackup("http://127.0.0.1:1")
+		}
+	}()
+	for idx := 0; idx < 50; idx++ {
+		_, err = hc.Clone()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	<-done
+}
+
+func TestHttpClientTraceSelection(t *testing.T) {
+	failingSource := httpclienttest.NewFakeSource()
+	defer failingSource.Close()
+	failingSource.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusServiceUnavailable,
+	})
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+	downSource := httpclienttest.NewFakeSource()
+	defer downSource.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(failingSource.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{Weight: 2})
+	_ = hc.AddSource(downSource.URL(), nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+	_ = hc.SetSourceOfflineFor(downSource.URL(), time.Minute)
+
+	req := hc.NewRequest(context.Background(), "/test").
+		TraceSelection().
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			if res.StatusCode != http.StatusOK {
+				res.RetryOnNextServer()
+				return errors.New("unexpected status")
+			}
+			return nil
+		})
+	err := req.Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	trace := req.SelectionTrace()
+	if len(trace) != 2 || trace[0].SourceID != 1 || trace[0].Err == nil {
+		t.Fatalf("unexpected first attempt [trace=%+v]", trace)
+	}
+	if trace[1].SourceID != 2 || trace[1].Weight != 2 || trace[1].Err != nil {
+		t.Fatalf("unexpected second attempt [trace=%+v]", trace)
+	}
+
+	// The down source is reported on each attempt
+	for _, attempt := range trace {
+		reasons := make(map[int]string)
+		for _, skipped := range attempt.Skipped {
+			reasons[skipped.SourceID] = skipped.Reason
+		}
+		if reasons[3] != httpclient.SkipReasonDown {
+			t.Fatalf("unexpected skipped sources [skipped=%+v]", attempt.Skipped)
+		}
+	}
+}
+
+func TestHttpClientMaxConnAge(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	hc, err := httpclient.New(httpclient.WithConnStats(), httpclient.WithMaxConnAge(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+
+	exec := func() {
+		err = hc.NewRequest(context.Background(), "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// A young connection is reused
+	exec()
+	exec()
+
+	// An old one is closed and a new one established
+	time.Sleep(100 * time.Millisecond)
+	exec()
+	exec()
+
+	ss := hc.StateSnapshot().Sources[0]
+	if ss.NewConns != 2 {
+		t.Fatalf("unexpected connection stats [new=%v] [reused=%v]", ss.NewConns, ss.ReusedConns)
+	}
+
+	if hc.SetMaxConnAge(-time.Second) == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestHttpClientAdaptiveWeights(t *testing.T) {
+	fastSource := httpclienttest.NewFakeSource()
+	defer fastSource.Close()
+	slowSource := httpclienttest.NewFakeSource()
+	defer slowSource.Close()
+	slowSource.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Delay:      20 * time.Millisecond,
+	})
+
+	hc, err := httpclient.New(httpclient.WithAdaptiveWeights(httpclient.AdaptiveWeightOptions{
+		Rate:      1,
+		MinWeight: 1,
+		MaxWeight: 10,
+		Interval:  time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource(fastSource.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(slowSource.URL(), nil, loadbalancer.ServerOptions{})
+
+	for idx := 0; idx < 10; idx++ {
+		err = hc.NewRequest(context.Background(), "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// The fast source earns the maximum weight and the slow one is clamped to the minimum
+	sources := hc.StateSnapshot().Sources
+	if sources[0].Weight != 10 || sources[1].Weight != 1 {
+		t.Fatalf("unexpected weights [fast=%v] [slow=%v]", sources[0].Weight, sources[1].Weight)
+	}
+
+	err = hc.SetAdaptiveWeights(httpclient.AdaptiveWeightOptions{
+		Rate:      0.5,
+		MinWeight: 5,
+		MaxWeight: 1,
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestHttpClientRetryStaleConns(t *testing.T) {
+	// The server answers the first request of each connection and closes it when the second one arrives, as if the
+	// idle timeout expired right then
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+	var conns int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func(conn net.Conn) {
+				defer func() {
+					_ = conn.Close()
+				}()
+				reader := bufio.NewReader(conn)
+				r, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				_, _ = io.Copy(io.Discard, r.Body)
+				_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+				_, _ = http.ReadRequest(reader)
+			}(conn)
+		}
+	}()
+
+	hc, err := httpclient.New(httpclient.WithRetryStaleConns())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource("http://"+ln.Addr().String(), nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+
+	for idx := 0; idx < 2; idx++ {
+		err = hc.NewRequest(context.Background(), "/test").
+			Method("PUT").
+			Body(strings.NewReader("data")).
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Fatalf("unexpected number of connections [conns=%v]", n)
+	}
+	if hc.StateSnapshot().Sources[0].IsDown {
+		t.Fatal("the source should be online")
+	}
+}
+
+func TestHttpClientExecTyped(t *testing.T) {
+	type result struct {
+		Value int `json:"value"`
+	}
+
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+	source1.Enqueue(httpclienttest.FakeResponse{
+		StatusCode: http.StatusServiceUnavailable,
+	})
+	source2.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Body:       []byte(`{"value":42}`),
+	})
+
+	hc, _ := httpclient.New()
+	_ = hc.AddSource(source1.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(source2.URL(), nil, loadbalancer.ServerOptions{})
+
+	// The unavailable source is skipped
+	res, err := httpclient.ExecTyped[result](hc.NewRequest(context.Background(), "/test"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Value != 42 || source1.Hits() != 1 {
+		t.Fatalf("unexpected result [value=%v] [hits=%v]", res.Value, source1.Hits())
+	}
+
+	// Client errors are not retried and include the body
+	for _, source := range []*httpclienttest.FakeSource{source1, source2} {
+		source.Enqueue(httpclienttest.FakeResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       []byte("not found"),
+		})
+	}
+	_, err = httpclient.ExecTyped[result](hc.NewRequest(context.Background(), "/test"))
+	var statusErr *httpclient.HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound || string(statusErr.Body) != "not found" {
+		t.Fatalf("unexpected error [err=%v]", err)
+	}
+
+	// Canceled requests are not retried
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := hc.NewRequest(ctx, "/test").TraceSelection()
+	_, err = httpclient.ExecTyped[result](req)
+	if !errors.Is(err, httpclient.ErrCanceled) {
+		t.Fatalf("expected a canceled error [err=%v]", err)
+	}
+	if len(req.SelectionTrace()) != 1 {
+		t.Fatalf("canceled request retried [attempts=%v]", len(req.SelectionTrace()))
+	}
+
+	// Neither are the expired ones
+	slowSource1 := httpclienttest.NewFakeSource()
+	defer slowSource1.Close()
+	slowSource2 := httpclienttest.NewFakeSource()
+	defer slowSource2.Close()
+	hc, _ = httpclient.New()
+	for _, source := range []*httpclienttest.FakeSource{slowSource1, slowSource2} {
+		source.SetDefault(httpclienttest.FakeResponse{
+			StatusCode: http.StatusOK,
+			Delay:      200 * time.Millisecond,
+		})
+		_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req = hc.NewRequest(ctx, "/test").TraceSelection()
+	_, err = httpclient.ExecTyped[result](req)
+	if !errors.Is(err, httpclient.ErrTimeout) {
+		t.Fatalf("expected a timeout error [err=%v]", err)
+	}
+	if len(req.SelectionTrace()) != 1 || slowSource1.Hits()+slowSource2.Hits() != 1 {
+		t.Fatalf("expired request retried [attempts=%v]", len(req.SelectionTrace()))
+	}
+}
+
+func TestHttpClientEventDelivery(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	run := func(mode int, release chan struct{}) []int {
+		mtx := sync.Mutex{}
+		events := make([]int, 0)
+		hc, err := httpclient.New(
+			httpclient.WithEventDelivery(mode),
+			httpclient.WithEventHandler(func(eventType int, sourceId int, err error) {
+				if release != nil {
+					<-release
+				}
+				mtx.Lock()
+				events = append(events, eventType)
+				mtx.Unlock()
+			}),
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+
+		source.Enqueue(httpclienttest.FakeResponse{}, httpclienttest.FakeResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, httpclienttest.FakeResponse{})
+		for idx := 0; idx < 3; idx++ {
+			_ = hc.NewRequest(context.Background(), "/test").
+				Callback(func(ctx context.Context, res httpclient.Response) error {
+					if res.Err() == nil && res.StatusCode != http.StatusOK {
+						return errors.New("unexpected status")
+					}
+					return res.Err()
+				}).
+				Exec()
+		}
+
+		// The requests were not delayed by the blocked handler
+		if release != nil {
+			close(release)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for {
+			mtx.Lock()
+			count := len(events)
+			mtx.Unlock()
+			if count >= 4 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		return events
+	}
+
+	syncEvents := run(httpclient.EventDeliverySync, nil)
+	asyncEvents := run(httpclient.EventDeliveryAsync, make(chan struct{}))
+	if len(syncEvents) != 4 || fmt.Sprint(syncEvents) != fmt.Sprint(asyncEvents) {
+		t.Fatalf("unexpected events [sync=%v] [async=%v]", syncEvents, asyncEvents)
+	}
+
+	_, err := httpclient.New(httpclient.WithEventDelivery(3))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestHttpClientAddSourcesFromURLs(t *testing.T) {
+	hc := httpclient.Create()
+
+	// Nothing is added if one url is invalid
+	err := hc.AddSourcesFromURLs([]string{"http://127.0.0.1:1", "invalid"}, httpclient.SourceOptions{})
+	if err == nil || !strings.Contains(err.Error(), "invalid") || hc.SourcesCount() != 0 {
+		t.Fatalf("unexpected result [err=%v] [count=%v]", err, hc.SourcesCount())
+	}
+
+	header := http.Header{}
+	header.Set("X-Test", "1")
+	opts := httpclient.SourceOptions{
+		Header: header,
+	}
+	err = hc.AddSourcesFromURLs([]string{"http://127.0.0.1:1", "http://127.0.0.1:2", "http://127.0.0.1:3"}, opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	header.Set("X-Test", "2")
+
+	count := 0
+	for _, ss := range hc.StateSnapshot().Sources {
+		count += 1
+		if ss.ID != count || ss.BaseURL != fmt.Sprintf("http://127.0.0.1:%v", count) {
+			t.Fatalf("unexpected source [id=%v] [url=%v]", ss.ID, ss.BaseURL)
+		}
+	}
+	if count != 3 {
+		t.Fatalf("unexpected number of sources [count=%v]", count)
+	}
+
+	// Changing the options after adding the sources does not affect them
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+	hc = httpclient.Create()
+	header.Set("X-Test", "1")
+	err = hc.AddSourcesFromURLs([]string{source.URL()}, opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	header.Set("X-Test", "2")
+	err = hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			return res.Err()
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if value := source.Requests()[0].Header.Get("X-Test"); value != "1" {
+		t.Fatalf("unexpected header value [value=%v]", value)
+	}
+}
+
+func TestHttpClientResponseValidator(t *testing.T) {
+	staleSource := httpclienttest.NewFakeSource()
+	defer staleSource.Close()
+	freshSource := httpclienttest.NewFakeSource()
+	defer freshSource.Close()
+	staleSource.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"X-Stale": []string{"1"},
+		},
+	})
+
+	opts := httpclient.SourceOptions{
+		ServerOptions: loadbalancer.ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		},
+		ResponseValidator: func(resp *http.Response) (bool, bool) {
+			stale := len(resp.Header.Get("X-Stale")) > 0
+			return !stale, stale
+		},
+	}
+	hc := httpclient.Create()
+	_ = hc.AddSourcesFromURLs([]string{staleSource.URL(), freshSource.URL()}, opts)
+
+	err := hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if res.Err() != nil {
+				return res.Err()
+			}
+			if res.SourceBaseURL() != freshSource.URL() {
+				return errors.New("unexpected source")
+			}
+			return nil
+		}).
+		Exec()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if staleSource.Hits() != 1 || !hc.StateSnapshot().Sources[0].IsDown {
+		t.Fatal("the stale source should be offline")
+	}
+
+	// The RoundTripper also skips the stale source
+	hc = httpclient.Create()
+	_ = hc.AddSourcesFromURLs([]string{staleSource.URL(), freshSource.URL()}, opts)
+	client := http.Client{
+		Transport: hc.RoundTripper(),
+	}
+	resp, err := client.Get("http://backend/test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = resp.Body.Close()
+	if len(resp.Header.Get("X-Stale")) > 0 || !hc.StateSnapshot().Sources[0].IsDown {
+		t.Fatal("the stale source should be offline")
+	}
+}
+
+func TestHttpClientActivateGroup(t *testing.T) {
+	blueSource := httpclienttest.NewFakeSource()
+	defer blueSource.Close()
+	greenSource := httpclienttest.NewFakeSource()
+	defer greenSource.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSourceWithOptions(blueSource.URL(), httpclient.SourceOptions{
+		Group: "blue",
+	})
+	_ = hc.AddSourceWithOptions(greenSource.URL(), httpclient.SourceOptions{
+		Group: "green",
+	})
+
+	exec := func(count int) {
+		for idx := 0; idx < count; idx++ {
+			err := hc.NewRequest(context.Background(), "/test").
+				Callback(func(ctx context.Context, res httpclient.Response) error {
+					return res.Err()
+				}).
+				Exec()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+
+	if err := hc.ActivateGroup("red"); err == nil {
+		t.Fatal("expected an error activating an unknown group")
+	}
+
+	// All the traffic goes to the active group
+	if err := hc.ActivateGroup("blue"); err != nil {
+		t.Fatal(err.Error())
+	}
+	exec(4)
+	if blueSource.Hits() != 4 || greenSource.Hits() != 0 || hc.ActiveGroup() != "blue" {
+		t.Fatalf("unexpected hits [blue=%v] [green=%v]", blueSource.Hits(), greenSource.Hits())
+	}
+
+	// Cut over and roll back
+	_ = hc.ActivateGroup("green")
+	exec(4)
+	if blueSource.Hits() != 4 || greenSource.Hits() != 4 {
+		t.Fatalf("unexpected hits [blue=%v] [green=%v]", blueSource.Hits(), greenSource.Hits())
+	}
+	if err := hc.RollbackGroup(); err != nil || hc.ActiveGroup() != "blue" {
+		t.Fatalf("unexpected rollback [err=%v] [active=%v]", err, hc.ActiveGroup())
+	}
+	exec(4)
+	if blueSource.Hits() != 8 || greenSource.Hits() != 4 {
+		t.Fatalf("unexpected hits [blue=%v] [green=%v]", blueSource.Hits(), greenSource.Hits())
+	}
+}
+
+func TestHttpClientCoalesce(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+	source.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Delay:      300 * time.Millisecond,
+		Body:       []byte("shared"),
+	})
+
+	hc := httpclient.Create()
+	_ = hc.AddSourceWithOptions(source.URL(), httpclient.SourceOptions{
+		SLA: time.Second,
+	})
+
+	exec := func(url string) (string, error) {
+		var body []byte
+		err := hc.NewRequest(context.Background(), url).
+			Coalesce(nil).
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				if err := res.Err(); err != nil {
+					return err
+				}
+				var err error
+				body, err = io.ReadAll(res.Body)
+				return err
+			}).
+			Exec()
+		return string(body), err
+	}
+
+	// Identical requests in flight share a single upstream request
+	wg := sync.WaitGroup{}
+	bodies := make([]string, 5)
+	errs := make([]error, 5)
+	for idx := 0; idx < 5; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			bodies[idx], errs[idx] = exec("/hot")
+		}(idx)
+		if idx == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+	for idx := range bodies {
+		if errs[idx] != nil {
+			t.Fatal(errs[idx].Error())
+		}
+		if bodies[idx] != "shared" {
+			t.Fatalf("unexpected body [%v]", bodies[idx])
+		}
+	}
+	if source.Hits() != 1 {
+		t.Fatalf("unexpected hits [%v]", source.Hits())
+	}
+
+	// Only the shared request counts toward the source stats
+	if ss := hc.StateSnapshot().Sources[0]; ss.Requests != 1 || ss.SLAMet+ss.SLAMissed != 1 || ss.InFlight != 0 {
+		t.Fatalf("unexpected source stats [requests=%v] [sla=%v] [inFlight=%v]", ss.Requests,
+			ss.SLAMet+ss.SLAMissed, ss.InFlight)
+	}
+
+	// Different urls are not coalesced
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = exec("/hot")
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = exec("/cold")
+	}()
+	wg.Wait()
+	if source.Hits() != 3 {
+		t.Fatalf("unexpected hits [%v]", source.Hits())
+	}
+
+	// Large responses are not shared, so the waiting request continues on its own
+	largeBody := strings.Repeat("x", 2<<20)
+	source.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Delay:      300 * time.Millisecond,
+		Body:       []byte(largeBody),
+	})
+	for idx := 0; idx < 2; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			bodies[idx], errs[idx] = exec("/large")
+		}(idx)
+		if idx == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+	for idx := 0; idx < 2; idx++ {
+		if errs[idx] != nil {
+			t.Fatal(errs[idx].Error())
+		}
+		if bodies[idx] != largeBody {
+			t.Fatalf("unexpected body length [%v]", len(bodies[idx]))
+		}
+	}
+	if source.Hits() != 5 {
+		t.Fatalf("unexpected hits [%v]", source.Hits())
+	}
+}
+
+func TestHttpClientRetryReusesConnection(t *testing.T) {
+	var dials int32
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(strings.Repeat("x", 4096)))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&dials, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(server.URL, nil, loadbalancer.ServerOptions{})
+
+	// The callbacks ask for a retry without reading the discarded response bodies
+	for idx := 0; idx < 4; idx++ {
+		err := hc.NewRequest(context.Background(), "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				if err := res.Err(); err != nil {
+					return err
+				}
+				res.RetryOnNextServer()
+				return errors.New("unavailable")
+			}).
+			Exec()
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("connection not reused across requests [dials=%v]", n)
+	}
+}
+
+func TestHttpClientFillFirst(t *testing.T) {
+	sources := make([]*httpclienttest.FakeSource, 3)
+	for idx := range sources {
+		sources[idx] = httpclienttest.NewFakeSource()
+		defer sources[idx].Close()
+	}
+
+	hc := httpclient.Create()
+	hc.SetFillFirst(true)
+	_ = hc.AddSourceWithOptions(sources[0].URL(), httpclient.SourceOptions{
+		ServerOptions: loadbalancer.ServerOptions{Weight: 1},
+	})
+	_ = hc.AddSourceWithOptions(sources[1].URL(), httpclient.SourceOptions{
+		ServerOptions: loadbalancer.ServerOptions{Weight: 3},
+		Capacity:      2,
+	})
+	_ = hc.AddSourceWithOptions(sources[2].URL(), httpclient.SourceOptions{
+		ServerOptions: loadbalancer.ServerOptions{Weight: 2},
+		Capacity:      1,
+	})
+	if hc.Config().Strategy != httpclient.StrategyFillFirst {
+		t.Fatalf("unexpected strategy [%v]", hc.Config().Strategy)
+	}
+
+	exec := func() {
+		_ = hc.NewRequest(context.Background(), "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+	}
+
+	// Under low load, only the source with the highest weight is used
+	for idx := 0; idx < 4; idx++ {
+		exec()
+	}
+	if sources[1].Hits() != 4 || sources[0].Hits()+sources[2].Hits() != 0 {
+		t.Fatalf("unexpected hits [%v/%v/%v]", sources[0].Hits(), sources[1].Hits(), sources[2].Hits())
+	}
+
+	// Concurrent requests overflow to the next source in weight order once the previous is full
+	for _, source := range sources {
+		source.Reset()
+		source.SetDefault(httpclienttest.FakeResponse{
+			StatusCode: http.StatusOK,
+			Delay:      300 * time.Millisecond,
+		})
+	}
+	wg := sync.WaitGroup{}
+	for idx := 0; idx < 5; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			exec()
+		}()
+		time.Sleep(30 * time.Millisecond)
+	}
+	wg.Wait()
+	if sources[1].Hits() != 2 || sources[2].Hits() != 1 || sources[0].Hits() != 2 {
+		t.Fatalf("unexpected hits [%v/%v/%v]", sources[0].Hits(), sources[1].Hits(), sources[2].Hits())
+	}
+}
+
+func TestHttpClientExecDetailed(t *testing.T) {
+	failingSource := httpclienttest.NewFakeSource()
+	defer failingSource.Close()
+	failingSource.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusServiceUnavailable,
+	})
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(failingSource.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+
+	details, err := hc.NewRequest(context.Background(), "/test").
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if err := res.Err(); err != nil {
+				return err
+			}
+			if res.StatusCode != http.StatusOK {
+				res.RetryOnNextServer()
+				return errors.New("unavailable")
+			}
+			return nil
+		}).
+		ExecDetailed()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if details.Attempts != 2 || len(details.AttemptErrors) != 2 {
+		t.Fatalf("unexpected attempts [%v]", details.Attempts)
+	}
+	if details.AttemptErrors[0] == nil || details.AttemptErrors[1] != nil {
+		t.Fatalf("unexpected attempt errors [%v]", details.AttemptErrors)
+	}
+	if details.BaseURL != source.URL() || details.SourceID != 2 {
+		t.Fatalf("unexpected source [%v]", details.BaseURL)
+	}
+	if details.Elapsed <= 0 {
+		t.Fatal("missing elapsed time")
+	}
+}
+
+func TestHttpClientRetryInSameZone(t *testing.T) {
+	zones := []string{"a", "b", "a", "b"}
+	sources := make([]*httpclienttest.FakeSource, len(zones))
+	hc := httpclient.Create()
+	for idx := range sources {
+		sources[idx] = httpclienttest.NewFakeSource()
+		defer sources[idx].Close()
+		sources[idx].SetDefault(httpclienttest.FakeResponse{
+			StatusCode: http.StatusServiceUnavailable,
+		})
+		_ = hc.AddSourceWithOptions(sources[idx].URL(), httpclient.SourceOptions{
+			Zone: zones[idx],
+		})
+	}
+
+	// Failover stays in the zone of the first source until all of its sources were attempted
+	attempted := make([]string, 0)
+	_ = hc.NewRequest(context.Background(), "/test").
+		RetryInSameZone().
+		MaxAttempts(4).
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			attempted = append(attempted, strings.TrimSuffix(res.URL(), "/test"))
+			res.RetryOnNextServer()
+			return errors.New("unavailable")
+		}).
+		Exec()
+	if len(attempted) != 4 {
+		t.Fatalf("unexpected attempts [%v]", attempted)
+	}
+	if attempted[0] != sources[0].URL() || attempted[1] != sources[2].URL() {
+		t.Fatalf("retry left the zone [%v]", attempted)
+	}
+}
+
+func TestHttpClientOnStateChange(t *testing.T) {
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(source1.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(source2.URL(), nil, loadbalancer.ServerOptions{})
+
+	snapshotsCh := make(chan httpclient.StateSnapshot, 10)
+	hc.OnStateChange(func(snapshot httpclient.StateSnapshot) {
+		snapshotsCh <- snapshot
+	})
+
+	// Rapid changes are coalesced
+	_ = hc.SetSourceOfflineFor(source1.URL(), time.Minute)
+	_ = hc.DrainSource(source2.URL(), time.Second, nil)
+	select {
+	case snapshot := <-snapshotsCh:
+		if !snapshot.Sources[0].IsDown || !snapshot.Sources[1].IsDraining {
+			t.Fatalf("unexpected snapshot [%+v]", snapshot)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("state change not notified")
+	}
+	select {
+	case snapshot := <-snapshotsCh:
+		t.Fatalf("unexpected notification [%+v]", snapshot)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// Once removed, the handler is not called
+	hc.OnStateChange(nil)
+	_ = hc.SetSourceOnline(source2.URL())
+	select {
+	case snapshot := <-snapshotsCh:
+		t.Fatalf("unexpected notification [%+v]", snapshot)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestHttpClientPriority(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+	source.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Delay:      200 * time.Millisecond,
+	})
+
+	hc := httpclient.Create()
+	_ = hc.AddSourceWithOptions(source.URL(), httpclient.SourceOptions{
+		MaxConcurrent: 1,
+	})
+
+	served := make([]string, 0)
+	servedMtx := sync.Mutex{}
+	exec := func(name string, priority int) error {
+		return hc.NewRequest(context.Background(), "/test").
+			WaitForSlot().
+			Priority(priority).
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				servedMtx.Lock()
+				served = append(served, name)
+				servedMtx.Unlock()
+				return res.Err()
+			}).
+			Exec()
+	}
+
+	// Waiting requests with a higher priority are served first
+	wg := sync.WaitGroup{}
+	for idx, name := range []string{"busy", "low", "high"} {
+		wg.Add(1)
+		go func(name string, priority int) {
+			defer wg.Done()
+			_ = exec(name, priority)
+		}(name, idx)
+		time.Sleep(50 * time.Millisecond)
+	}
+	wg.Wait()
+	if strings.Join(served, ",") != "busy,high,low" {
+		t.Fatalf("unexpected order [%v]", served)
+	}
+
+	// Once the queue is full, lower priority requests are shed
+	if err := hc.SetSlotQueueLimit(1); err != nil {
+		t.Fatal(err.Error())
+	}
+	errs := make([]error, 3)
+	for idx, priority := range []int{0, 0, 5} {
+		wg.Add(1)
+		go func(idx int, priority int) {
+			defer wg.Done()
+			errs[idx] = exec("request", priority)
+		}(idx, priority)
+		time.Sleep(50 * time.Millisecond)
+	}
+	err := exec("rejected", 1)
+	if !errors.Is(err, httpclient.ErrOverloaded) {
+		t.Fatalf("expected an overloaded error [err=%v]", err)
+	}
+	wg.Wait()
+	if errs[0] != nil || !errors.Is(errs[1], httpclient.ErrOverloaded) || errs[2] != nil {
+		t.Fatalf("unexpected errors [%v]", errs)
+	}
+}
+
+func TestHttpClientMaxTotalConnections(t *testing.T) {
+	source1 := httpclienttest.NewFakeSource()
+	defer source1.Close()
+	source2 := httpclienttest.NewFakeSource()
+	defer source2.Close()
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(source1.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSource(source2.URL(), nil, loadbalancer.ServerOptions{})
+	if err := hc.SetMaxTotalConnections(1); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	exec := func(ctx context.Context) error {
+		return hc.NewRequest(ctx, "/test").
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+	}
+
+	// Idle connections are closed to make room
+	for idx := 0; idx < 4; idx++ {
+		if err := exec(context.Background()); err != nil {
+			t.Fatal(err.Error())
+		}
+		if n := hc.OpenConnections(); n != 1 {
+			t.Fatalf("unexpected open connections [%v]", n)
+		}
+	}
+	if source1.Hits() != 2 || source2.Hits() != 2 {
+		t.Fatalf("unexpected hits [%v/%v]", source1.Hits(), source2.Hits())
+	}
+
+	// New connections wait while the open one is in use
+	source1.Enqueue(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Delay:      300 * time.Millisecond,
+	})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- exec(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	err := exec(ctx)
+	cancelCtx()
+	if !errors.Is(err, httpclient.ErrTimeout) {
+		t.Fatalf("expected a timeout error [err=%v]", err)
+	}
+	if err = <-errCh; err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := hc.OpenConnections(); n > 1 {
+		t.Fatalf("unexpected open connections [%v]", n)
+	}
+}
+
+func TestHttpClientTLSCertificateError(t *testing.T) {
+	// The certificates of the test servers are not trusted by the client
+	servers := make([]*httptest.Server, 2)
+	hc := httpclient.Create()
+	for idx := range servers {
+		servers[idx] = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer servers[idx].Close()
+		_ = hc.AddSource(servers[idx].URL, nil, loadbalancer.ServerOptions{
+			MaxFails:    1,
+			FailTimeout: time.Minute,
+		})
+	}
+	tlsEvents := int32(0)
+	hc.SetEventHandler(func(eventType int, source int, err error) {
+		if eventType == httpclient.TLSErrorEvent {
+			atomic.AddInt32(&tlsEvents, 1)
+		}
+	})
+
+	// The error is returned right away even if the callback asks for a retry
+	details, err := hc.NewRequest(context.Background(), "/test").
+		RetryIfNotSent().
+		Callback(func(ctx context.Context, res httpclient.Response) error {
+			if err := res.Err(); err != nil {
+				res.RetryOnNextServer()
+				return err
+			}
+			return nil
+		}).
+		ExecDetailed()
+	if !errors.Is(err, httpclient.ErrTLSCertificate) {
+		t.Fatalf("expected a certificate error [err=%v]", err)
+	}
+	if details.Attempts != 1 || atomic.LoadInt32(&tlsEvents) != 1 {
+		t.Fatalf("unexpected attempts [%v] or events [%v]", details.Attempts, atomic.LoadInt32(&tlsEvents))
+	}
+
+	// The source is not marked as offline
+	for _, ss := range hc.StateSnapshot().Sources {
+		if ss.IsDown {
+			t.Fatalf("unexpected offline source [%v]", ss.BaseURL)
+		}
+	}
+}
+
+func TestHttpClientErrorPenalty(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	hc, err := httpclient.New(httpclient.WithErrorPenalty(httpclient.ErrorPenaltyOptions{
+		Penalty:   0.5,
+		Recovery:  0.5,
+		MinWeight: 10,
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{
+		Weight: 100,
+	})
+
+	exec := func(fail bool) {
+		_ = hc.NewRequest(context.Background(), "/test").
+			MaxAttempts(1).
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				if fail {
+					return errors.New("failed")
+				}
+				return res.Err()
+			}).
+			Exec()
+	}
+
+	// Each failure halves the weight until the minimum is reached
+	exec(true)
+	exec(true)
+	if weight := hc.StateSnapshot().Sources[0].Weight; weight != 25 {
+		t.Fatalf("unexpected weight after failures [weight=%v]", weight)
+	}
+	for idx := 0; idx < 5; idx++ {
+		exec(true)
+	}
+	if weight := hc.StateSnapshot().Sources[0].Weight; weight != 10 {
+		t.Fatalf("unexpected weight after more failures [weight=%v]", weight)
+	}
+
+	// Successes restore the weight gradually
+	exec(false)
+	if weight := hc.StateSnapshot().Sources[0].Weight; weight != 55 {
+		t.Fatalf("unexpected weight after a success [weight=%v]", weight)
+	}
+	for idx := 0; idx < 10; idx++ {
+		exec(false)
+	}
+	if weight := hc.StateSnapshot().Sources[0].Weight; weight != 100 {
+		t.Fatalf("unexpected weight after successes [weight=%v]", weight)
+	}
+
+	// Cannot be combined with adaptive weights
+	err = hc.SetAdaptiveWeights(httpclient.AdaptiveWeightOptions{
+		Rate:      1,
+		MinWeight: 1,
+		MaxWeight: 10,
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestHttpClientRoundTripperRetriesOtherSources(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+
+	// The refusing source has a higher weight, so the round-robin would pick it again on retries
+	hc := httpclient.Create()
+	_ = hc.AddSource("http://127.0.0.1:1", nil, loadbalancer.ServerOptions{
+		Weight: 3,
+	})
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{
+		Weight: 1,
+	})
+
+	client := http.Client{
+		Transport: hc.RoundTripper(),
+	}
+	for idx := 0; idx < 8; idx++ {
+		resp, err := client.Get("http://backend/test")
+		if err != nil {
+			t.Fatalf("request failed [idx=%v] [err=%v]", idx, err.Error())
+		}
+		_ = resp.Body.Close()
+	}
+	if source.Hits() != 8 {
+		t.Fatalf("unexpected hits [hits=%v]", source.Hits())
+	}
+}
+
+func TestHttpClientCacheKey(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+	source.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Cache-Control": []string{"max-age=60"},
+			"Vary":          []string{"accept"},
+		},
+		Body: []byte("cached"),
+	})
+
+	hc := httpclient.Create()
+	err := hc.EnableCache(10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+
+	exec := func(header http.Header) error {
+		return hc.NewRequest(context.Background(), "/test").
+			Headers(header).
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+	}
+
+	err = exec(http.Header{"Accept": []string{"application/json"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = exec(http.Header{
+		"Accept":        []string{"text/plain"},
+		"Authorization": []string{"Bearer token"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Only the response matching the varying headers and without credentials is served
+	_ = hc.SetSourceOfflineFor(source.URL(), time.Minute)
+	err = exec(http.Header{"Accept": []string{"application/json"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = exec(http.Header{"Accept": []string{"text/plain"}})
+	if !errors.Is(err, loadbalancer.ErrNoServersAvailable) {
+		t.Fatalf("expected no servers available [err=%v]", err)
+	}
+	err = exec(http.Header{
+		"Accept":        []string{"application/json"},
+		"Authorization": []string{"Bearer token"},
+	})
+	if !errors.Is(err, loadbalancer.ErrNoServersAvailable) {
+		t.Fatalf("expected no servers available [err=%v]", err)
+	}
+}
+
+func TestHttpClientShadowSourceLimits(t *testing.T) {
+	source := httpclienttest.NewFakeSource()
+	defer source.Close()
+	source.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Delay:      200 * time.Millisecond,
+	})
+	shadow := httpclienttest.NewFakeSource()
+	defer shadow.Close()
+	shadow.SetDefault(httpclienttest.FakeResponse{
+		StatusCode: http.StatusOK,
+		Delay:      time.Second,
+	})
+
+	hc := httpclient.Create()
+	_ = hc.AddSource(source.URL(), nil, loadbalancer.ServerOptions{})
+	_ = hc.AddSourceWithOptions(shadow.URL(), httpclient.SourceOptions{
+		IsShadow: true,
+	})
+
+	exec := func(url string) error {
+		return hc.NewRequest(context.Background(), url).
+			Coalesce(nil).
+			Callback(func(ctx context.Context, res httpclient.Response) error {
+				return res.Err()
+			}).
+			Exec()
+	}
+
+	// Coalesced requests send a single copy
+	wg := sync.WaitGroup{}
+	for idx := 0; idx < 5; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = exec("/hot")
+		}()
+		if idx == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+	time.Sleep(100 * time.Millisecond)
+	if shadow.Hits() != 1 {
+		t.Fatalf("unexpected shadow hits [hits=%v]", shadow.Hits())
+	}
+
+	// Copies exceeding the limit of the slow shadow source are dropped
+	for idx := 0; idx < 100; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			_ = exec(fmt.Sprintf("/test%v", idx))
+		}(idx)
+	}
+	wg.Wait()
+	time.Sleep(100 * time.Millisecond)
+	if hits := shadow.Hits(); hits > 65 {
+		t.Fatalf("unexpected shadow hits [hits=%v]", hits)
+	}
+}
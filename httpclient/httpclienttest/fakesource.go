@@ -0,0 +1,143 @@
+// Package httpclienttest provides utilities to test code that uses the load-balanced http client.
+package httpclienttest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// FakeSource is an in-process http server that replies with scripted responses.
+type FakeSource struct {
+	mtx        sync.Mutex
+	srv        *httptest.Server
+	script     []FakeResponse
+	defaultRes FakeResponse
+	requests   []*http.Request
+}
+
+// FakeResponse describes how a fake source replies to a request.
+type FakeResponse struct {
+	// StatusCode is the status code to return. Defaults to 200.
+	StatusCode int
+
+	// Header contains the headers to return.
+	Header http.Header
+
+	// Body is the body to return.
+	Body []byte
+
+	// Delay is the time to wait before replying.
+	Delay time.Duration
+
+	// Fail closes the connection without replying, causing a transport error on the client side.
+	Fail bool
+}
+
+// -----------------------------------------------------------------------------
+
+// NewFakeSource creates and starts a new fake source that replies with a 200 status code by default.
+func NewFakeSource() *FakeSource {
+	fs := &FakeSource{
+		script:   make([]FakeResponse, 0),
+		requests: make([]*http.Request, 0),
+	}
+	fs.srv = httptest.NewServer(http.HandlerFunc(fs.handler))
+	return fs
+}
+
+// URL returns the base url of the fake source.
+func (fs *FakeSource) URL() string {
+	return fs.srv.URL
+}
+
+// Close stops the fake source.
+func (fs *FakeSource) Close() {
+	fs.srv.Close()
+}
+
+// Enqueue adds responses to the script. Each request consumes the next scripted response and, once the script is
+// exhausted, the default response is used.
+func (fs *FakeSource) Enqueue(responses ...FakeResponse) {
+	fs.mtx.Lock()
+	fs.script = append(fs.script, responses...)
+	fs.mtx.Unlock()
+}
+
+// SetDefault sets the response to use when the script is exhausted.
+func (fs *FakeSource) SetDefault(res FakeResponse) {
+	fs.mtx.Lock()
+	fs.defaultRes = res
+	fs.mtx.Unlock()
+}
+
+// Hits returns the number of requests received.
+func (fs *FakeSource) Hits() int {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	return len(fs.requests)
+}
+
+// Requests returns a copy of the received requests. Bodies are not available.
+func (fs *FakeSource) Requests() []*http.Request {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	return append([]*http.Request(nil), fs.requests...)
+}
+
+// Reset clears the script and the received requests.
+func (fs *FakeSource) Reset() {
+	fs.mtx.Lock()
+	fs.script = fs.script[:0]
+	fs.requests = fs.requests[:0]
+	fs.mtx.Unlock()
+}
+
+// -----------------------------------------------------------------------------
+
+func (fs *FakeSource) handler(w http.ResponseWriter, r *http.Request) {
+	// Get the response to send and record the request
+	fs.mtx.Lock()
+	res := fs.defaultRes
+	if len(fs.script) > 0 {
+		res = fs.script[0]
+		fs.script = fs.script[1:]
+	}
+	fs.requests = append(fs.requests, r.Clone(r.Context()))
+	fs.mtx.Unlock()
+
+	if res.Delay > 0 {
+		select {
+		case <-time.After(res.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if res.Fail {
+		hj, ok := w.(http.Hijacker)
+		if ok {
+			conn, _, err := hj.Hijack()
+			if err == nil {
+				_ = conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	for k, v := range res.Header {
+		w.Header()[k] = v
+	}
+	statusCode := res.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	w.WriteHeader(statusCode)
+	if len(res.Body) > 0 {
+		_, _ = w.Write(res.Body)
+	}
+}
@@ -0,0 +1,55 @@
+package httpclienttest
+
+import (
+	"sync"
+
+	"github.com/randlabs/go-loadbalancer/v2/httpclient"
+)
+
+// -----------------------------------------------------------------------------
+
+// SequenceSelector is a deterministic selector that picks the sources in the given order of IDs, starting again
+// when the sequence is exhausted.
+type SequenceSelector struct {
+	mtx    sync.Mutex
+	ids    []int
+	pos    int
+	picked []int
+}
+
+// -----------------------------------------------------------------------------
+
+// NewSequenceSelector creates a new selector that picks the sources with the given IDs in order.
+func NewSequenceSelector(ids ...int) *SequenceSelector {
+	return &SequenceSelector{
+		ids:    ids,
+		picked: make([]int, 0),
+	}
+}
+
+// Select implements the httpclient.Selector interface.
+func (s *SequenceSelector) Select(sources []*httpclient.Source) *httpclient.Source {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.ids) == 0 {
+		return nil
+	}
+	id := s.ids[s.pos]
+	s.pos = (s.pos + 1) % len(s.ids)
+
+	for _, src := range sources {
+		if src.ID() == id {
+			s.picked = append(s.picked, id)
+			return src
+		}
+	}
+	return nil
+}
+
+// Picked returns the IDs of the sources picked so far.
+func (s *SequenceSelector) Picked() []int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]int(nil), s.picked...)
+}
@@ -1,7 +1,15 @@
 package httpclient
 
 import (
+	"context"
 	"errors"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/randlabs/go-loadbalancer/v2"
 )
@@ -9,9 +17,22 @@ import (
 // -----------------------------------------------------------------------------
 
 var errServerDown = errors.New("server down")
+var errSourceNotFound = errors.New("source not found")
+var errHealthCheckDisabled = errors.New("health check not enabled")
 
 // -----------------------------------------------------------------------------
 
+func newDefaultTransport() *http.Transport {
+	// From: https://www.loginradius.com/blog/async/tune-the-go-http-client-for-high-performance/
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxConnsPerHost = 100
+	transport.IdleConnTimeout = 60 * time.Second
+	transport.MaxIdleConnsPerHost = 100
+	transport.ResponseHeaderTimeout = 5 * time.Second
+	return transport
+}
+
 func (c *HttpClient) balancerEventHandler(eventType int, srv *loadbalancer.Server) {
 	src := srv.UserData().(*Source)
 
@@ -19,25 +40,297 @@ func (c *HttpClient) balancerEventHandler(eventType int, srv *loadbalancer.Serve
 	switch eventType {
 	case loadbalancer.ServerUpEvent:
 		src.setOnlineStatus(true)
-		if c.eventHandler != nil {
-			c.eventHandler(ServerUpEvent, src.ID(), nil)
-		}
+		c.raiseEvent(ServerUpEvent, src.ID(), nil)
 
 	case loadbalancer.ServerDownEvent:
 		src.setOnlineStatus(false)
-		if c.eventHandler != nil {
-			c.eventHandler(ServerDownEvent, src.ID(), errServerDown)
-		}
+		c.raiseEvent(ServerDownEvent, src.ID(), errServerDown)
 	}
+	c.stateChanged()
 }
 
+// raiseRequestEvent updates the request counters of the source and raises the request event.
 func (c *HttpClient) raiseRequestEvent(srv *loadbalancer.Server, err error) {
-	if c.eventHandler != nil {
+	src := srv.UserData().(*Source)
+	atomic.AddInt64(&src.requests, 1)
+	if err != nil {
+		atomic.AddInt64(&src.failures, 1)
+	}
+
+	if err == nil {
+		c.raiseEvent(RequestSucceededEvent, src.ID(), nil)
+	} else {
+		c.raiseEvent(RequestFailedEvent, src.ID(), err)
+	}
+}
+
+func (c *HttpClient) setSourceLastError(src *Source, err error) {
+	if src.setLastError(err) {
+		c.raiseEvent(SourceErrorEvent, src.ID(), err)
+	}
+}
+
+// transportFor returns the transport to use for the requests sent to the source.
+func (c *HttpClient) transportFor(src *Source) *http.Transport {
+	if src.opts.ResponseHeaderTimeout == 0 {
+		return c.transport
+	}
+	src.transportOnce.Do(func() {
+		src.transport = c.transport.Clone()
+		if src.opts.ResponseHeaderTimeout > 0 {
+			src.transport.ResponseHeaderTimeout = src.opts.ResponseHeaderTimeout
+		} else {
+			src.transport.ResponseHeaderTimeout = 0
+		}
+	})
+	return src.transport
+}
+
+// drainBody reads the rest of the body, up to maxDrainBodySize bytes, and closes it. The transport only reuses the
+// connection if the body was read to the end, so larger bodies are discarded along with their connection.
+func drainBody(body io.ReadCloser) {
+	_, _ = io.CopyN(io.Discard, body, maxDrainBodySize)
+	_ = body.Close()
+}
+
+// normalizeBaseURL checks the base url and removes the trailing slash.
+func normalizeBaseURL(baseURL string) (string, error) {
+	match, _ := regexp.MatchString(`https?://([^:/?#]+)(:\d+)?/?$`, baseURL)
+	if !match {
+		return "", errors.New("missing base url")
+	}
+	return strings.TrimSuffix(baseURL, "/"), nil
+}
+
+func (c *HttpClient) sourceByURL(baseURL string) *Source {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	for _, src := range c.sourceList() {
+		if src.BaseURL() == baseURL {
+			return src
+		}
+	}
+	return nil
+}
+
+// sourceList returns the current source list. Sources are never removed, so the returned slice can be safely used
+// after the lock is released.
+func (c *HttpClient) sourceList() []*Source {
+	c.sourcesMtx.RLock()
+	sources := c.sources[:len(c.sources):len(c.sources)]
+	c.sourcesMtx.RUnlock()
+	return sources
+}
+
+func (c *HttpClient) shadowSourceList() []*Source {
+	c.sourcesMtx.RLock()
+	sources := c.shadowSources[:len(c.shadowSources):len(c.shadowSources)]
+	c.sourcesMtx.RUnlock()
+	return sources
+}
+
+func newSourceState(src *Source) *SourceState {
+	return &SourceState{
+		BaseURL:   src.BaseURL(),
+		IsOnline:  src.IsOnline(),
+		LastError: src.Err(),
+		IsBackup:  src.IsBackup(),
+	}
+}
+
+func (c *HttpClient) nextServer() (*loadbalancer.Server, error) {
+	return c.nextServerFor(requestIntentAny, nil)
+}
+
+// nextServerFor selects the next server taking into account the source role required by the request intent. The
+// excluded and draining sources are skipped.
+func (c *HttpClient) nextServerFor(intent int, excluded []*Source) (*loadbalancer.Server, error) {
+	return c.nextServerInZone(intent, excluded, "", nil)
+}
+
+// selectSource works like nextServerFor, without asking the external breakers, and, if the trace is not nil, records
+// the sources skipped and why.
+func (c *HttpClient) selectSource(intent int, excluded []*Source, trace *SelectionAttempt) (
+	*loadbalancer.Server, error,
+) {
+	if c.selector != nil {
+		sources := c.sourceList()
+		allowed := make([]*Source, 0, len(sources))
+		for _, src := range sources {
+			if reason := c.skipReason(src, excluded); len(reason) == 0 {
+				allowed = append(allowed, src)
+			} else {
+				trace.addSkipped(src, reason)
+			}
+		}
+		src := c.selector.Select(allowed)
+		if src == nil {
+			return nil, &loadbalancer.NoServersError{}
+		}
+		return src.srv, nil
+	}
+
+	// Skip the excluded, draining and busy sources, remembering if any was busy
+	busy := false
+	accept := func(srv *loadbalancer.Server) bool {
 		src := srv.UserData().(*Source)
+		reason := c.skipReason(src, excluded)
+		if len(reason) == 0 {
+			return true
+		}
+		if reason == SkipReasonBusy {
+			busy = true
+		}
+		trace.addSkipped(src, reason)
+		return false
+	}
+
+	// On traffic split mode, send the share of each source to it and the remainder to the rest of sources. If the
+	// chosen source or the rest are not available, use any of them.
+	if split := c.loadTrafficSplit(); split != nil {
+		target := split.next()
+
+		srv, err := c.selectServer(intent, func(srv *loadbalancer.Server) bool {
+			src := srv.UserData().(*Source)
+			if target != nil {
+				return src == target && accept(srv)
+			}
+			return !split.has(src) && accept(srv)
+		})
 		if err == nil {
-			c.eventHandler(RequestSucceededEvent, src.ID(), nil)
-		} else {
-			c.eventHandler(RequestFailedEvent, src.ID(), err)
+			return srv, nil
+		}
+	}
+
+	var srv *loadbalancer.Server
+	var err error
+	if c.fillFirst {
+		srv, err = c.selectFillFirst(intent, accept)
+	} else {
+		srv, err = c.selectServer(intent, accept)
+	}
+	if err != nil && busy {
+		err = ErrOverloaded
+	}
+	return srv, err
+}
+
+// selectServer selects the next server accepted by the filter taking into account the source role required by the
+// request intent. The given preferences are tried in order before the intent one.
+func (c *HttpClient) selectServer(intent int, accept loadbalancer.SelectFilter,
+	prefer ...loadbalancer.SelectFilter) (*loadbalancer.Server, error) {
+	criteria := loadbalancer.SelectCriteria{
+		Filter: accept,
+		Prefer: prefer,
+	}
+	switch intent {
+	case requestIntentRead:
+		// Prefer read-only sources but fall back to the others if none is available
+		criteria.Prefer = append(criteria.Prefer, isReadOnlySource)
+
+	case requestIntentWrite:
+		// Never use read-only sources
+		criteria.Filter = func(srv *loadbalancer.Server) bool {
+			return isWritableSource(srv) && accept(srv)
+		}
+	}
+
+	srv, err := c.lb.NextForRequest(criteria)
+	if intent == requestIntentWrite && errors.Is(err, loadbalancer.ErrAllVetoed) {
+		err = &loadbalancer.NoServersError{}
+	}
+	return srv, err
+}
+
+// skipReason returns why the source cannot be selected or an empty string if it can.
+func (c *HttpClient) skipReason(src *Source, excluded []*Source) string {
+	switch {
+	case isExcludedSource(src, excluded):
+		return SkipReasonExcluded
+	case !c.isInActiveGroup(src):
+		return SkipReasonInactiveGroup
+	case src.isDraining():
+		return SkipReasonDraining
+	case src.isBusy():
+		return SkipReasonBusy
+	}
+	return ""
+}
+
+func isExcludedSource(src *Source, excluded []*Source) bool {
+	for _, ex := range excluded {
+		if ex == src {
+			return true
+		}
+	}
+	return false
+}
+
+func isReadOnlySource(srv *loadbalancer.Server) bool {
+	return srv.UserData().(*Source).opts.ReadOnly
+}
+
+func isWritableSource(srv *loadbalancer.Server) bool {
+	return !srv.UserData().(*Source).opts.ReadOnly
+}
+
+func isOwnError(err error) bool {
+	var e *Error
+	return errors.As(err, &e)
+}
+
+// isIsolatedDNSFailure records a DNS failure of the source and returns true if it only affects this source, that is,
+// a source responded within the window after the failures of this one started and no other source failed to resolve
+// within the window.
+func (c *HttpClient) isIsolatedDNSFailure(src *Source) bool {
+	now := time.Now().UnixNano()
+	atomic.CompareAndSwapInt64(&src.dnsFailingSince, 0, now)
+	atomic.StoreInt64(&src.dnsLastFailure, now)
+
+	window := int64(c.dnsFailureWindow)
+	ts := atomic.LoadInt64(&c.lastReachableTimestamp)
+	if ts == 0 || ts <= atomic.LoadInt64(&src.dnsFailingSince) || now-ts >= window {
+		return false
+	}
+	for _, other := range c.sourceList() {
+		if other != src {
+			if last := atomic.LoadInt64(&other.dnsLastFailure); last != 0 && now-last < window {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// resetDNSFailures ends the current streak of DNS failures of the source.
+func (src *Source) resetDNSFailures() {
+	atomic.StoreInt64(&src.dnsFailingSince, 0)
+	atomic.StoreInt64(&src.dnsLastFailure, 0)
+}
+
+// isRequestNotSent returns true if the transport error happened while establishing the connection, before any data
+// was written.
+func isRequestNotSent(ctx context.Context, err error) bool {
+	var opErr *net.OpError
+	return (errors.As(err, &opErr) && opErr.Op == "dial") || isProxyConnectError(ctx, err)
+}
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// mergeHeader replaces the values of the keys in dest with the ones in src.
+func mergeHeader(dest http.Header, src http.Header) {
+	for k, v := range src {
+		vLen := len(v)
+		if vLen > 0 {
+			dest.Set(k, v[0])
+			for vIdx := 1; vIdx < vLen; vIdx++ {
+				dest.Add(k, v[vIdx])
+			}
 		}
 	}
 }
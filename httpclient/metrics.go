@@ -0,0 +1,156 @@
+package httpclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// MetricsContentType is the content type of the output of WriteMetrics.
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metricDesc struct {
+	name       string
+	metricType string
+	help       string
+	value      func(ss *SourceSnapshot) int64
+}
+
+// -----------------------------------------------------------------------------
+
+var sourceMetrics = []metricDesc{
+	{
+		name:       "loadbalancer_source_up",
+		metricType: "gauge",
+		help:       "Whether the source is online.",
+		value: func(ss *SourceSnapshot) int64 {
+			return boolToInt64(!(ss.IsDown || ss.IsProbing))
+		},
+	},
+	{
+		name:       "loadbalancer_source_in_flight",
+		metricType: "gauge",
+		help:       "Number of requests currently being executed against the source.",
+		value: func(ss *SourceSnapshot) int64 {
+			return int64(ss.InFlight)
+		},
+	},
+	{
+		name:       "loadbalancer_source_requests_total",
+		metricType: "counter",
+		help:       "Number of requests sent to the source.",
+		value: func(ss *SourceSnapshot) int64 {
+			return ss.Requests
+		},
+	},
+	{
+		name:       "loadbalancer_source_failures_total",
+		metricType: "counter",
+		help:       "Number of requests sent to the source that failed.",
+		value: func(ss *SourceSnapshot) int64 {
+			return ss.Failures
+		},
+	},
+	{
+		name:       "loadbalancer_source_retries_total",
+		metricType: "counter",
+		help:       "Number of retries sent to the source.",
+		value: func(ss *SourceSnapshot) int64 {
+			return ss.Retries
+		},
+	},
+	{
+		name:       "loadbalancer_source_open_connections",
+		metricType: "gauge",
+		help:       "Number of connections open to the source.",
+		value: func(ss *SourceSnapshot) int64 {
+			return int64(ss.OpenConns)
+		},
+	},
+	{
+		name:       "loadbalancer_source_new_connections_total",
+		metricType: "counter",
+		help:       "Number of requests sent to the source using a new connection.",
+		value: func(ss *SourceSnapshot) int64 {
+			return ss.NewConns
+		},
+	},
+	{
+		name:       "loadbalancer_source_reused_connections_total",
+		metricType: "counter",
+		help:       "Number of requests sent to the source reusing a connection.",
+		value: func(ss *SourceSnapshot) int64 {
+			return ss.ReusedConns
+		},
+	},
+}
+
+var sourceStates = []string{"online", "offline", "probing"}
+
+// -----------------------------------------------------------------------------
+
+// WriteMetrics writes the metrics of all the sources in the Prometheus text exposition format. Each sample is labeled
+// with the source id, base url and role. The loadbalancer_source_state gauge has an additional state label and is 1
+// for the current state of the source.
+func (c *HttpClient) WriteMetrics(w io.Writer) error {
+	snapshot := c.StateSnapshot()
+
+	buf := bytes.Buffer{}
+	for _, desc := range sourceMetrics {
+		writeMetricHeader(&buf, desc.name, desc.metricType, desc.help)
+		for idx := range snapshot.Sources {
+			ss := &snapshot.Sources[idx]
+			fmt.Fprintf(&buf, "%s{%s} %d\n", desc.name, sourceLabels(ss), desc.value(ss))
+		}
+	}
+
+	writeMetricHeader(&buf, "loadbalancer_source_state", "gauge", "State of the source.")
+	for idx := range snapshot.Sources {
+		ss := &snapshot.Sources[idx]
+
+		currentState := "online"
+		if ss.IsProbing {
+			currentState = "probing"
+		} else if ss.IsDown {
+			currentState = "offline"
+		}
+		for _, state := range sourceStates {
+			fmt.Fprintf(&buf, "loadbalancer_source_state{%s,state=\"%s\"} %d\n", sourceLabels(ss), state,
+				boolToInt64(state == currentState))
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// -----------------------------------------------------------------------------
+
+func writeMetricHeader(buf *bytes.Buffer, name string, metricType string, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func sourceLabels(ss *SourceSnapshot) string {
+	role := "primary"
+	if ss.IsBackup {
+		role = "backup"
+	}
+	return "id=\"" + strconv.Itoa(ss.ID) + "\",source=\"" + escapeLabelValue(ss.BaseURL) + "\",role=\"" + role + "\""
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func boolToInt64(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
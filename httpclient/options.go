@@ -0,0 +1,250 @@
+package httpclient
+
+import (
+	"net/http"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// Option sets a configuration setting of a client created with New.
+type Option func(cfg *config)
+
+type config struct {
+	transport      *http.Transport
+	dialPreference int
+	eventHandler   EventHandler
+	eventDelivery  int
+	minPrimary     int
+	stickyPrimary  bool
+
+	backupHysteresis *backupHysteresis
+
+	dnsFailureWindow *time.Duration
+	defaultHeader    http.Header
+	userAgent        string
+	dialContext      DialContextFunc
+	warmup           bool
+	ignoreWeights    bool
+	fillFirst        bool
+	healthCheck      *HealthCheckOptions
+	selector         Selector
+	errorRate        *ErrorRateOptions
+	fallback         FallbackHandler
+	connStats        bool
+
+	requestIDHeader    string
+	requestIDGenerator func() string
+	defaultSourceOpts  *SourceOptions
+	breakerFactory     BreakerFactory
+	statusErrorPolicy  StatusErrorPolicy
+	maxConnAge         time.Duration
+	retryStaleConns    bool
+	adaptive           *AdaptiveWeightOptions
+	errorPenalty       *ErrorPenaltyOptions
+}
+
+type backupHysteresis struct {
+	margin int
+	hold   time.Duration
+}
+
+// -----------------------------------------------------------------------------
+
+// WithTransport sets the transport to use. The transport is cloned.
+func WithTransport(transport *http.Transport) Option {
+	return func(cfg *config) {
+		cfg.transport = transport
+	}
+}
+
+// WithDialPreference sets the IP address family preference. See SetDialPreference for details.
+func WithDialPreference(pref int) Option {
+	return func(cfg *config) {
+		cfg.dialPreference = pref
+	}
+}
+
+// WithEventHandler sets the notification handler callback.
+func WithEventHandler(handler EventHandler) Option {
+	return func(cfg *config) {
+		cfg.eventHandler = handler
+	}
+}
+
+// WithEventDelivery sets how the events are delivered to the event handler. See SetEventDelivery for details.
+func WithEventDelivery(mode int) Option {
+	return func(cfg *config) {
+		cfg.eventDelivery = mode
+	}
+}
+
+// WithMinPrimary sets the minimum amount of online primary sources below which backup sources are also used.
+func WithMinPrimary(minPrimary int) Option {
+	return func(cfg *config) {
+		cfg.minPrimary = minPrimary
+	}
+}
+
+// WithStickyPrimary enables the sticky mode. See SetStickyPrimary for details.
+func WithStickyPrimary() Option {
+	return func(cfg *config) {
+		cfg.stickyPrimary = true
+	}
+}
+
+// WithDNSFailureWindow sets the DNS failure window. See SetDNSFailureWindow for details.
+func WithDNSFailureWindow(window time.Duration) Option {
+	return func(cfg *config) {
+		cfg.dnsFailureWindow = &window
+	}
+}
+
+// WithDefaultHeaders sets the headers to add to the requests sent to all the sources.
+func WithDefaultHeaders(header http.Header) Option {
+	return func(cfg *config) {
+		cfg.defaultHeader = header
+	}
+}
+
+// WithUserAgent sets the default User-Agent header sent to all the sources.
+func WithUserAgent(userAgent string) Option {
+	return func(cfg *config) {
+		cfg.userAgent = userAgent
+	}
+}
+
+// WithDialContext sets the function used to establish the connections to the sources. See SetDialContext for details.
+func WithDialContext(dialContext DialContextFunc) Option {
+	return func(cfg *config) {
+		cfg.dialContext = dialContext
+	}
+}
+
+// WithWarmup enables the warmup mode. See SetWarmup for details.
+func WithWarmup() Option {
+	return func(cfg *config) {
+		cfg.warmup = true
+	}
+}
+
+// WithHealthCheck enables the active health check. See EnableHealthCheck for details.
+func WithHealthCheck(opts HealthCheckOptions) Option {
+	return func(cfg *config) {
+		cfg.healthCheck = &opts
+	}
+}
+
+// WithBackupHysteresis sets the hysteresis applied to stop using the backup sources. See SetBackupHysteresis for
+// details.
+func WithBackupHysteresis(margin int, hold time.Duration) Option {
+	return func(cfg *config) {
+		cfg.backupHysteresis = &backupHysteresis{
+			margin: margin,
+			hold:   hold,
+		}
+	}
+}
+
+// WithSelector sets a custom source selector. See SetSelector for details.
+func WithSelector(selector Selector) Option {
+	return func(cfg *config) {
+		cfg.selector = selector
+	}
+}
+
+// WithErrorRateThreshold enables the degraded and recovered events. See SetErrorRateThreshold for details.
+func WithErrorRateThreshold(opts ErrorRateOptions) Option {
+	return func(cfg *config) {
+		cfg.errorRate = &opts
+	}
+}
+
+// WithIgnoreWeights makes all eligible sources receive the same amount of requests regardless of their weights.
+func WithIgnoreWeights() Option {
+	return func(cfg *config) {
+		cfg.ignoreWeights = true
+	}
+}
+
+// WithFillFirst fills the sources up to their capacity in weight order. See SetFillFirst for details.
+func WithFillFirst() Option {
+	return func(cfg *config) {
+		cfg.fillFirst = true
+	}
+}
+
+// WithFallback sets a handler to call when no source is available or all the sources attempted by a request failed.
+// See SetFallback for details.
+func WithFallback(handler FallbackHandler) Option {
+	return func(cfg *config) {
+		cfg.fallback = handler
+	}
+}
+
+// WithConnStats enables tracking the connection reuse of each source. See SetConnStats for details.
+func WithConnStats() Option {
+	return func(cfg *config) {
+		cfg.connStats = true
+	}
+}
+
+// WithRequestIDHeader sends a request ID in the given header. See SetRequestIDHeader for details.
+func WithRequestIDHeader(name string, generator func() string) Option {
+	return func(cfg *config) {
+		cfg.requestIDHeader = name
+		cfg.requestIDGenerator = generator
+	}
+}
+
+// WithDefaultSourceOptions sets the options used as the base of all the sources. See SetDefaultSourceOptions for
+// details.
+func WithDefaultSourceOptions(opts SourceOptions) Option {
+	return func(cfg *config) {
+		cfg.defaultSourceOpts = &opts
+	}
+}
+
+// WithBreakerFactory sets the function that creates a breaker for each source. See SetBreakerFactory for details.
+func WithBreakerFactory(factory BreakerFactory) Option {
+	return func(cfg *config) {
+		cfg.breakerFactory = factory
+	}
+}
+
+// WithStatusErrorPolicy sets how the error responses detected by the client are handled. See SetStatusErrorPolicy for
+// details.
+func WithStatusErrorPolicy(policy StatusErrorPolicy) Option {
+	return func(cfg *config) {
+		cfg.statusErrorPolicy = policy
+	}
+}
+
+// WithMaxConnAge limits the lifetime of the connections to the sources. See SetMaxConnAge for details.
+func WithMaxConnAge(maxAge time.Duration) Option {
+	return func(cfg *config) {
+		cfg.maxConnAge = maxAge
+	}
+}
+
+// WithAdaptiveWeights enables adjusting the weights of the sources. See SetAdaptiveWeights for details.
+func WithAdaptiveWeights(opts AdaptiveWeightOptions) Option {
+	return func(cfg *config) {
+		cfg.adaptive = &opts
+	}
+}
+
+// WithErrorPenalty enables reducing the weights of the sources on errors. See SetErrorPenalty for details.
+func WithErrorPenalty(opts ErrorPenaltyOptions) Option {
+	return func(cfg *config) {
+		cfg.errorPenalty = &opts
+	}
+}
+
+// WithRetryStaleConns enables retrying the requests that fail on a stale connection. See SetRetryStaleConns for
+// details.
+func WithRetryStaleConns() Option {
+	return func(cfg *config) {
+		cfg.retryStaleConns = true
+	}
+}
@@ -0,0 +1,99 @@
+package httpclient
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+// ErrorPenaltyOptions specifies how the weights of the sources are reduced on errors and restored on successes.
+type ErrorPenaltyOptions struct {
+	// Penalty is the fraction of the current weight removed on each failed request, between 0 and 1.
+	Penalty float64
+
+	// Recovery is the fraction of the removed weight restored on each successful request, between 0 and 1.
+	Recovery float64
+
+	// MinWeight is the lowest weight a source can be reduced to. Defaults to 1.
+	MinWeight int
+}
+
+type penaltyTracker struct {
+	mtx    sync.Mutex
+	factor float64
+}
+
+// -----------------------------------------------------------------------------
+
+// SetErrorPenalty enables reducing the weight of a source on each failed request and restoring it on each successful
+// one, so traffic moves away gradually from a degrading source before its breaker puts it offline. The weight changes
+// continuously between the weight the source was added with and MinWeight, so the added weights must be large enough,
+// for e.g. 100, for the changes to be gradual. It cannot be combined with adaptive weights. Passing a zero penalty
+// disables it and restores the weights. It must be called before executing requests.
+func (c *HttpClient) SetErrorPenalty(opts ErrorPenaltyOptions) error {
+	if opts.Penalty == 0 {
+		c.errorPenalty = ErrorPenaltyOptions{}
+		for _, src := range c.sourceList() {
+			src.penalty.mtx.Lock()
+			src.penalty.factor = 0
+			src.penalty.mtx.Unlock()
+			_ = src.srv.SetWeight(src.baseWeight())
+		}
+		return nil
+	}
+	if opts.Penalty < 0 || opts.Penalty > 1 || opts.Recovery < 0 || opts.Recovery > 1 || opts.MinWeight < 0 ||
+		c.adaptive.Rate != 0 {
+		return errors.New("invalid parameter")
+	}
+	if opts.MinWeight == 0 {
+		opts.MinWeight = 1
+	}
+	c.errorPenalty = opts
+
+	// Done
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// trackErrorPenalty reduces or restores the weight of the source based on the result of a request.
+func (c *HttpClient) trackErrorPenalty(src *Source, failed bool) {
+	opts := c.errorPenalty
+	if opts.Penalty == 0 {
+		return
+	}
+
+	// The factor is the fraction of the base weight in effect
+	t := &src.penalty
+	t.mtx.Lock()
+	if t.factor == 0 {
+		t.factor = 1
+	}
+	if failed {
+		t.factor -= opts.Penalty * t.factor
+	} else {
+		t.factor += opts.Recovery * (1 - t.factor)
+	}
+	baseWeight := src.baseWeight()
+	if minFactor := float64(opts.MinWeight) / float64(baseWeight); t.factor < minFactor {
+		// Do not accumulate penalties below the minimum weight, so the recovery is not delayed
+		t.factor = math.Min(minFactor, 1)
+	}
+	weight := int(math.Round(float64(baseWeight) * t.factor))
+	t.mtx.Unlock()
+
+	if weight != src.srv.Weight() {
+		_ = src.srv.SetWeight(weight)
+		c.stateChanged()
+	}
+}
+
+// baseWeight returns the weight the source was added with.
+func (src *Source) baseWeight() int {
+	if src.opts.Weight == 0 {
+		return 1
+	}
+	return src.opts.Weight
+}
@@ -0,0 +1,112 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync/atomic"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	errProxyConnectFailed = "failed to connect through the source proxy"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	tunnelNone int32 = iota
+	tunnelConnecting
+	tunnelEstablished
+)
+
+// -----------------------------------------------------------------------------
+
+type sourceContextKey struct{}
+
+type sourceContext struct {
+	src    *Source
+	tunnel int32
+}
+
+// -----------------------------------------------------------------------------
+
+// withSource returns a copy of the context that carries the source the request is sent to. It also tracks whether a
+// proxy tunnel was being established so a failed CONNECT can be told apart from a source failure.
+func withSource(ctx context.Context, src *Source) context.Context {
+	sc := &sourceContext{
+		src: src,
+	}
+	ctx = context.WithValue(ctx, sourceContextKey{}, sc)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: sc.tunnelUp,
+		GotConn: func(_ httptrace.GotConnInfo) {
+			sc.tunnelUp()
+		},
+	})
+}
+
+func sourceFromContext(ctx context.Context) *Source {
+	if sc := sourceContextFrom(ctx); sc != nil {
+		return sc.src
+	}
+	return nil
+}
+
+func sourceContextFrom(ctx context.Context) *sourceContext {
+	sc, _ := ctx.Value(sourceContextKey{}).(*sourceContext)
+	return sc
+}
+
+func (sc *sourceContext) tunnelUp() {
+	atomic.CompareAndSwapInt32(&sc.tunnel, tunnelConnecting, tunnelEstablished)
+}
+
+// setupSourceProxy makes the transport honor the proxy settings of each source. Requests sent to sources without a
+// proxy use the original transport settings.
+func setupSourceProxy(transport *http.Transport) {
+	baseProxy := transport.Proxy
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		src := sourceFromContext(req.Context())
+		if src != nil && src.opts.Proxy != nil {
+			return src.opts.Proxy, nil
+		}
+		if baseProxy != nil {
+			return baseProxy(req)
+		}
+		return nil, nil
+	}
+
+	baseGetProxyConnectHeader := transport.GetProxyConnectHeader
+	transport.GetProxyConnectHeader = func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error) {
+		// The transport is about to send the CONNECT request
+		sc := sourceContextFrom(ctx)
+		if sc != nil {
+			atomic.StoreInt32(&sc.tunnel, tunnelConnecting)
+			if sc.src.opts.Proxy != nil {
+				return sc.src.opts.ProxyHeader.Clone(), nil
+			}
+		}
+		if baseGetProxyConnectHeader != nil {
+			return baseGetProxyConnectHeader(ctx, proxyURL, target)
+		}
+		return transport.ProxyConnectHeader, nil
+	}
+}
+
+// isProxyConnectError returns true if the transport error happened while connecting to the proxy or establishing
+// the tunnel, so the source itself is not to blame. The context must be the one the request was sent with.
+func isProxyConnectError(ctx context.Context, err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "proxyconnect" {
+		return true
+	}
+
+	// The transport reports a rejected CONNECT with a plain error, so check if the tunnel was never established
+	sc := sourceContextFrom(ctx)
+	return sc != nil && atomic.LoadInt32(&sc.tunnel) == tunnelConnecting
+}
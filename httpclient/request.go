@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -15,6 +16,12 @@ const (
 	defaultTimeout = 20 * time.Second
 )
 
+const (
+	requestIntentAny int = iota
+	requestIntentRead
+	requestIntentWrite
+)
+
 // -----------------------------------------------------------------------------
 
 // Request represents a load-balanced http client request object.
@@ -27,6 +34,51 @@ type Request struct {
 	timeout time.Duration
 	callback ExecCallback
 	client  *HttpClient
+
+	retryIfNotSent bool
+	captureTimings bool
+	timings        []RequestTimings
+	intent         int
+	excludeSources []string
+	maxAttempts    int
+	retryIf        func(err error) bool
+	pinned         *Source
+	requestID      string
+	waitForSlot    bool
+	traceSelection bool
+	selectionTrace []SelectionAttempt
+
+	coalesce        bool
+	coalesceKeyFunc CoalesceKeyFunc
+	details         *ExecDetails
+	zoneAffinity    bool
+	priority        int
+}
+
+// ExecResult contains the result of sending a request to one of the sources with ExecN.
+type ExecResult struct {
+	// SourceID is the identifier of the source.
+	SourceID int
+	// BaseURL is the base url of the source.
+	BaseURL string
+	// Err is the error returned by the callback.
+	Err error
+}
+
+// ExecDetails contains the outcome of a request executed with ExecDetailed.
+type ExecDetails struct {
+	// SourceID is the identifier of the source of the last attempt or zero if no source was attempted.
+	SourceID int
+	// BaseURL is the base url of the source of the last attempt.
+	BaseURL string
+	// RequestID is the request identifier sent to the sources, if enabled.
+	RequestID string
+	// Attempts is the amount of attempts sent to the sources, including the retries.
+	Attempts int
+	// AttemptErrors contains the error of each attempt in order, nil if it succeeded.
+	AttemptErrors []error
+	// Elapsed is the total time spent executing the request.
+	Elapsed time.Duration
 }
 
 // -----------------------------------------------------------------------------
@@ -74,7 +126,9 @@ func (req *Request) BodyBytes(body []byte) *Request {
 	return req
 }
 
-// Timeout sets the request timeout
+// Timeout sets the timeout of each attempt. The effective deadline of an attempt is the earliest between this timeout
+// and the context deadline. If it expires, ErrTimeout is returned. The transport timeouts, like the response header
+// one, still apply and, if they are hit first, the returned error also matches ErrTransportTimeout.
 func (req *Request) Timeout(timeout time.Duration) *Request {
 	req.timeout = timeout
 	return req
@@ -86,8 +140,212 @@ func (req *Request) Callback(cb ExecCallback) *Request {
 	return req
 }
 
+// RetryIfNotSent enables retrying the request on the next server, without calling the callback, if it failed before
+// any data was written to the source, for e.g. the connection was refused. It is safe to use with non-idempotent
+// requests. Each request is retried at most once per source.
+func (req *Request) RetryIfNotSent() *Request {
+	req.retryIfNotSent = true
+	return req
+}
+
+// MaxAttempts limits the total number of attempts, including the first one, the silent retries and the ones requested
+// by the callback. Once reached, no more retries are done and the result of the last attempt is returned. Zero means no
+// limit.
+func (req *Request) MaxAttempts(attempts int) *Request {
+	if attempts < 0 {
+		attempts = 0
+	}
+	req.maxAttempts = attempts
+	return req
+}
+
+// RetryIf sets a predicate to decide which transport errors, for e.g. a connection reset, are silently retried on the
+// next server without calling the callback. It only governs retries, whether the source is marked as failed still
+// depends on the error type. Unlike RetryIfNotSent, the request may have reached the source, so it should only be used
+// with idempotent requests.
+func (req *Request) RetryIf(retryable func(err error) bool) *Request {
+	req.retryIf = retryable
+	return req
+}
+
+// RetryOnErrors works like RetryIf retrying the transport errors that match any of the targets using errors.Is.
+func (req *Request) RetryOnErrors(targets ...error) *Request {
+	return req.RetryIf(func(err error) bool {
+		for _, target := range targets {
+			if errors.Is(err, target) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ForRead indicates the request only reads data, so it is sent preferably to read-only sources. If none of them is
+// available, the request is sent to the other sources.
+func (req *Request) ForRead() *Request {
+	req.intent = requestIntentRead
+	return req
+}
+
+// ForWrite indicates the request modifies data, so it is never sent to read-only sources.
+func (req *Request) ForWrite() *Request {
+	req.intent = requestIntentWrite
+	return req
+}
+
+// ExcludeSources prevents the request from being sent to the sources with the given base urls. Unknown urls are
+// ignored. Regardless of this setting, retries are only sent to sources not attempted yet. Once all of them were
+// attempted, the error of the last attempt is returned.
+func (req *Request) ExcludeSources(baseURLs ...string) *Request {
+	req.excludeSources = append(req.excludeSources, baseURLs...)
+	return req
+}
+
+// WaitForSlot makes the request wait, up to the context deadline, for a source to have a free slot when all the
+// available ones are busy because of their MaxConcurrent limit, instead of failing with ErrOverloaded. Waiting
+// requests are served in arrival order. If the context expires first, ErrTimeout or ErrCanceled is returned.
+func (req *Request) WaitForSlot() *Request {
+	req.waitForSlot = true
+	return req
+}
+
+// Priority sets the priority of the request when waiting for a slot (see WaitForSlot). Waiting requests with a higher
+// priority are served first and, if the client has a slot queue limit, they can shed queued requests with a lower
+// priority. Requests with the same priority are served in arrival order. The default priority is zero.
+func (req *Request) Priority(priority int) *Request {
+	req.priority = priority
+	return req
+}
+
+// CaptureTimings enables capturing the timing breakdown of each attempt. Timings are available in the callback through
+// the response and, once executed, through the Timings method. It is disabled by default due to its overhead.
+func (req *Request) CaptureTimings() *Request {
+	req.captureTimings = true
+	return req
+}
+
+// Timings returns the timing breakdown of each executed attempt if CaptureTimings was called.
+func (req *Request) Timings() []RequestTimings {
+	return req.timings
+}
+
 // Exec runs the http client request
 func (req *Request) Exec() error {
+	err := req.validate()
+	if err != nil {
+		return err
+	}
+	req.requestID = req.client.newRequestID(req.headers)
+	return req.client.exec(req)
+}
+
+// ExecDetailed works like Exec and also returns the source that served the request, the attempts done and the total
+// time spent, for post-hoc inspection without event handlers. The response is still processed by the callback, which
+// owns its body until it returns, as with Exec.
+func (req *Request) ExecDetailed() (ExecDetails, error) {
+	err := req.validate()
+	if err != nil {
+		return ExecDetails{}, err
+	}
+	req.requestID = req.client.newRequestID(req.headers)
+	req.details = &ExecDetails{
+		RequestID: req.requestID,
+	}
+
+	startTime := time.Now()
+	err = req.client.exec(req)
+	details := *req.details
+	details.Elapsed = time.Since(startTime)
+	req.details = nil
+
+	// Done
+	return details, err
+}
+
+// ExecN sends the request to n distinct sources concurrently, for e.g. for quorum reads or to compare the responses
+// of two backends, and returns the result of each one in the order the sources were selected. If less than n sources
+// are available, the request is only sent to the available ones. The callback is called concurrently, once per
+// source, and each attempt is never retried. Requests are not mirrored to the shadow sources.
+//
+// If the request context expires before all the sources respond, the results received so far are returned right
+// away and the ones still in flight have ErrPending as error. Their requests are canceled by the context, but a
+// callback already running is not waited for.
+func (req *Request) ExecN(n int) ([]ExecResult, error) {
+	err := req.validate()
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, errors.New("invalid parameter")
+	}
+	c := req.client
+	req.requestID = c.newRequestID(req.headers)
+
+	// Select the sources
+	selected := make([]*Source, 0, n)
+	for _, baseURL := range req.excludeSources {
+		if src := c.sourceByURL(baseURL); src != nil {
+			selected = append(selected, src)
+		}
+	}
+	excludedCount := len(selected)
+	for len(selected)-excludedCount < n {
+		srv, err := c.nextServerFor(req.intent, selected)
+		if err != nil {
+			if len(selected) == excludedCount {
+				return nil, c.newError(err, errNoAvailableServer, req.url, 0)
+			}
+			break
+		}
+		selected = append(selected, srv.UserData().(*Source))
+	}
+	selected = selected[excludedCount:]
+
+	// Send a copy of the request to each one
+	results := make([]ExecResult, len(selected))
+	pending := len(selected)
+	resultsMtx := sync.Mutex{}
+	doneCh := make(chan struct{})
+	for idx, src := range selected {
+		pinnedReq := *req
+		pinnedReq.pinned = src
+		pinnedReq.maxAttempts = 1
+
+		results[idx].SourceID = src.ID()
+		results[idx].BaseURL = src.BaseURL()
+		results[idx].Err = ErrPending
+
+		go func(pinnedReq *Request, idx int) {
+			err := c.exec(pinnedReq)
+
+			resultsMtx.Lock()
+			results[idx].Err = err
+			pending -= 1
+			if pending == 0 {
+				close(doneCh)
+			}
+			resultsMtx.Unlock()
+		}(&pinnedReq, idx)
+	}
+
+	// Wait for all the results or return the ones already in if the context expires first
+	select {
+	case <-doneCh:
+	case <-req.ctx.Done():
+	}
+
+	resultsMtx.Lock()
+	partial := make([]ExecResult, len(results))
+	copy(partial, results)
+	resultsMtx.Unlock()
+
+	// Done
+	return partial, nil
+}
+
+// -----------------------------------------------------------------------------
+
+func (req *Request) validate() error {
 	if len(req.method) == 0 {
 		return errors.New("invalid method")
 	}
@@ -100,5 +358,24 @@ func (req *Request) Exec() error {
 	if req.callback == nil {
 		return errors.New("invalid callback")
 	}
-	return req.client.exec(req)
+	return nil
+}
+
+// canRetry returns true if another attempt is allowed after the given number of retries.
+func (req *Request) canRetry(retries int) bool {
+	return req.maxAttempts == 0 || retries+1 < req.maxAttempts
+}
+
+// setAttemptResult records the result of the last attempt in the selection trace and the details if enabled. The
+// source is nil if no source was available.
+func (req *Request) setAttemptResult(src *Source, err error) {
+	if len(req.selectionTrace) > 0 {
+		req.selectionTrace[len(req.selectionTrace)-1].Err = err
+	}
+	if req.details != nil && src != nil {
+		req.details.SourceID = src.ID()
+		req.details.BaseURL = src.BaseURL()
+		req.details.Attempts += 1
+		req.details.AttemptErrors = append(req.details.AttemptErrors, err)
+	}
 }
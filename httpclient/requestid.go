@@ -0,0 +1,101 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+type requestIDContextKey struct{}
+
+// -----------------------------------------------------------------------------
+
+var fallbackUUIDCounter uint64
+
+// -----------------------------------------------------------------------------
+
+// SetRequestIDHeader makes the client send a request ID in the given header. The ID is created once per Exec call
+// with the generator, or as a random UUID if nil, and kept across retries. If the request already has the header,
+// its value is used instead. The ID is available in the callback through Response.RequestID and
+// RequestIDFromContext. An empty name disables it. It must be called before executing requests.
+func (c *HttpClient) SetRequestIDHeader(name string, generator func() string) {
+	c.requestIDHeader = name
+	c.requestIDGenerator = generator
+}
+
+// RequestIDFromContext returns the request ID stored in the context passed to the request callback, or an empty
+// string if there is none. Requests sent through the RoundTripper only get the header.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// -----------------------------------------------------------------------------
+
+// newRequestID returns the ID to send with a request having the given headers or an empty string if disabled.
+func (c *HttpClient) newRequestID(header http.Header) string {
+	if len(c.requestIDHeader) == 0 {
+		return ""
+	}
+	if id := header.Get(c.requestIDHeader); len(id) > 0 {
+		return id
+	}
+	if c.requestIDGenerator != nil {
+		return c.requestIDGenerator()
+	}
+	return newUUID()
+}
+
+// withRequestIDHeader returns a copy of the request with the request ID header set if enabled and not present.
+func (c *HttpClient) withRequestIDHeader(req *http.Request) *http.Request {
+	if len(c.requestIDHeader) == 0 || len(req.Header.Get(c.requestIDHeader)) > 0 {
+		return req
+	}
+	id := c.newRequestID(req.Header)
+	req = req.Clone(req.Context())
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set(c.requestIDHeader, id)
+	return req
+}
+
+// withRequestID returns a copy of the context that carries the request ID if any.
+func withRequestID(ctx context.Context, id string) context.Context {
+	if len(id) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// newUUID returns a random (version 4) UUID. If the system random source fails, the UUID is made unique from the
+// current time and a counter instead.
+func newUUID() string {
+	var b [16]byte
+
+	_, err := rand.Read(b[:])
+	if err != nil {
+		binary.BigEndian.PutUint64(b[0:8], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint64(b[8:16], atomic.AddUint64(&fallbackUUIDCounter, 1))
+	}
+	b[6] = (b[6] & 0x0F) | 0x40
+	b[8] = (b[8] & 0x3F) | 0x80
+
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], b[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:])
+	return string(buf)
+}
@@ -20,8 +20,12 @@ type Response struct {
 	source          *Source
 	retryCount      int
 	err             error
+	notSent         bool
+	timings         *RequestTimings
+	isFallback      bool
 	upstreamOffline *bool
 	retry           *bool
+	requestID       string
 }
 
 // -----------------------------------------------------------------------------
@@ -36,6 +40,17 @@ func (res *Response) Err() error {
 	return res.err
 }
 
+// RequestNotSent returns true if the request failed before any data was written to the source, for e.g. the
+// connection was refused. In this case, it is safe to retry non-idempotent requests on the next server.
+func (res *Response) RequestNotSent() bool {
+	return res.notSent
+}
+
+// Timings returns the timing breakdown of this attempt, or nil if the request was not set to capture timings.
+func (res *Response) Timings() *RequestTimings {
+	return res.timings
+}
+
 // RetryCount has the number of retries of the current request.
 func (res *Response) RetryCount() int {
 	return res.retryCount
@@ -53,10 +68,27 @@ func (res *Response) RetryOnNextServer() {
 
 // SourceID indicates the request must be retried on the next available server.
 func (res *Response) SourceID() int {
+	if res.source == nil {
+		return 0
+	}
 	return res.source.ID()
 }
 
 // SourceBaseURL returns the base URL to use.
 func (res *Response) SourceBaseURL() string {
-	return res.source.baseURL
+	if res.source == nil {
+		return ""
+	}
+	return res.source.BaseURL()
+}
+
+// RequestID returns the ID sent with the request or an empty string if request IDs are not enabled.
+func (res *Response) RequestID() string {
+	return res.requestID
+}
+
+// IsFallback returns true if the response was provided by the fallback handler instead of a source. In this case,
+// the response is not live and SourceID returns zero.
+func (res *Response) IsFallback() bool {
+	return res.isFallback
 }
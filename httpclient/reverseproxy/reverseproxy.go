@@ -0,0 +1,132 @@
+// Package reverseproxy provides an http.Handler that forwards the incoming requests to the sources of a load-balanced
+// http client.
+package reverseproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/randlabs/go-loadbalancer/v2"
+	"github.com/randlabs/go-loadbalancer/v2/httpclient"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	defaultMaxRetryBodySize = 1 << 20
+
+	sourcePlaceholderHost = "source"
+)
+
+// -----------------------------------------------------------------------------
+
+// Proxy is a reverse proxy that balances the incoming requests between the sources of an http client.
+type Proxy struct {
+	rp               *httputil.ReverseProxy
+	preserveHost     bool
+	maxRetryBodySize int64
+}
+
+// Options specifies the reverse proxy settings.
+type Options struct {
+	// PreserveHost keeps the Host header of the incoming request instead of using the source one.
+	PreserveHost bool
+
+	// MaxRetryBodySize is the maximum size of a request body that is buffered so the request can be retried on
+	// another source. Larger bodies, or with unknown length, are streamed and these requests are only retried if
+	// they were not sent. A negative value disables buffering. Defaults to 1MB.
+	MaxRetryBodySize int64
+
+	// FlushInterval specifies the flush interval to use while copying the response body. A negative value flushes
+	// immediately after each write. Streaming responses, like server-sent events, are always flushed immediately.
+	FlushInterval time.Duration
+
+	// ErrorHandler is called when the request cannot be forwarded. By default, it replies with a 503 status code if
+	// no source is available and with a 502 status code otherwise.
+	ErrorHandler func(w http.ResponseWriter, req *http.Request, err error)
+}
+
+// -----------------------------------------------------------------------------
+
+// New creates a new reverse proxy that forwards the requests to the sources of the given client. The client failover
+// and retry logic apply, see httpclient.HttpClient.RoundTripper for details. Protocol upgrades, like WebSockets, are
+// supported.
+func New(hc *httpclient.HttpClient, opts Options) (*Proxy, error) {
+	if hc == nil {
+		return nil, errors.New("invalid parameter")
+	}
+	if opts.MaxRetryBodySize == 0 {
+		opts.MaxRetryBodySize = defaultMaxRetryBodySize
+	}
+	if opts.ErrorHandler == nil {
+		opts.ErrorHandler = defaultErrorHandler
+	}
+
+	p := &Proxy{
+		preserveHost:     opts.PreserveHost,
+		maxRetryBodySize: opts.MaxRetryBodySize,
+	}
+	p.rp = &httputil.ReverseProxy{
+		Director:      p.director,
+		Transport:     hc.RoundTripper(),
+		FlushInterval: opts.FlushInterval,
+		ErrorHandler:  opts.ErrorHandler,
+	}
+
+	// Done
+	return p, nil
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.rp.ServeHTTP(w, req)
+}
+
+// -----------------------------------------------------------------------------
+
+func (p *Proxy) director(req *http.Request) {
+	// The scheme and host are replaced by the round tripper with the ones of the selected source
+	req.URL.Scheme = "http"
+	req.URL.Host = sourcePlaceholderHost
+	if !p.preserveHost {
+		req.Host = ""
+	}
+
+	// Buffer small bodies so the request can be retried
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength > 0 &&
+		req.ContentLength <= p.maxRetryBodySize {
+		body, err := io.ReadAll(io.LimitReader(req.Body, req.ContentLength))
+		_ = req.Body.Close()
+		if err != nil {
+			// Let the transport fail
+			req.Body = io.NopCloser(errReader{err: err})
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+}
+
+func defaultErrorHandler(w http.ResponseWriter, _ *http.Request, err error) {
+	if errors.Is(err, loadbalancer.ErrNoServersAvailable) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(_ []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,269 @@
+package httpclient
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/randlabs/go-loadbalancer/v2"
+)
+
+// -----------------------------------------------------------------------------
+
+type roundTripper struct {
+	c *HttpClient
+}
+
+type inFlightBody struct {
+	io.ReadCloser
+	src    *Source
+	closed int32
+}
+
+// -----------------------------------------------------------------------------
+
+// RoundTripper returns an http.RoundTripper that sends each request to the next available source. The scheme and host
+// of the request url are replaced with the ones of the source, and the default and source headers are added unless
+// the request already has them. The Host header is kept only if it differs from the request url host.
+//
+// Transport errors and 502, 503 and 504 responses count as source failures. If the request body is empty or can be
+// obtained again through GetBody, the request is retried on the next source if it was not sent or if it is
+// idempotent. Each request is retried at most once per source.
+func (c *HttpClient) RoundTripper() http.RoundTripper {
+	return &roundTripper{
+		c: c,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := rt.c
+
+	canReplay := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	method := req.Method
+	if len(method) == 0 {
+		method = "GET"
+	}
+	isIdempotent := isIdempotentMethod(method)
+
+	// Keep the same request ID across retries
+	req = c.withRequestIDHeader(req)
+
+	retryCounter := 0
+	var staleSource *Source
+	var excluded []*Source
+	var lastErr error
+	for {
+		var srv *loadbalancer.Server
+		var err error
+		if staleSource != nil {
+			// Retry on the source whose connection was stale
+			srv = staleSource.srv
+		} else {
+			// Skip the sources already tried
+			srv, err = c.nextServerFor(requestIntentAny, excluded)
+		}
+		if err != nil {
+			closeRequestBody(req)
+			if lastErr != nil {
+				// No other source is available, so return the error of the last one
+				return nil, lastErr
+			}
+			return nil, c.newError(err, errNoAvailableServer, req.URL.String(), 0)
+		}
+		src := srv.UserData().(*Source)
+
+		// Build the request to send to this source
+		outReq, err := c.newSourceRequest(req, src, retryCounter > 0 || staleSource != nil)
+		if err != nil {
+			closeRequestBody(req)
+			return nil, c.newError(err, errUnableToExecuteRequest, req.URL.String(), 0)
+		}
+		ctx, usage := c.withConnUsageTrace(outReq.Context())
+		outReq = outReq.WithContext(ctx)
+		fullUrl := outReq.URL.String()
+
+		atomic.AddInt32(&src.inFlight, 1)
+		if retryCounter > 0 {
+			atomic.AddInt64(&src.retries, 1)
+		}
+		startTime := time.Now()
+		resp, err := c.transportFor(src).RoundTrip(outReq)
+		if staleSource == nil && canReplay && req.Context().Err() == nil && usage.isStale(err, isIdempotent) {
+			// The source closed the reused connection, so retry once on a new one
+			src.releaseSlot()
+			src.closeIdleConns()
+
+			staleSource = src
+			continue
+		}
+		staleSource = nil
+		elapsed := time.Since(startTime)
+		src.trackSLA(elapsed, err)
+
+		upstreamOffline := false
+		if err != nil {
+			src.releaseSlot()
+
+			notSent := isRequestNotSent(ctx, err)
+			tlsFailure := false
+			if isProxyConnectError(ctx, err) {
+				err = c.newProxyError(err, fullUrl)
+			} else if isTLSCertificateError(err) {
+				tlsFailure = true
+				err = c.newTLSError(err, fullUrl)
+				c.raiseEvent(TLSErrorEvent, src.ID(), err)
+			} else if req.Context().Err() != nil {
+				err = ErrCanceled
+			} else {
+				upstreamOffline = true
+				err = c.newError(err, errUnableToExecuteRequest, fullUrl, 0)
+			}
+
+			c.setSourceLastError(src, err)
+			c.raiseRequestEvent(srv, err)
+			if upstreamOffline {
+				src.reportFailure()
+				c.trackAdaptiveWeight(src, elapsed, true)
+				c.trackErrorPenalty(src, true)
+			}
+
+			if req.Context().Err() == nil && retryCounter < c.SourcesCount()-1 &&
+				canReplay && (notSent || isIdempotent) && !tlsFailure {
+				excluded = append(excluded, src)
+				lastErr = err
+				retryCounter += 1
+				continue
+			}
+			return nil, err
+		}
+
+		errMessage := errUnableToExecuteRequest
+		healthy, retryOther := true, false
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			upstreamOffline = true
+		default:
+			if !src.hasRequiredHeader(resp) {
+				upstreamOffline = true
+				errMessage = errMissingResponseHeader
+			} else {
+				healthy, retryOther = src.validateResponse(resp)
+			}
+		}
+
+		c.trackAdaptiveWeight(src, elapsed, upstreamOffline || !healthy)
+		c.trackErrorPenalty(src, upstreamOffline || !healthy)
+		if !healthy || retryOther {
+			// The source validator rejected the response
+			err = c.newError(nil, errInvalidResponse, fullUrl, resp.StatusCode)
+			c.setSourceLastError(src, err)
+			c.raiseRequestEvent(srv, err)
+			if !healthy {
+				src.reportFailure()
+			} else {
+				src.reportSuccess()
+			}
+
+			if retryOther && canReplay && retryCounter < c.SourcesCount()-1 {
+				drainBody(resp.Body)
+				src.releaseSlot()
+
+				excluded = append(excluded, src)
+				lastErr = err
+				retryCounter += 1
+				continue
+			}
+		} else if upstreamOffline {
+			err = c.newError(nil, errMessage, fullUrl, resp.StatusCode)
+			c.setSourceLastError(src, err)
+			c.raiseRequestEvent(srv, err)
+			if !c.statusErrorPolicy.NoMarkDown {
+				src.reportFailure()
+			}
+
+			if !c.statusErrorPolicy.NoRetry && isIdempotent && canReplay && retryCounter < c.SourcesCount()-1 {
+				drainBody(resp.Body)
+				src.releaseSlot()
+
+				excluded = append(excluded, src)
+				lastErr = err
+				retryCounter += 1
+				continue
+			}
+		} else {
+			c.setSourceLastError(src, nil)
+			c.raiseRequestEvent(srv, nil)
+			src.reportSuccess()
+		}
+
+		// Keep the request counted as in-flight until the body is closed. Upgraded connections are not tracked.
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			src.releaseSlot()
+		} else {
+			resp.Body = &inFlightBody{
+				ReadCloser: resp.Body,
+				src:        src,
+			}
+		}
+
+		// Done
+		return resp, nil
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+func (c *HttpClient) newSourceRequest(req *http.Request, src *Source, isRetry bool) (*http.Request, error) {
+	outReq := req.Clone(req.Context())
+	if isRetry && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		outReq.Body = body
+	}
+
+	baseURL, err := url.Parse(src.BaseURL())
+	if err != nil {
+		return nil, err
+	}
+	// Use the source host unless the Host header was explicitly set
+	if outReq.Host == req.URL.Host {
+		outReq.Host = ""
+	}
+	outReq.URL.Scheme = baseURL.Scheme
+	outReq.URL.Host = baseURL.Host
+
+	// Add the source and default headers if not present in the request
+	if outReq.Header == nil {
+		outReq.Header = make(http.Header)
+	}
+	for _, h := range []http.Header{src.header, c.defaultHeader} {
+		for k, v := range h {
+			if len(v) > 0 && len(outReq.Header.Values(k)) == 0 {
+				outReq.Header.Set(k, v[0])
+			}
+		}
+	}
+	outReq.Close = outReq.Close || src.opts.DisableKeepAlive
+
+	// Done
+	ctx := c.withConnAgeTrace(c.withConnStatsTrace(withSource(req.Context(), src), src))
+	return outReq.WithContext(c.withIdleTrace(ctx)), nil
+}
+
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
+
+func (b *inFlightBody) Close() error {
+	if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		b.src.releaseSlot()
+	}
+	return b.ReadCloser.Close()
+}
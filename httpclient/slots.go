@@ -0,0 +1,173 @@
+package httpclient
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/randlabs/go-loadbalancer/v2"
+)
+
+// -----------------------------------------------------------------------------
+
+// slotQueue keeps the requests waiting for a source to have a free concurrency slot sorted by priority and, within
+// the same priority, in arrival order.
+type slotQueue struct {
+	mtx     sync.Mutex
+	waiters list.List
+	limit   int
+}
+
+type slotWaiter struct {
+	elem     *list.Element
+	ch       chan struct{}
+	priority int
+	signaled bool
+	shed     bool
+}
+
+// -----------------------------------------------------------------------------
+
+// releaseSlot ends a request sent to the source and wakes up the first request waiting for a slot, if any. It also
+// signals the drain completion of the source.
+func (src *Source) releaseSlot() {
+	atomic.AddInt32(&src.inFlight, -1)
+	if src.opts.MaxConcurrent > 0 && src.slots != nil {
+		src.slots.signal()
+	}
+	if src.isDraining() {
+		src.checkDrained()
+	}
+}
+
+// SetSlotQueueLimit limits the amount of requests waiting for a slot (see Request.WaitForSlot). Once reached, a new
+// request with a higher priority than the lowest one queued sheds the last request with that priority, which fails
+// with an error matching ErrOverloaded, and takes its place. Otherwise, the new request fails right away with that
+// error. Zero means no limit. It must be called before executing requests.
+func (c *HttpClient) SetSlotQueueLimit(limit int) error {
+	if limit < 0 {
+		return errors.New("invalid parameter")
+	}
+
+	// Lock access
+	c.slots.mtx.Lock()
+	c.slots.limit = limit
+	c.slots.mtx.Unlock()
+
+	// Done
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// waitForSlot waits until one of the sources busy because of their MaxConcurrent limit has a free slot. It returns
+// ErrTimeout or ErrCanceled if the context expires first and ErrOverloaded if the request is shed. Waiters are served
+// by priority, then in arrival order, and the ones that lose a freed slot to a request that was not waiting keep their
+// position.
+func (c *HttpClient) waitForSlot(ctx context.Context, intent int, priority int, excluded []*Source) (
+	*loadbalancer.Server, error,
+) {
+	atFront := false
+	for {
+		// Enqueue before checking so a slot freed in the meantime is not missed
+		w := c.slots.enqueue(atFront, priority)
+		if w == nil {
+			return nil, ErrOverloaded
+		}
+
+		srv, err := c.nextServerFor(intent, excluded)
+		if !errors.Is(err, ErrOverloaded) {
+			c.slots.remove(w)
+			return srv, err
+		}
+
+		select {
+		case <-w.ch:
+			if w.shed {
+				return nil, ErrOverloaded
+			}
+			atFront = true
+
+		case <-ctx.Done():
+			c.slots.remove(w)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, ErrTimeout
+			}
+			return nil, ErrCanceled
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// enqueue adds a waiter after the ones with the same or higher priority or, if atFront is true, before the ones with
+// the same priority. It returns nil if the queue is full and no waiter with a lower priority can be shed. Waiters put
+// back at the front do not count toward the limit.
+func (q *slotQueue) enqueue(atFront bool, priority int) *slotWaiter {
+	w := &slotWaiter{
+		ch:       make(chan struct{}),
+		priority: priority,
+	}
+
+	// Lock access
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if !atFront && q.limit > 0 && q.waiters.Len() >= q.limit {
+		// Shed the last waiter, which has the lowest priority, if it is lower than the new one
+		last := q.waiters.Back().Value.(*slotWaiter)
+		if last.priority >= priority {
+			return nil
+		}
+		q.waiters.Remove(last.elem)
+		last.signaled = true
+		last.shed = true
+		close(last.ch)
+	}
+
+	for elem := q.waiters.Front(); elem != nil; elem = elem.Next() {
+		other := elem.Value.(*slotWaiter)
+		if other.priority < priority || (atFront && other.priority == priority) {
+			w.elem = q.waiters.InsertBefore(w, elem)
+			return w
+		}
+	}
+	w.elem = q.waiters.PushBack(w)
+	return w
+}
+
+// remove takes the waiter out of the queue. If it was already woken up, the next one is woken up instead, unless it
+// was shed.
+func (q *slotQueue) remove(w *slotWaiter) {
+	// Lock access
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if !w.signaled {
+		q.waiters.Remove(w.elem)
+		return
+	}
+	if !w.shed {
+		q.signalLocked()
+	}
+}
+
+func (q *slotQueue) signal() {
+	// Lock access
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.signalLocked()
+}
+
+func (q *slotQueue) signalLocked() {
+	elem := q.waiters.Front()
+	if elem == nil {
+		return
+	}
+	w := q.waiters.Remove(elem).(*slotWaiter)
+	w.signaled = true
+	close(w.ch)
+}
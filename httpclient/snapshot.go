@@ -0,0 +1,113 @@
+package httpclient
+
+import (
+	"sort"
+	"time"
+
+	"github.com/randlabs/go-loadbalancer/v2"
+)
+
+// -----------------------------------------------------------------------------
+
+// StateSnapshot contains a consistent copy of the state of all the sources. It can be serialized to JSON.
+type StateSnapshot struct {
+	Sources []SourceSnapshot `json:"sources"`
+}
+
+// SourceSnapshot contains a copy of the state of a single source.
+type SourceSnapshot struct {
+	ID          int           `json:"id"`
+	BaseURL     string        `json:"baseUrl"`
+	Weight      int           `json:"weight"`
+	IsBackup    bool          `json:"isBackup"`
+	IsDown      bool          `json:"isDown"`
+	IsProbing   bool          `json:"isProbing"`
+	IsDraining  bool          `json:"isDraining"`
+	FailCounter int           `json:"failCounter"`
+	InFlight    int           `json:"inFlight"`
+	Requests    int64         `json:"requests"`
+	Failures    int64         `json:"failures"`
+	Retries     int64         `json:"retries"`
+	OpenConns   int           `json:"openConns"`
+	NewConns    int64         `json:"newConns"`
+	ReusedConns int64         `json:"reusedConns"`
+	SLAMet      int64         `json:"slaMet"`
+	SLAMissed   int64         `json:"slaMissed"`
+	RecoversIn  time.Duration `json:"recoversIn"`
+	LastError   string        `json:"lastError,omitempty"`
+}
+
+// -----------------------------------------------------------------------------
+
+// StateSnapshot returns a copy of the state of all sources taken at the same time.
+func (c *HttpClient) StateSnapshot() StateSnapshot {
+	states := c.lb.Snapshot()
+
+	snapshot := StateSnapshot{
+		Sources: make([]SourceSnapshot, 0, len(states)),
+	}
+	for _, state := range states {
+		src := state.Server.UserData().(*Source)
+
+		ss := SourceSnapshot{
+			ID:          src.ID(),
+			BaseURL:     src.BaseURL(),
+			Weight:      state.Weight,
+			IsBackup:    state.IsBackup,
+			IsDown:      state.IsDown,
+			IsProbing:   state.IsProbing,
+			IsDraining:  src.isDraining(),
+			FailCounter: state.FailCounter,
+			InFlight:    src.InFlight(),
+			Requests:    src.Requests(),
+			Failures:    src.Failures(),
+			Retries:     src.Retries(),
+			OpenConns:   src.OpenConns(),
+			NewConns:    src.NewConns(),
+			ReusedConns: src.ReusedConns(),
+			SLAMet:      src.SLAMet(),
+			SLAMissed:   src.SLAMissed(),
+			RecoversIn:  state.RecoversIn,
+		}
+		if err := src.Err(); err != nil {
+			ss.LastError = err.Error()
+		}
+		snapshot.Sources = append(snapshot.Sources, ss)
+	}
+
+	// Sort by source id
+	sort.Slice(snapshot.Sources, func(i, j int) bool {
+		return snapshot.Sources[i].ID < snapshot.Sources[j].ID
+	})
+
+	// Done
+	return snapshot
+}
+
+// HealthySourceURLs returns the base urls of the online sources, taken at the same time, sorted by weight in
+// descending order. Sources with the same weight are sorted by id.
+func (c *HttpClient) HealthySourceURLs() []string {
+	states := c.lb.Snapshot()
+
+	healthy := make([]loadbalancer.ServerState, 0, len(states))
+	for _, state := range states {
+		if !(state.IsDown || state.IsProbing) {
+			healthy = append(healthy, state)
+		}
+	}
+
+	sort.SliceStable(healthy, func(i, j int) bool {
+		if healthy[i].Weight != healthy[j].Weight {
+			return healthy[i].Weight > healthy[j].Weight
+		}
+		return healthy[i].Server.UserData().(*Source).ID() < healthy[j].Server.UserData().(*Source).ID()
+	})
+
+	urls := make([]string, 0, len(healthy))
+	for _, state := range healthy {
+		urls = append(urls, state.Server.UserData().(*Source).BaseURL())
+	}
+
+	// Done
+	return urls
+}
@@ -1,8 +1,16 @@
 package httpclient
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/randlabs/go-loadbalancer/v2"
 )
 
 // -----------------------------------------------------------------------------
@@ -10,11 +18,165 @@ import (
 // Source represents a server where the client will do requests.
 type Source struct {
 	id        int // NOTE: The IDs starts from 1
-	baseURL   string
+	baseURL   atomic.Value
 	header    http.Header
-	isBackup  bool
+	isBackup  int32
 	isOnline  int32
 	lastError atomic.Value
+	srv       *loadbalancer.Server
+	inFlight  int32
+	requests  int64
+	failures  int64
+	retries   int64
+
+	openConns   int32
+	newConns    int64
+	reusedConns int64
+
+	slaMet    int64
+	slaMissed int64
+
+	dnsFailingSince int64 // NOTE: Start and last time of the current streak of DNS failures
+	dnsLastFailure  int64
+
+	slowThreshold time.Duration
+	optsMtx       sync.Mutex
+	opts          SourceOptions
+	errorRate     errorRateTracker
+	adaptive      adaptiveTracker
+	penalty       penaltyTracker
+	connSem       chan struct{}
+	mirrorSem     chan struct{}
+	slots         *slotQueue
+	totalConns    *connLimiter
+	breaker       Breaker
+
+	connsMtx sync.Mutex
+	conns    map[*sourceConn]struct{}
+
+	draining      int32
+	drainMtx      sync.Mutex
+	drainedCh     chan struct{}
+	drainCancelCh chan struct{}
+
+	transportOnce sync.Once
+	transport     *http.Transport
+}
+
+// SourceOptions specifies the balancer options of a source along with other request settings.
+type SourceOptions struct {
+	loadbalancer.ServerOptions
+
+	// Header contains the headers to add to every request sent to this source.
+	Header http.Header
+
+	// IsShadow indicates the source only receives a copy of the idempotent requests sent to the other sources. The
+	// copies are sent in the background and their responses are discarded, so the source never serves real responses.
+	// At most 64 copies are in flight per shadow source, so the further ones are dropped while it is slow. Shadow
+	// sources are not counted by SourcesCount and have an ID of zero.
+	IsShadow bool
+
+	// Proxy, if set, is the proxy used to reach this source. Requests to https sources are tunneled through the
+	// proxy using the CONNECT method.
+	Proxy *url.URL
+
+	// ProxyHeader contains the headers, like Proxy-Authorization, to send to the proxy in the CONNECT request.
+	ProxyHeader http.Header
+
+	// Group is the name of the group the source belongs to, for e.g. "blue" or "green". See ActivateGroup.
+	Group string
+
+	// Zone is the name of the datacenter or availability zone of the source. See Request.RetryInSameZone.
+	Zone string
+
+	// ReadOnly indicates the source is a read replica. Requests executed with ForWrite are never sent to it and requests
+	// executed with ForRead are sent to it preferably.
+	ReadOnly bool
+
+	// ExpectContinue adds the "Expect: 100-continue" header to requests with a body, so the source can reject them
+	// before the body is sent. If the source replies with a 417 status code, the request is sent to the next source
+	// without calling the callback. Bodies are kept in memory anyway to allow retries, so this only saves bandwidth.
+	// It requires the transport ExpectContinueTimeout to be set, as it is in the default transport.
+	ExpectContinue bool
+
+	// RequireResponseHeader, if set, makes responses lacking the header count as failures, so misconfigured sources or
+	// misrouted requests returning otherwise valid responses are detected. The response is still passed to the
+	// callback along with the error.
+	RequireResponseHeader *HeaderRequirement
+
+	// ResponseValidator, if set, is called with the responses that have no other error, so sources returning valid
+	// responses that signal a problem, like stale data, can be detected. Returning healthy as false counts as a
+	// failure toward the MaxFails limit of the source. Returning retry as true sends the request to the next source
+	// if it can be retried; otherwise the response is passed to the callback along with an error. It must not read the
+	// response body.
+	ResponseValidator func(resp *http.Response) (healthy bool, retry bool)
+
+	// ResponseHeaderTimeout overrides the time to wait for the response headers of this source, for e.g. for long
+	// polling endpoints. A negative value disables the timeout. Zero uses the transport setting. Sources with an
+	// override use their own connection pool, created the first time they are used, so the transport settings
+	// changed after that, like the dial preference, are not applied to them.
+	ResponseHeaderTimeout time.Duration
+
+	// MaxConcurrent limits the amount of requests executed at the same time against this source. Busy sources are
+	// skipped during selection and, if all the available sources are busy, requests fail with an error matching
+	// ErrOverloaded unless they wait for a slot (see Request.WaitForSlot). Concurrent selections may briefly exceed
+	// the limit. It is not used with a custom selector. Zero means no limit.
+	MaxConcurrent int
+
+	// Capacity is the amount of requests the source can handle at the same time on fill-first mode (see
+	// HttpClient.SetFillFirst). Once reached, requests overflow to the next source. Unlike MaxConcurrent, it is not a
+	// hard limit. Zero means the source is never full.
+	Capacity int
+
+	// MaxConns limits the amount of connections opened to this source, including the idle ones. Once reached,
+	// requests wait for a connection to become idle or to be closed. It applies to all the requests, including the
+	// health checks and the mirrored ones, but not to connections established with a custom DialTLSContext
+	// transport function. Zero means no limit.
+	MaxConns int
+
+	// DisableKeepAlive closes the connection after each request sent to this source, so every request uses a fresh
+	// connection. Other sources keep reusing connections. Note this adds a connection setup, and a TLS handshake for
+	// https sources, to every request, increasing latency and load on both sides.
+	DisableKeepAlive bool
+
+	// Responses that take longer than SlowThreshold to arrive count as failures toward the MaxFails limit, even if
+	// the request succeeded. A value of zero disables the check.
+	SlowThreshold time.Duration
+
+	// SLA is the target response time of the source. Requests whose response arrived within it are counted as met,
+	// the slower ones and the ones that failed to get a response as missed. A value of zero disables the tracking.
+	SLA time.Duration
+
+	// Overrides sets options to the given values, even to their zero value, after the defaults set with
+	// HttpClient.SetDefaultSourceOptions are applied, so a source can disable an option enabled by default.
+	Overrides SourceOverrides
+}
+
+// SourceOverrides contains the source options to set regardless of the defaults. Nil fields are left as they are.
+type SourceOverrides struct {
+	Weight                *int
+	MaxFails              *int
+	FailTimeout           *time.Duration
+	IsBackup              *bool
+	BackupOrder           *int
+	ReadOnly              *bool
+	ExpectContinue        *bool
+	ResponseHeaderTimeout *time.Duration
+	MaxConcurrent         *int
+	Capacity              *int
+	MaxConns              *int
+	DisableKeepAlive      *bool
+	SlowThreshold         *time.Duration
+	SLA                   *time.Duration
+}
+
+// HeaderRequirement specifies a header a response must contain.
+type HeaderRequirement struct {
+	// Name is the name of the header.
+	Name string
+
+	// Value, if not empty, must match the header value.
+	Value string
 }
 
 // Hack-hack to avoid panics on atomic.Value
@@ -24,13 +186,23 @@ type packedError struct {
 
 // -----------------------------------------------------------------------------
 
-func newSource(id int, baseURL string, headers http.Header, isBackup bool) *Source {
+func newSource(id int, baseURL string, opts SourceOptions) *Source {
 	src := Source{
-		id:        id,
-		baseURL:   baseURL,
-		header:    headers.Clone(),
-		isBackup:  isBackup,
-		lastError: atomic.Value{},
+		id:            id,
+		header:        opts.Header.Clone(),
+		lastError:     atomic.Value{},
+		slowThreshold: opts.SlowThreshold,
+		opts:          opts,
+	}
+	src.baseURL.Store(baseURL)
+	if opts.IsBackup {
+		atomic.StoreInt32(&src.isBackup, 1)
+	}
+	if opts.MaxConns > 0 {
+		src.connSem = make(chan struct{}, opts.MaxConns)
+	}
+	if opts.IsShadow {
+		src.mirrorSem = make(chan struct{}, maxMirrorsInFlight)
 	}
 	atomic.StoreInt32(&src.isOnline, 1)
 	src.setLastError(nil)
@@ -38,6 +210,63 @@ func newSource(id int, baseURL string, headers http.Header, isBackup bool) *Sour
 	return &src
 }
 
+// checkSourceOptions checks the options specific to the http client. The load balancer checks the rest.
+func checkSourceOptions(opts SourceOptions) error {
+	if opts.SlowThreshold < 0 || opts.SLA < 0 || opts.MaxConns < 0 || opts.MaxConcurrent < 0 ||
+		opts.Capacity < 0 {
+		return errors.New("invalid parameter")
+	}
+	if opts.RequireResponseHeader != nil && len(opts.RequireResponseHeader.Name) == 0 {
+		return errors.New("invalid parameter")
+	}
+	if opts.Proxy != nil && opts.Proxy.Scheme != "http" && opts.Proxy.Scheme != "https" {
+		return errors.New("invalid parameter")
+	}
+	return nil
+}
+
+// cloneSourceOptions returns a deep copy of the options, so the caller can reuse them.
+func cloneSourceOptions(opts SourceOptions) SourceOptions {
+	opts.Header = opts.Header.Clone()
+	opts.ProxyHeader = opts.ProxyHeader.Clone()
+	if opts.Proxy != nil {
+		proxy := *opts.Proxy
+		opts.Proxy = &proxy
+	}
+	if opts.RequireResponseHeader != nil {
+		requirement := *opts.RequireResponseHeader
+		opts.RequireResponseHeader = &requirement
+	}
+	return opts
+}
+
+// mergeSourceOptions returns a copy of the options where the fields with a zero value are taken from the defaults.
+func mergeSourceOptions(opts SourceOptions, defaults SourceOptions) SourceOptions {
+	defaults.Overrides = SourceOverrides{}
+	mergeZeroFields(reflect.ValueOf(&opts).Elem(), reflect.ValueOf(defaults))
+
+	// Apply the explicit values
+	dst := reflect.ValueOf(&opts).Elem()
+	overrides := reflect.ValueOf(opts.Overrides)
+	for idx := 0; idx < overrides.NumField(); idx++ {
+		if field := overrides.Field(idx); !field.IsNil() {
+			dst.FieldByName(overrides.Type().Field(idx).Name).Set(field.Elem())
+		}
+	}
+	return opts
+}
+
+func mergeZeroFields(dst reflect.Value, defaults reflect.Value) {
+	for idx := 0; idx < dst.NumField(); idx++ {
+		field := dst.Field(idx)
+		if dst.Type().Field(idx).Anonymous && field.Kind() == reflect.Struct {
+			mergeZeroFields(field, defaults.Field(idx))
+		} else if field.IsZero() {
+			field.Set(defaults.Field(idx))
+		}
+	}
+}
+
 // ID returns the source identifier.
 func (src *Source) ID() int {
 	return src.id
@@ -45,12 +274,12 @@ func (src *Source) ID() int {
 
 // BaseURL returns the source base url.
 func (src *Source) BaseURL() string {
-	return src.baseURL
+	return src.baseURL.Load().(string)
 }
 
 // IsBackup returns if the source is primary or backup.
 func (src *Source) IsBackup() bool {
-	return src.isBackup
+	return atomic.LoadInt32(&src.isBackup) != 0
 }
 
 // IsOnline returns if the source is online.
@@ -58,12 +287,122 @@ func (src *Source) IsOnline() bool {
 	return atomic.LoadInt32(&src.isOnline) != 0
 }
 
+// InFlight returns the number of requests currently being executed against the source.
+func (src *Source) InFlight() int {
+	return int(atomic.LoadInt32(&src.inFlight))
+}
+
+// Requests returns the number of requests sent to the source, including the failed ones and the retries.
+func (src *Source) Requests() int64 {
+	return atomic.LoadInt64(&src.requests)
+}
+
+// Failures returns the number of requests sent to the source that failed.
+func (src *Source) Failures() int64 {
+	return atomic.LoadInt64(&src.failures)
+}
+
+// Retries returns the number of requests sent to the source as a retry of a request that failed on another source.
+func (src *Source) Retries() int64 {
+	return atomic.LoadInt64(&src.retries)
+}
+
+// OpenConns returns the number of connections currently open to the source, either in use or idle.
+func (src *Source) OpenConns() int {
+	return int(atomic.LoadInt32(&src.openConns))
+}
+
+// NewConns returns the number of requests that used a new connection. It is only tracked if the connection stats are
+// enabled.
+func (src *Source) NewConns() int64 {
+	return atomic.LoadInt64(&src.newConns)
+}
+
+// ReusedConns returns the number of requests that reused a connection. It is only tracked if the connection stats are
+// enabled.
+func (src *Source) ReusedConns() int64 {
+	return atomic.LoadInt64(&src.reusedConns)
+}
+
+// SLAMet returns the number of requests whose response arrived within the source SLA.
+func (src *Source) SLAMet() int64 {
+	return atomic.LoadInt64(&src.slaMet)
+}
+
+// SLAMissed returns the number of requests that did not get a response within the source SLA.
+func (src *Source) SLAMissed() int64 {
+	return atomic.LoadInt64(&src.slaMissed)
+}
+
+// SLACompliance returns the fraction of requests, from 0 to 1, that met the source SLA, or 1 if there are none.
+func (src *Source) SLACompliance() float64 {
+	met := src.SLAMet()
+	total := met + src.SLAMissed()
+	if total == 0 {
+		return 1
+	}
+	return float64(met) / float64(total)
+}
+
+// trackSLA accounts the response time of a request if the source has an SLA. Requests canceled by the caller are
+// ignored.
+func (src *Source) trackSLA(elapsed time.Duration, err error) {
+	if src.opts.SLA == 0 || errors.Is(err, context.Canceled) {
+		return
+	}
+	if err == nil && elapsed <= src.opts.SLA {
+		atomic.AddInt64(&src.slaMet, 1)
+	} else {
+		atomic.AddInt64(&src.slaMissed, 1)
+	}
+}
+
 // Err returns the last error occurred in the source.
 func (src *Source) Err() error {
 	perr := src.lastError.Load().(packedError)
 	return perr.err
 }
 
+// options returns a copy of the source options. The role and fail policy can be changed at any time, so they must be
+// read through it.
+func (src *Source) options() SourceOptions {
+	// Lock access
+	src.optsMtx.Lock()
+	defer src.optsMtx.Unlock()
+
+	// Done
+	return src.opts
+}
+
+func (src *Source) hasRequiredHeader(resp *http.Response) bool {
+	hr := src.opts.RequireResponseHeader
+	if hr == nil {
+		return true
+	}
+	values := resp.Header.Values(hr.Name)
+	if len(hr.Value) == 0 {
+		return len(values) > 0
+	}
+	for _, value := range values {
+		if value == hr.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// validateResponse runs the response validator of the source, if any.
+func (src *Source) validateResponse(resp *http.Response) (healthy bool, retry bool) {
+	if src.opts.ResponseValidator == nil {
+		return true, false
+	}
+	return src.opts.ResponseValidator(resp)
+}
+
+func (src *Source) isBusy() bool {
+	return src.opts.MaxConcurrent > 0 && src.InFlight() >= src.opts.MaxConcurrent
+}
+
 func (src *Source) setOnlineStatus(online bool) {
 	if online {
 		atomic.StoreInt32(&src.isOnline, 1)
@@ -72,8 +411,22 @@ func (src *Source) setOnlineStatus(online bool) {
 	}
 }
 
-func (src *Source) setLastError(err error) {
-	src.lastError.Store(packedError{
+// setLastError stores the last error and returns true if it is a new non-nil error that differs from the previous one.
+func (src *Source) setLastError(err error) bool {
+	old := src.lastError.Swap(packedError{
 		err: err,
 	})
+	if err == nil {
+		return false
+	}
+	if old == nil {
+		return true
+	}
+	prevErr := old.(packedError).err
+	if prevErr == nil {
+		return true
+	}
+
+	// De-duplicate identical consecutive errors
+	return reflect.TypeOf(prevErr) != reflect.TypeOf(err) || prevErr.Error() != err.Error()
 }
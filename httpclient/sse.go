@@ -0,0 +1,266 @@
+package httpclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/randlabs/go-loadbalancer/v2"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	defaultSSEReconnectDelay    = time.Second
+	defaultSSEMaxReconnectDelay = 30 * time.Second
+
+	errSSEUnexpectedStatus = "unexpected event stream status code"
+	errSSEReconnectLimit   = "event stream reconnection limit reached"
+)
+
+// -----------------------------------------------------------------------------
+
+// SSEEvent is an event received from a server-sent events stream.
+type SSEEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// SSEOptions specifies how an event stream is consumed.
+type SSEOptions struct {
+	// Headers contains additional headers to send on each connection attempt.
+	Headers http.Header
+
+	// ReconnectDelay is the initial time to wait before reconnecting. It is doubled on each consecutive failure up
+	// to MaxReconnectDelay and can be overridden by the stream through the retry field. Defaults to one second.
+	ReconnectDelay time.Duration
+
+	// MaxReconnectDelay is the maximum time to wait before reconnecting. Defaults to 30 seconds.
+	MaxReconnectDelay time.Duration
+
+	// MaxReconnects is the maximum number of consecutive failed reconnections. Zero means unlimited.
+	MaxReconnects int
+
+	// SameSource indicates to reconnect to the same source while it is online instead of the next available one.
+	SameSource bool
+}
+
+// SSEHandler is called for each received event. Returning an error stops consuming the stream.
+type SSEHandler func(ev SSEEvent) error
+
+// -----------------------------------------------------------------------------
+
+// StreamEvents consumes a server-sent events stream from the given resource. If the stream is disconnected, it
+// reconnects to the same or the next available source with an exponential backoff and sends the last received event
+// ID in the Last-Event-ID header so the stream can be resumed.
+//
+// It returns when the context is canceled, the handler returns an error, the source replies with a 204 status code
+// or the reconnection limit is reached.
+func (c *HttpClient) StreamEvents(ctx context.Context, url string, opts SSEOptions, handler SSEHandler) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if len(url) == 0 || handler == nil || opts.ReconnectDelay < 0 || opts.MaxReconnectDelay < 0 ||
+		opts.MaxReconnects < 0 {
+		return errors.New("invalid parameter")
+	}
+	if opts.ReconnectDelay == 0 {
+		opts.ReconnectDelay = defaultSSEReconnectDelay
+	}
+	if opts.MaxReconnectDelay == 0 {
+		opts.MaxReconnectDelay = defaultSSEMaxReconnectDelay
+	}
+
+	stream := sseStream{
+		lastEventID: "",
+		delay:       opts.ReconnectDelay,
+	}
+	failures := 0
+	var lastSrv *loadbalancer.Server
+	var lastErr error
+
+	for {
+		// Pick the source
+		var srv *loadbalancer.Server
+		var err error
+		if opts.SameSource && lastSrv != nil && lastSrv.UserData().(*Source).IsOnline() {
+			srv = lastSrv
+		} else {
+			srv, err = c.nextServer()
+		}
+
+		if err == nil {
+			lastSrv = srv
+
+			var received bool
+			var stop bool
+
+			received, stop, lastErr = c.consumeEventStream(ctx, srv, url, opts, &stream, handler)
+			if stop {
+				return lastErr
+			}
+			if received {
+				// Restart the backoff if the stream was working
+				failures = 0
+				stream.delay = stream.baseDelay(opts)
+			}
+		} else {
+			lastErr = c.newError(err, errNoAvailableServer, url, 0)
+		}
+
+		// Check the reconnection limit
+		failures += 1
+		if opts.MaxReconnects > 0 && failures > opts.MaxReconnects {
+			return c.newError(lastErr, errSSEReconnectLimit, url, 0)
+		}
+
+		// Wait before reconnecting
+		select {
+		case <-ctx.Done():
+			return ErrCanceled
+		case <-time.After(stream.delay):
+		}
+		stream.delay *= 2
+		if stream.delay > opts.MaxReconnectDelay {
+			stream.delay = opts.MaxReconnectDelay
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+type sseStream struct {
+	lastEventID string
+	delay       time.Duration
+	retryDelay  time.Duration
+}
+
+func (s *sseStream) baseDelay(opts SSEOptions) time.Duration {
+	if s.retryDelay > 0 {
+		return s.retryDelay
+	}
+	return opts.ReconnectDelay
+}
+
+// consumeEventStream connects to the source and dispatches the events until the stream ends. It returns if at least
+// one event was received and if the caller must stop reconnecting.
+func (c *HttpClient) consumeEventStream(
+	ctx context.Context, srv *loadbalancer.Server, url string, opts SSEOptions, stream *sseStream, handler SSEHandler,
+) (bool, bool, error) {
+	src := srv.UserData().(*Source)
+	fullUrl := src.BaseURL() + url
+
+	httpReq, err := c.newHttpRequest(&Request{method: "GET", url: url, headers: opts.Headers}, src, nil)
+	if err != nil {
+		return false, true, c.newError(err, errUnableToExecuteRequest, fullUrl, 0)
+	}
+	httpReq.Header.Set("Accept", "text/event-stream")
+	httpReq.Header.Set("Cache-Control", "no-cache")
+	if len(stream.lastEventID) > 0 {
+		httpReq.Header.Set("Last-Event-ID", stream.lastEventID)
+	}
+
+	client := http.Client{
+		Transport: c.transportFor(src),
+	}
+
+	atomic.AddInt32(&src.inFlight, 1)
+	defer src.releaseSlot()
+
+	resp, err := client.Do(httpReq.WithContext(withSource(ctx, src)))
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, true, ErrCanceled
+		}
+		err = c.newError(err, errUnableToExecuteRequest, fullUrl, 0)
+		c.setSourceLastError(src, err)
+		src.reportFailure()
+		return false, false, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	// A 204 status code means the server asks to stop reconnecting
+	if resp.StatusCode == http.StatusNoContent {
+		src.reportSuccess()
+		return false, true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = c.newError(nil, errSSEUnexpectedStatus, fullUrl, resp.StatusCode)
+		c.setSourceLastError(src, err)
+		if !c.statusErrorPolicy.NoMarkDown {
+			src.reportFailure()
+		}
+		return false, false, err
+	}
+	src.reportSuccess()
+	c.setSourceLastError(src, nil)
+
+	// Parse the stream
+	received := false
+	ev := SSEEvent{}
+	data := make([]string, 0)
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if ctx.Err() != nil {
+				return received, true, ErrCanceled
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return received, false, c.newError(err, errUnableToExecuteRequest, fullUrl, 0)
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		// An empty line dispatches the event
+		if len(line) == 0 {
+			if len(data) > 0 {
+				ev.Data = strings.Join(data, "\n")
+				ev.ID = stream.lastEventID
+				received = true
+
+				err = handler(ev)
+				if err != nil {
+					return received, true, err
+				}
+			}
+			ev = SSEEvent{}
+			data = data[:0]
+			continue
+		}
+
+		// Skip comments
+		if line[0] == ':' {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			if !strings.Contains(value, "\x00") {
+				stream.lastEventID = value
+			}
+		case "event":
+			ev.Event = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			ms, err := strconv.Atoi(value)
+			if err == nil && ms >= 0 {
+				stream.retryDelay = time.Duration(ms) * time.Millisecond
+				stream.delay = stream.retryDelay
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// -----------------------------------------------------------------------------
+
+// connUsage records how the connection of a request attempt was used.
+type connUsage struct {
+	mtx         sync.Mutex
+	conn        *sourceConn
+	reusedIdle  bool
+	wrote       bool
+	gotResponse bool
+}
+
+// -----------------------------------------------------------------------------
+
+// SetRetryStaleConns enables retrying once, on the same source, the requests that fail because the source closed
+// an idle connection right when it was reused, a common situation behind cloud load balancers with short idle
+// timeouts. The retry is only done if no response was received and the request is idempotent or was not completely
+// sent. The idle connections to the source are closed before the retry, so it uses a new one, and the failure does
+// not count toward the MaxFails limit of the source. It must be called before executing requests.
+func (c *HttpClient) SetRetryStaleConns(enable bool) {
+	c.retryStaleConns = enable
+}
+
+// -----------------------------------------------------------------------------
+
+// withConnUsageTrace returns a copy of the context that records the connection usage of the request if stale
+// connections are retried.
+func (c *HttpClient) withConnUsageTrace(ctx context.Context) (context.Context, *connUsage) {
+	if !c.retryStaleConns {
+		return ctx, nil
+	}
+
+	cu := &connUsage{}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			sc := unwrapSourceConn(info.Conn)
+			if sc != nil {
+				atomic.StoreInt32(&sc.idle, 0)
+			}
+
+			cu.mtx.Lock()
+			cu.conn = sc
+			cu.reusedIdle = info.Reused && info.WasIdle
+			cu.mtx.Unlock()
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				cu.mtx.Lock()
+				cu.wrote = true
+				cu.mtx.Unlock()
+			}
+		},
+		GotFirstResponseByte: func() {
+			cu.mtx.Lock()
+			cu.gotResponse = true
+			cu.mtx.Unlock()
+		},
+		PutIdleConn: func(err error) {
+			cu.mtx.Lock()
+			sc := cu.conn
+			cu.mtx.Unlock()
+
+			if err == nil && sc != nil {
+				atomic.StoreInt32(&sc.idle, 1)
+			}
+		},
+	}), cu
+}
+
+// isStale returns true if the request failed because the reused idle connection was closed by the source before
+// it got the request.
+func (cu *connUsage) isStale(err error, isIdempotent bool) bool {
+	if cu == nil || err == nil {
+		return false
+	}
+
+	cu.mtx.Lock()
+	defer cu.mtx.Unlock()
+
+	return cu.reusedIdle && !cu.gotResponse && (isIdempotent || !cu.wrote) && isClosedConnError(err)
+}
+
+// closeIdleConns closes the idle connections open to the source.
+func (src *Source) closeIdleConns() {
+	// Lock access
+	src.connsMtx.Lock()
+	conns := make([]*sourceConn, 0, len(src.conns))
+	for sc := range src.conns {
+		if atomic.LoadInt32(&sc.idle) != 0 {
+			conns = append(conns, sc)
+		}
+	}
+	src.connsMtx.Unlock()
+
+	for _, sc := range conns {
+		_ = sc.Close()
+	}
+}
+
+func isClosedConnError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) || strings.Contains(err.Error(), "server closed idle connection")
+}
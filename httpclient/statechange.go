@@ -0,0 +1,122 @@
+package httpclient
+
+import (
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+type stateWatcher struct {
+	mtx        sync.Mutex
+	handler    func(snapshot StateSnapshot)
+	pending    bool
+	deliverMtx sync.Mutex
+	last       []materialState
+}
+
+// materialState contains the parts of the state of a source whose change is notified.
+type materialState struct {
+	id         int
+	weight     int
+	isBackup   bool
+	isDown     bool
+	isProbing  bool
+	isDraining bool
+}
+
+// -----------------------------------------------------------------------------
+
+const (
+	stateChangeWindow = 100 * time.Millisecond
+)
+
+// -----------------------------------------------------------------------------
+
+// OnStateChange sets a handler to call with a snapshot of the sources when any of them goes up or down, starts or
+// stops draining, changes its weight or its backup role, or when sources are added. Changes happening within 100ms are
+// coalesced into a single call, which is made from a different goroutine, so the handler does not delay the requests.
+// Calls are never concurrent. Passing nil removes the handler.
+func (c *HttpClient) OnStateChange(handler func(snapshot StateSnapshot)) {
+	// Lock access
+	c.stateWatcher.mtx.Lock()
+	c.stateWatcher.handler = handler
+	c.stateWatcher.mtx.Unlock()
+
+	c.stateWatcher.deliverMtx.Lock()
+	c.stateWatcher.last = nil
+	if handler != nil {
+		c.stateWatcher.last = materialStateOf(c.StateSnapshot())
+	}
+	c.stateWatcher.deliverMtx.Unlock()
+}
+
+// -----------------------------------------------------------------------------
+
+// stateChanged schedules a call to the state change handler, if any, once the coalescing window expires.
+func (c *HttpClient) stateChanged() {
+	w := &c.stateWatcher
+
+	// Lock access
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.handler == nil || w.pending {
+		return
+	}
+	w.pending = true
+	time.AfterFunc(stateChangeWindow, c.deliverStateChange)
+}
+
+// deliverStateChange calls the state change handler if the material state of the sources changed since the last call.
+func (c *HttpClient) deliverStateChange() {
+	w := &c.stateWatcher
+
+	// Lock access
+	w.mtx.Lock()
+	w.pending = false
+	handler := w.handler
+	w.mtx.Unlock()
+
+	if handler == nil {
+		return
+	}
+
+	w.deliverMtx.Lock()
+	defer w.deliverMtx.Unlock()
+
+	snapshot := c.StateSnapshot()
+	current := materialStateOf(snapshot)
+	if isSameMaterialState(current, w.last) {
+		return
+	}
+	w.last = current
+	handler(snapshot)
+}
+
+func materialStateOf(snapshot StateSnapshot) []materialState {
+	states := make([]materialState, 0, len(snapshot.Sources))
+	for _, ss := range snapshot.Sources {
+		states = append(states, materialState{
+			id:         ss.ID,
+			weight:     ss.Weight,
+			isBackup:   ss.IsBackup,
+			isDown:     ss.IsDown,
+			isProbing:  ss.IsProbing,
+			isDraining: ss.IsDraining,
+		})
+	}
+	return states
+}
+
+func isSameMaterialState(a []materialState, b []materialState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// RequestTimings contains the timing breakdown of a request attempt. Phases that did not happen, like DNS resolution
+// or connecting when a connection is reused, have a zero duration.
+type RequestTimings struct {
+	// SourceID is the id of the source the attempt was sent to.
+	SourceID int
+	// DNS is the time spent resolving the source hostname.
+	DNS time.Duration
+	// Connect is the time spent establishing the TCP connection.
+	Connect time.Duration
+	// TLS is the time spent on the TLS handshake.
+	TLS time.Duration
+	// TTFB is the time elapsed since the attempt started until the first response byte was received.
+	TTFB time.Duration
+	// Total is the time elapsed since the attempt started until the response headers were received or it failed.
+	Total time.Duration
+	// ConnReused indicates if an idle connection was reused.
+	ConnReused bool
+}
+
+type timingsRecorder struct {
+	mtx          sync.Mutex
+	timings      RequestTimings
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+}
+
+// -----------------------------------------------------------------------------
+
+func newTimingsRecorder(sourceID int) *timingsRecorder {
+	return &timingsRecorder{
+		timings: RequestTimings{
+			SourceID: sourceID,
+		},
+		start: time.Now(),
+	}
+}
+
+// withTrace returns a copy of the context that records the attempt timings.
+func (r *timingsRecorder) withTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(_ httptrace.DNSStartInfo) {
+			r.mtx.Lock()
+			r.dnsStart = time.Now()
+			r.mtx.Unlock()
+		},
+		DNSDone: func(_ httptrace.DNSDoneInfo) {
+			r.mtx.Lock()
+			r.timings.DNS = time.Since(r.dnsStart)
+			r.mtx.Unlock()
+		},
+		ConnectStart: func(_, _ string) {
+			r.mtx.Lock()
+			r.connectStart = time.Now()
+			r.mtx.Unlock()
+		},
+		ConnectDone: func(_, _ string, _ error) {
+			r.mtx.Lock()
+			r.timings.Connect = time.Since(r.connectStart)
+			r.mtx.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			r.mtx.Lock()
+			r.tlsStart = time.Now()
+			r.mtx.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, _ error) {
+			r.mtx.Lock()
+			r.timings.TLS = time.Since(r.tlsStart)
+			r.mtx.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.mtx.Lock()
+			r.timings.ConnReused = info.Reused
+			r.mtx.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			r.mtx.Lock()
+			r.timings.TTFB = time.Since(r.start)
+			r.mtx.Unlock()
+		},
+	})
+}
+
+// finish returns the recorded timings.
+func (r *timingsRecorder) finish() RequestTimings {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.timings.Total = time.Since(r.start)
+	return r.timings
+}
@@ -0,0 +1,40 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+// -----------------------------------------------------------------------------
+
+// ErrTLSCertificate is matched by errors caused by the certificate of a source failing verification, for e.g.
+// because it expired, it was issued for another host or its authority is not trusted, or by a source not speaking TLS.
+// As these are configuration problems, the failures do not count toward the MaxFails limit of the source and the
+// request is not retried, even if the callback asks for it. A TLSErrorEvent is also raised.
+var ErrTLSCertificate = errors.New("tls certificate error")
+
+// -----------------------------------------------------------------------------
+
+const (
+	errTLSCertificate = "source tls certificate rejected, check the source certificate and the trusted authorities"
+)
+
+// -----------------------------------------------------------------------------
+
+func (c *HttpClient) newTLSError(wrappedErr error, url string) *Error {
+	err := c.newError(wrappedErr, errTLSCertificate, url, 0)
+	err.errType = errorTypeIsTLS
+	return err
+}
+
+// isTLSCertificateError returns true if the transport error is caused by the certificate verification or the
+// source not speaking TLS.
+func isTLSCertificateError(err error) bool {
+	var invalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var recordErr tls.RecordHeaderError
+	return errors.As(err, &invalidErr) || errors.As(err, &hostnameErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &recordErr)
+}
@@ -0,0 +1,92 @@
+package httpclient
+
+// -----------------------------------------------------------------------------
+
+const (
+	// SkipReasonDown indicates the source was offline.
+	SkipReasonDown = "down"
+	// SkipReasonProbing indicates the source was waiting for a health check on warmup mode.
+	SkipReasonProbing = "probing"
+	// SkipReasonExcluded indicates the source was excluded by the request or already attempted.
+	SkipReasonExcluded = "excluded"
+	// SkipReasonDraining indicates the source was being drained.
+	SkipReasonDraining = "draining"
+	// SkipReasonBusy indicates the source reached its MaxConcurrent limit.
+	SkipReasonBusy = "busy"
+	// SkipReasonBreaker indicates the external breaker of the source did not allow the request.
+	SkipReasonBreaker = "breaker"
+	// SkipReasonInactiveGroup indicates the source does not belong to the active group.
+	SkipReasonInactiveGroup = "inactive-group"
+)
+
+// -----------------------------------------------------------------------------
+
+// SelectionAttempt describes how the source of a request attempt was selected.
+type SelectionAttempt struct {
+	// SourceID is the identifier of the selected source, or zero if none was available.
+	SourceID int
+	// BaseURL is the base url of the selected source.
+	BaseURL string
+	// Weight is the weight of the selected source.
+	Weight int
+	// Skipped contains the sources that were not eligible or were rejected while looking for the selected one.
+	Skipped []SkippedSource
+	// Err is the result of the attempt.
+	Err error
+}
+
+// SkippedSource contains a source skipped during selection and the reason, one of the SkipReason constants.
+type SkippedSource struct {
+	SourceID int
+	BaseURL  string
+	Reason   string
+}
+
+// -----------------------------------------------------------------------------
+
+// TraceSelection enables recording how the source of each attempt was selected and its outcome. The trace is
+// available through the SelectionTrace method once executed. It is disabled by default due to its overhead.
+func (req *Request) TraceSelection() *Request {
+	req.traceSelection = true
+	return req
+}
+
+// SelectionTrace returns the selection details of each executed attempt if TraceSelection was called.
+func (req *Request) SelectionTrace() []SelectionAttempt {
+	return req.selectionTrace
+}
+
+// -----------------------------------------------------------------------------
+
+// addSkipped records a skipped source once. It is called while the load balancer lock is held.
+func (sa *SelectionAttempt) addSkipped(src *Source, reason string) {
+	if sa == nil {
+		return
+	}
+	for idx := range sa.Skipped {
+		if sa.Skipped[idx].SourceID == src.ID() {
+			return
+		}
+	}
+	sa.Skipped = append(sa.Skipped, SkippedSource{
+		SourceID: src.ID(),
+		BaseURL:  src.BaseURL(),
+		Reason:   reason,
+	})
+}
+
+// finish records the selected source and the offline ones, which are not evaluated during selection.
+func (sa *SelectionAttempt) finish(selected *Source, sources []*Source) {
+	if selected != nil {
+		sa.SourceID = selected.ID()
+		sa.BaseURL = selected.BaseURL()
+		sa.Weight = selected.srv.Weight()
+	}
+	for _, src := range sources {
+		if src.srv.IsProbing() {
+			sa.addSkipped(src, SkipReasonProbing)
+		} else if src.srv.IsDown() {
+			sa.addSkipped(src, SkipReasonDown)
+		}
+	}
+}
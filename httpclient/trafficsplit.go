@@ -0,0 +1,109 @@
+package httpclient
+
+import (
+	"errors"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+type trafficSplit struct {
+	mtx    sync.Mutex
+	shares []trafficShare
+	total  float64
+}
+
+type trafficShare struct {
+	src     *Source
+	percent float64
+	served  float64
+}
+
+// -----------------------------------------------------------------------------
+
+// SetTrafficSplit sends an exact percentage of the requests to the sources with the given base urls regardless of
+// their weights, for e.g. to send 5% of the traffic to a canary. The remaining requests are balanced among the rest of
+// sources as usual. If the chosen source is not available, the request is sent to any other source. Percentages must
+// not be negative and must not exceed 100 in total. Passing an empty map removes the split. It is not used with a
+// custom selector.
+func (c *HttpClient) SetTrafficSplit(split map[string]float64) error {
+	if len(split) == 0 {
+		c.trafficSplit.Store((*trafficSplit)(nil))
+		return nil
+	}
+
+	ts := trafficSplit{
+		shares: make([]trafficShare, 0, len(split)),
+	}
+	sum := float64(0)
+	for baseURL, percent := range split {
+		if !(percent >= 0) {
+			return errors.New("invalid parameter")
+		}
+		src := c.sourceByURL(baseURL)
+		if src == nil {
+			return errSourceNotFound
+		}
+		ts.shares = append(ts.shares, trafficShare{
+			src:     src,
+			percent: percent,
+		})
+		sum += percent
+	}
+	if sum > 100 {
+		return errors.New("invalid parameter")
+	}
+
+	c.trafficSplit.Store(&ts)
+
+	// Done
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+func (c *HttpClient) loadTrafficSplit() *trafficSplit {
+	ts, _ := c.trafficSplit.Load().(*trafficSplit)
+	return ts
+}
+
+// next returns the source that must receive the next request, or nil if it belongs to the remainder. The source with
+// the largest deficit with respect to its share is chosen, so the shares are met exactly over time.
+func (ts *trafficSplit) next() *Source {
+	// Lock access
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+
+	ts.total += 1
+
+	var chosen *trafficShare
+	remainderPercent := float64(100)
+	remainderServed := ts.total - 1
+	maxDeficit := float64(0)
+	for idx := range ts.shares {
+		share := &ts.shares[idx]
+
+		deficit := share.percent/100*ts.total - share.served
+		if chosen == nil || deficit > maxDeficit {
+			chosen = share
+			maxDeficit = deficit
+		}
+		remainderPercent -= share.percent
+		remainderServed -= share.served
+	}
+	if remainderPercent/100*ts.total-remainderServed > maxDeficit {
+		return nil
+	}
+
+	chosen.served += 1
+	return chosen.src
+}
+
+func (ts *trafficSplit) has(src *Source) bool {
+	for idx := range ts.shares {
+		if ts.shares[idx].src == src {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package httpclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// -----------------------------------------------------------------------------
+
+// HTTPStatusError is returned by ExecTyped when the final response has a non-2xx status code.
+type HTTPStatusError struct {
+	// StatusCode is the status code of the response.
+	StatusCode int
+	// URL is the full url of the request.
+	URL string
+	// Body contains the beginning of the response body, up to 512 bytes.
+	Body []byte
+}
+
+// -----------------------------------------------------------------------------
+
+const (
+	statusErrorBodySize = 512
+)
+
+// -----------------------------------------------------------------------------
+
+// ExecTyped executes the request and decodes the JSON body of a 2xx response into a value of type T. It replaces the
+// request callback with one that applies the default classification: transport errors and 5xx responses are retried
+// on the next source if the request is idempotent or was not sent, and 5xx responses count as source failures, both
+// subject to the client StatusErrorPolicy. Canceled and timed out requests are never retried and, unless MaxAttempts
+// is set, each source is attempted once at most. Non-2xx responses are returned as an *HTTPStatusError. The response
+// body is always closed.
+func ExecTyped[T any](req *Request) (T, error) {
+	var result T
+
+	isIdempotent := isIdempotentMethod(req.method)
+	policy := req.client.statusErrorPolicy
+	if req.maxAttempts == 0 {
+		req.MaxAttempts(req.client.SourcesCount())
+	}
+
+	req.Callback(func(ctx context.Context, res Response) error {
+		if err := res.Err(); err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrCanceled) || errors.Is(err, ErrTimeout) {
+				return err
+			}
+			if isIdempotent || res.RequestNotSent() {
+				res.RetryOnNextServer()
+			}
+			return err
+		}
+
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			if res.StatusCode >= 500 {
+				if !policy.NoMarkDown {
+					res.SetOffline()
+				}
+				if !policy.NoRetry && isIdempotent {
+					res.RetryOnNextServer()
+				}
+			}
+
+			statusErr := &HTTPStatusError{
+				StatusCode: res.StatusCode,
+				URL:        res.URL(),
+			}
+			if res.Body != nil {
+				statusErr.Body, _ = io.ReadAll(io.LimitReader(res.Body, statusErrorBodySize))
+			}
+			return statusErr
+		}
+
+		if res.Body == nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		// Start with a zero value on each attempt
+		var value T
+		err := json.NewDecoder(res.Body).Decode(&value)
+		if err != nil {
+			return err
+		}
+		result = value
+
+		// Done
+		return nil
+	})
+	err := req.Exec()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	// Done
+	return result, nil
+}
+
+// -----------------------------------------------------------------------------
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %v [URL=%v]", e.StatusCode, e.URL)
+}
@@ -0,0 +1,171 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	errUpgradeFailed = "failed to upgrade the connection"
+)
+
+// -----------------------------------------------------------------------------
+
+type upgradedConn struct {
+	io.ReadWriteCloser
+	conn   net.Conn
+	src    *Source
+	closed int32
+}
+
+// -----------------------------------------------------------------------------
+
+// Dial establishes an upgraded connection, like a WebSocket, with the next available source and returns the raw
+// bidirectional connection along with the handshake response. The header must contain the Upgrade header and any
+// other header required by the protocol. The Connection header is set automatically.
+//
+// If the handshake fails, a source not tried yet is used, unless the handshake was rejected with a 4xx response.
+// Transport errors and 5xx responses also count as source failures. The connection stays bound to the selected source,
+// which can be obtained from the response request url, and is counted as in-flight until closed. On failure, the last
+// handshake response, if any, is returned with its body closed.
+func (c *HttpClient) Dial(ctx context.Context, path string, header http.Header) (net.Conn, *http.Response, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if len(path) == 0 || len(header.Get("Upgrade")) == 0 {
+		return nil, nil, errors.New("invalid parameter")
+	}
+
+	var lastResp *http.Response
+	var lastErr error
+
+	attempts := c.SourcesCount()
+	if attempts == 0 {
+		attempts = 1
+	}
+	excluded := make([]*Source, 0, attempts)
+	for attempt := 0; attempt < attempts; attempt++ {
+		srv, err := c.nextServerFor(requestIntentAny, excluded)
+		if err != nil {
+			if lastErr == nil {
+				lastErr = c.newError(err, errNoAvailableServer, path, 0)
+			}
+			break
+		}
+		src := srv.UserData().(*Source)
+		excluded = append(excluded, src)
+		fullUrl := src.BaseURL() + path
+
+		httpReq, err := c.newHttpRequest(&Request{method: "GET", url: path, headers: header}, src, nil)
+		if err != nil {
+			return nil, nil, c.newError(err, errUnableToExecuteRequest, fullUrl, 0)
+		}
+		httpReq.Header.Set("Connection", "Upgrade")
+		httpReq.Close = false
+
+		// Capture the underlying connection to expose its addresses and deadlines
+		var netConn net.Conn
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				netConn = info.Conn
+			},
+		}
+		reqCtx := httptrace.WithClientTrace(withSource(ctx, src), trace)
+
+		atomic.AddInt32(&src.inFlight, 1)
+		if attempt > 0 {
+			atomic.AddInt64(&src.retries, 1)
+		}
+		resp, err := c.transportFor(src).RoundTrip(httpReq.WithContext(reqCtx))
+		if err == nil && resp.StatusCode == http.StatusSwitchingProtocols {
+			if rwc, ok := resp.Body.(io.ReadWriteCloser); ok && netConn != nil {
+				c.setSourceLastError(src, nil)
+				c.raiseRequestEvent(srv, nil)
+				src.reportSuccess()
+
+				// Done
+				return &upgradedConn{
+					ReadWriteCloser: rwc,
+					conn:            netConn,
+					src:             src,
+				}, resp, nil
+			}
+		}
+		src.releaseSlot()
+
+		// Handshake failed, check if the source must be blamed
+		upstreamOffline := false
+		isErrorStatus := false
+		isRejected := false
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ErrCanceled
+			}
+			if isProxyConnectError(reqCtx, err) {
+				err = c.newProxyError(err, fullUrl)
+			} else {
+				upstreamOffline = true
+				err = c.newError(err, errUpgradeFailed, fullUrl, 0)
+			}
+		} else {
+			_ = resp.Body.Close()
+			isErrorStatus = resp.StatusCode >= 500
+			isRejected = resp.StatusCode >= 400 && resp.StatusCode < 500
+			upstreamOffline = isErrorStatus && !c.statusErrorPolicy.NoMarkDown
+			err = c.newError(nil, errUpgradeFailed, fullUrl, resp.StatusCode)
+			lastResp = resp
+		}
+
+		c.setSourceLastError(src, err)
+		c.raiseRequestEvent(srv, err)
+		if upstreamOffline {
+			src.reportFailure()
+		}
+		lastErr = err
+
+		if isRejected || (isErrorStatus && c.statusErrorPolicy.NoRetry) {
+			// Other sources would reject the handshake too
+			break
+		}
+	}
+
+	// Done
+	return nil, lastResp, lastErr
+}
+
+// -----------------------------------------------------------------------------
+
+func (uc *upgradedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&uc.closed, 0, 1) {
+		uc.src.releaseSlot()
+	}
+	return uc.ReadWriteCloser.Close()
+}
+
+func (uc *upgradedConn) LocalAddr() net.Addr {
+	return uc.conn.LocalAddr()
+}
+
+func (uc *upgradedConn) RemoteAddr() net.Addr {
+	return uc.conn.RemoteAddr()
+}
+
+func (uc *upgradedConn) SetDeadline(t time.Time) error {
+	return uc.conn.SetDeadline(t)
+}
+
+func (uc *upgradedConn) SetReadDeadline(t time.Time) error {
+	return uc.conn.SetReadDeadline(t)
+}
+
+func (uc *upgradedConn) SetWriteDeadline(t time.Time) error {
+	return uc.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,73 @@
+package httpclient
+
+import (
+	"github.com/randlabs/go-loadbalancer/v2"
+)
+
+// -----------------------------------------------------------------------------
+
+// RetryInSameZone makes the retries prefer the sources in the same zone as the first source attempted, set with the
+// Zone source option, so failover stays local while there are sources available in that zone. Once all of them were
+// attempted, the request is retried on the sources of other zones.
+func (req *Request) RetryInSameZone() *Request {
+	req.zoneAffinity = true
+	return req
+}
+
+// -----------------------------------------------------------------------------
+
+// nextServerInZone works like nextServerFor but prefers the sources in the given zone, if any, and, if the trace is not
+// nil, records the sources skipped and why. The external breakers may count the requests they allow, so only the one
+// of the selected source is asked and, if it refuses, another source is selected.
+func (c *HttpClient) nextServerInZone(intent int, excluded []*Source, zone string, trace *SelectionAttempt) (
+	*loadbalancer.Server, error,
+) {
+	for {
+		srv, err := c.selectInZone(intent, excluded, zone, trace)
+		if err != nil {
+			return nil, err
+		}
+		src := srv.UserData().(*Source)
+		if src.isAllowedByBreaker() {
+			return srv, nil
+		}
+		trace.addSkipped(src, SkipReasonBreaker)
+		excluded = append(excluded[:len(excluded):len(excluded)], src)
+	}
+}
+
+// selectInZone works like selectSource but prefers the sources in the given zone, if any.
+func (c *HttpClient) selectInZone(intent int, excluded []*Source, zone string, trace *SelectionAttempt) (
+	*loadbalancer.Server, error,
+) {
+	if len(zone) > 0 {
+		// Exclude the sources in other zones
+		zoneExcluded := excluded[:len(excluded):len(excluded)]
+		for _, src := range c.sourceList() {
+			if src.opts.Zone != zone {
+				zoneExcluded = append(zoneExcluded, src)
+			}
+		}
+		srv, err := c.selectSource(intent, zoneExcluded, trace)
+		if err == nil {
+			return srv, nil
+		}
+		if trace != nil {
+			// Keep the sources refused by their breakers
+			*trace = SelectionAttempt{
+				Skipped: breakerSkipped(trace.Skipped),
+			}
+		}
+	}
+	return c.selectSource(intent, excluded, trace)
+}
+
+func breakerSkipped(skipped []SkippedSource) []SkippedSource {
+	var result []SkippedSource
+	for _, s := range skipped {
+		if s.Reason == SkipReasonBreaker {
+			result = append(result, s)
+		}
+	}
+	return result
+}
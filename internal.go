@@ -1,5 +1,10 @@
 package loadbalancer
 
+import (
+	"sort"
+	"time"
+)
+
 // -----------------------------------------------------------------------------
 
 func (lb *LoadBalancer) raiseEvent(eventType int, server *Server) {
@@ -10,3 +15,181 @@ func (lb *LoadBalancer) raiseEvent(eventType int, server *Server) {
 	lb.eventHandlerMtx.RUnlock()
 }
 
+
+// now returns the current time of the load balancer clock. The clock is only changed before adding servers, so it
+// can be read without the lock.
+func (lb *LoadBalancer) now() time.Time {
+	if lb.clock != nil {
+		return lb.clock.Now()
+	}
+	return time.Now()
+}
+
+// anyBackupOrder is used as the backup order when all the backups must be considered.
+const anyBackupOrder = -1
+
+var anyBackupOrders = []int{anyBackupOrder}
+
+func isValidFailPolicy(maxFails int, failTimeout time.Duration) bool {
+	if maxFails > 0 {
+		return failTimeout > time.Duration(0)
+	}
+	return maxFails == 0
+}
+
+// NOTE: The following methods must be called while the load balancer lock is held.
+
+func (lb *LoadBalancer) serverAt(idx int) *Server {
+	if idx < len(lb.primaryGroup.srvList) {
+		return lb.primaryGroup.srvList[idx]
+	}
+	return lb.backupGroup.srvList[idx-len(lb.primaryGroup.srvList)]
+}
+
+// nextRecoveryIn returns the time left for the first offline primary server to become online again, or false if no
+// server will become online by itself.
+func (lb *LoadBalancer) nextRecoveryIn(now time.Time) (time.Duration, bool) {
+	toWait := time.Duration(-1)
+	for _, srv := range lb.primaryGroup.srvList {
+		// Only consider offline servers
+		if srv.down() {
+			diff := srv.failTimestamp.Sub(now)
+			if diff <= 0 {
+				// This server will immediately become online
+				return 0, true
+			}
+
+			if toWait < 0 || diff < toWait {
+				toWait = diff
+			}
+		}
+	}
+	if toWait < 0 {
+		return 0, false
+	}
+	return toWait, true
+}
+
+func (lb *LoadBalancer) isAccepted(srv *Server, filter SelectFilter) bool {
+	return (lb.selectFilter == nil || lb.selectFilter(srv)) && (filter == nil || filter(srv))
+}
+
+func (lb *LoadBalancer) weightOf(srv *Server) int {
+	if lb.ignoreWeights {
+		return 1
+	}
+	return srv.opts.Weight
+}
+
+func (lb *LoadBalancer) backupsActive() bool {
+	return lb.backupsEngaged
+}
+
+// updateBackupsEngaged engages the backup servers when the online primary servers are below the minimum and, once
+// engaged, only releases them when the online primary servers reach the minimum plus the hysteresis margin for, at
+// least, the hysteresis hold time.
+func (lb *LoadBalancer) updateBackupsEngaged(now time.Time) {
+	primaryOnlineCount := int(lb.primaryOnlineCount)
+	if primaryOnlineCount == 0 || primaryOnlineCount < lb.minPrimary {
+		lb.backupsEngaged = true
+		lb.backupsRecoveredSince = time.Time{}
+		return
+	}
+	if !lb.backupsEngaged {
+		return
+	}
+
+	if primaryOnlineCount < lb.minPrimary+lb.hysteresisMargin {
+		lb.backupsRecoveredSince = time.Time{}
+		return
+	}
+	if lb.backupsRecoveredSince.IsZero() {
+		lb.backupsRecoveredSince = now
+	}
+	if now.Sub(lb.backupsRecoveredSince) >= lb.hysteresisHold {
+		lb.backupsEngaged = false
+		lb.backupsRecoveredSince = time.Time{}
+	}
+}
+
+func (lb *LoadBalancer) isEligible(srv *Server) bool {
+	if srv.isProbing {
+		return false
+	}
+	if srv.opts.IsBackup {
+		return lb.backupsActive()
+	}
+	return !srv.down()
+}
+
+// addBackupOrder keeps the sorted list of distinct backup orders.
+func (lb *LoadBalancer) addBackupOrder(order int) {
+	idx := sort.SearchInts(lb.backupOrders, order)
+	if idx < len(lb.backupOrders) && lb.backupOrders[idx] == order {
+		return
+	}
+	lb.backupOrders = append(lb.backupOrders, 0)
+	copy(lb.backupOrders[idx+1:], lb.backupOrders[idx:])
+	lb.backupOrders[idx] = order
+}
+
+// rebuildBackupOrders recreates the list of backup orders from the current backup servers.
+func (lb *LoadBalancer) rebuildBackupOrders() {
+	lb.backupOrders = lb.backupOrders[:0]
+	for _, srv := range lb.backupGroup.srvList {
+		lb.addBackupOrder(srv.opts.BackupOrder)
+	}
+}
+
+// cursorServer returns the server the round-robin cursor points to or nil if there are no servers.
+func (lb *LoadBalancer) cursorServer() *Server {
+	if len(lb.primaryGroup.srvList)+len(lb.backupGroup.srvList) == 0 {
+		return nil
+	}
+	return lb.serverAt(lb.currServerIdx)
+}
+
+// setCursorServer moves the round-robin cursor to the given server, keeping the current weight.
+func (lb *LoadBalancer) setCursorServer(srv *Server) {
+	if srv == nil {
+		return
+	}
+	if srv.opts.IsBackup {
+		lb.currServerIdx = len(lb.primaryGroup.srvList) + srv.index
+	} else {
+		lb.currServerIdx = srv.index
+	}
+}
+
+// selectionOrders returns the backup orders to try, from the preferred one, when selecting a server.
+func (lb *LoadBalancer) selectionOrders() []int {
+	if len(lb.backupOrders) <= 1 || !lb.backupsActive() {
+		return anyBackupOrders
+	}
+	return lb.backupOrders
+}
+
+// remove takes the server out of the group and updates the index of the following ones.
+func (group *ServerGroup) remove(srv *Server) {
+	group.srvList = append(group.srvList[:srv.index], group.srvList[srv.index+1:]...)
+	for idx := srv.index; idx < len(group.srvList); idx++ {
+		group.srvList[idx].index = idx
+	}
+}
+
+func isExcludedServer(srv *Server, excluded []*Server) bool {
+	for _, excludedSrv := range excluded {
+		if srv == excludedSrv {
+			return true
+		}
+	}
+	return false
+}
+
+func isInBackupOrder(srv *Server, order int) bool {
+	return !srv.opts.IsBackup || order == anyBackupOrder || srv.opts.BackupOrder == order
+}
+
+func (lb *LoadBalancer) hasEligible() bool {
+	return lb.primaryOnlineCount > 0 || (lb.backupOnlineCount > 0 && lb.backupsActive())
+}
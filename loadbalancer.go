@@ -2,7 +2,9 @@ package loadbalancer
 
 import (
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,9 +15,81 @@ type LoadBalancer struct {
 	mtx                sync.Mutex
 	primaryGroup       ServerGroup
 	backupGroup        ServerGroup
-	primaryOnlineCount int
+	primaryOnlineCount int32 // NOTE: Online counters are written atomically while the lock is held, so they can be
+	backupOnlineCount  int32 //       read without it
+	minPrimary         int
+	hysteresisMargin   int
+	hysteresisHold     time.Duration
+	warmup             bool
+	ignoreWeights      bool
+	selectFilter       SelectFilter
+	clock              Clock
+	currServerIdx      int
+	currServerWeight   int
+	stickyPrimary      bool
+	stickyServer       *Server
+	backupOrders       []int
+
+	backupsEngaged        bool
+	backupsRecoveredSince time.Time
+
 	eventHandlerMtx    sync.RWMutex
 	eventHandler       EventHandler
+
+	healthCheck tcpHealthChecker
+}
+
+// ServerState contains a point-in-time copy of the state of a server.
+type ServerState struct {
+	Server      *Server
+	Weight      int
+	IsBackup    bool
+	IsDown      bool
+	IsProbing   bool
+	FailCounter int
+	// RecoversIn indicates the time left for an offline server to become online again.
+	RecoversIn time.Duration
+}
+
+// NoServersError is returned by TryNext when no server is available.
+type NoServersError struct {
+	// RetryAfter is the time left for the first offline server to become online again. It is zero if no server
+	// will become online by itself, for e.g. if they are being probed.
+	RetryAfter time.Duration
+}
+
+// RoundRobinState is the position of the weighted round-robin cursor.
+type RoundRobinState struct {
+	// Index is the position of the current server. Primary servers come first, then backup servers, both in the
+	// order they were added.
+	Index int `json:"index"`
+	// Weight is the amount of times the current server was selected in the current turn.
+	Weight int `json:"weight"`
+}
+
+// SelectFilter is called with each candidate server during selection. Returning false skips the server without
+// marking it as offline. It is called while the load balancer lock is held, so it must not call load balancer or
+// server methods.
+type SelectFilter func(srv *Server) bool
+
+// SelectCriteria contains the routing hints applied by NextForRequest.
+type SelectCriteria struct {
+	// Filter rejects the servers that cannot handle the request. It is applied in addition to the one set with
+	// SetSelectFilter.
+	Filter SelectFilter
+	// Prefer is a list of filters tried in order. The server is selected among the ones accepted by the first filter
+	// that has an available server or among any accepted server if none has.
+	Prefer []SelectFilter
+	// Exclude is a list of servers to skip, for e.g. the ones already tried.
+	Exclude []*Server
+	// AllowExcluded makes the excluded servers selectable if no other server is available.
+	AllowExcluded bool
+}
+
+// Clock provides the current time to the load balancer. It allows tests to control the time-based logic, like fail
+// timeouts and backup hysteresis, without waiting.
+type Clock interface {
+	Now() time.Time
 }
 
 // EventHandler is a handler to call when a server is set offline or online.
@@ -28,6 +102,16 @@ const (
 	ServerDownEvent
 )
 
+const (
+	waitPollInterval = 100 * time.Millisecond
+)
+
+// ErrNoServersAvailable is matched by NoServersError errors.
+var ErrNoServersAvailable = errors.New("no servers available")
+
+// ErrAllVetoed is returned by TryNext when all the available servers were rejected by the select filter.
+var ErrAllVetoed = errors.New("all servers vetoed by the select filter")
+
 // -----------------------------------------------------------------------------
 
 // Create creates a new load balancer manager
@@ -35,10 +119,10 @@ func Create() *LoadBalancer {
 	lb := LoadBalancer{
 		mtx: sync.Mutex{},
 		primaryGroup: ServerGroup{
-			srvList: make([]Server, 0),
+			srvList: make([]*Server, 0),
 		},
 		backupGroup: ServerGroup{
-			srvList: make([]Server, 0),
+			srvList: make([]*Server, 0),
 		},
 		eventHandlerMtx: sync.RWMutex{},
 	}
@@ -52,27 +136,153 @@ func (lb *LoadBalancer) SetEventHandler(handler EventHandler) {
 	lb.eventHandlerMtx.Unlock()
 }
 
+// SetMinPrimary sets the minimum amount of online primary servers below which backup servers are also used. When
+// backups are active, they are selected along with the online primary servers in the same weighted round-robin.
+//
+// Eligibility rules:
+//
+//	| Server  | State   | Online primaries             | Eligible |
+//	|---------|---------|------------------------------|----------|
+//	| Primary | Online  | any                          | yes      |
+//	| Primary | Offline | any                          | no       |
+//	| Backup  | -       | zero                         | yes      |
+//	| Backup  | -       | less than minPrimary         | yes      |
+//	| Backup  | -       | greater or equal minPrimary  | no       |
+//
+// The default value of zero only activates backup servers when all primary servers are offline. See
+// SetBackupHysteresis to delay releasing the backup servers.
+func (lb *LoadBalancer) SetMinPrimary(minPrimary int) error {
+	if minPrimary < 0 {
+		return errors.New("invalid parameter")
+	}
+	lb.mtx.Lock()
+	lb.minPrimary = minPrimary
+	lb.mtx.Unlock()
+	return nil
+}
+
+// SetBackupHysteresis sets the hysteresis applied to release the backup servers. Once engaged, backup servers are kept
+// in use until the online primary servers reach the minimum set with SetMinPrimary plus the margin, and stay so for,
+// at least, the hold time. This avoids backups rapidly engaging and disengaging when primary servers are flapping.
+// By default, both are zero, so backups are released as soon as enough primary servers are online.
+func (lb *LoadBalancer) SetBackupHysteresis(margin int, hold time.Duration) error {
+	if margin < 0 || hold < 0 {
+		return errors.New("invalid parameter")
+	}
+	lb.mtx.Lock()
+	lb.hysteresisMargin = margin
+	lb.hysteresisHold = hold
+	lb.mtx.Unlock()
+	return nil
+}
+
+// SetStickyPrimary enables or disables the sticky mode. On sticky mode, Next returns the same server repeatedly until
+// it is marked as down, then a new server is selected and pinned.
+func (lb *LoadBalancer) SetStickyPrimary(enable bool) {
+	lb.mtx.Lock()
+	lb.stickyPrimary = enable
+	lb.stickyServer = nil
+	lb.mtx.Unlock()
+}
+
+// Unstick releases the pinned server so the next call to Next selects a new one.
+func (lb *LoadBalancer) Unstick() {
+	lb.mtx.Lock()
+	lb.stickyServer = nil
+	lb.mtx.Unlock()
+}
+
+// RecoverAll puts all the primary servers marked as down online again immediately, including the ones put offline
+// with SetOfflineFor, instead of waiting for their fail timeout to expire, and resets the failure counters and circuit
+// breakers of the others. A ServerUpEvent is raised for each recovered server. Servers being probed on warmup mode are
+// not affected.
+func (lb *LoadBalancer) RecoverAll() {
+	notifyUp := make([]*Server, 0)
+
+	// Lock access
+	lb.mtx.Lock()
+
+	now := lb.now()
+	for _, srv := range lb.primaryGroup.srvList {
+		if srv.isProbing {
+			continue
+		}
+		if srv.down() {
+			srv.recover(now)
+			notifyUp = append(notifyUp, srv)
+		} else if srv.isHalfOpen {
+			srv.stateSince = now
+		}
+		srv.isHalfOpen = false
+		srv.failCounter = 0
+		srv.trialCount = 0
+	}
+
+	// Unlock access
+	lb.mtx.Unlock()
+
+	// Call event callback
+	for _, srv := range notifyUp {
+		lb.raiseEvent(ServerUpEvent, srv)
+	}
+}
+
+// SetWarmup enables or disables the warmup mode. On warmup mode, newly added servers start in a probing state and
+// are not selected until they are marked as online by calling SetOnline.
+func (lb *LoadBalancer) SetWarmup(enable bool) {
+	lb.mtx.Lock()
+	lb.warmup = enable
+	lb.mtx.Unlock()
+}
+
+// SetIgnoreWeights enables or disables ignoring the server weights. When ignored, eligible servers are selected in
+// plain round-robin, so all of them receive the same amount of requests.
+func (lb *LoadBalancer) SetIgnoreWeights(ignore bool) {
+	lb.mtx.Lock()
+	lb.ignoreWeights = ignore
+	lb.currServerWeight = 0
+	lb.mtx.Unlock()
+}
+
+// SetClock sets the clock used to get the current time. Passing nil restores the system clock. It must be called
+// before adding servers.
+func (lb *LoadBalancer) SetClock(clock Clock) {
+	lb.mtx.Lock()
+	lb.clock = clock
+	lb.mtx.Unlock()
+}
+
+// SetSelectFilter sets a filter to veto the candidate servers during selection. Passing nil removes the filter.
+func (lb *LoadBalancer) SetSelectFilter(filter SelectFilter) {
+	lb.mtx.Lock()
+	lb.selectFilter = filter
+	lb.mtx.Unlock()
+}
+
 // Add adds a new server to the list
 func (lb *LoadBalancer) Add(opts ServerOptions, userData interface{}) error {
+	_, err := lb.AddServer(opts, userData)
+	return err
+}
+
+// AddServer adds a new server to the list and returns it
+func (lb *LoadBalancer) AddServer(opts ServerOptions, userData interface{}) (*Server, error) {
 	// Check options
-	if opts.Weight < 0 {
-		return errors.New("invalid parameter")
+	if opts.Weight < 0 || opts.BackupOrder < 0 {
+		return nil, errors.New("invalid parameter")
 	}
 	if !opts.IsBackup {
-		if opts.MaxFails > 0 {
-			if opts.FailTimeout <= time.Duration(0) {
-				return errors.New("invalid parameter")
-			}
-		} else if opts.MaxFails < 0 {
-			return errors.New("invalid parameter")
+		if !isValidFailPolicy(opts.MaxFails, opts.FailTimeout) {
+			return nil, errors.New("invalid parameter")
 		}
 	}
 
 	// Create new server
-	srv := Server{
-		lb:       lb,
-		opts:     opts,
-		userData: userData,
+	srv := &Server{
+		lb:         lb,
+		opts:       opts,
+		stateSince: lb.now(),
+		userData:   userData,
 	}
 	if srv.opts.Weight == 0 {
 		srv.opts.Weight = 1
@@ -86,6 +296,12 @@ func (lb *LoadBalancer) Add(opts ServerOptions, userData interface{}) error {
 	lb.mtx.Lock()
 	defer lb.mtx.Unlock()
 
+	// On warmup mode, the server must be marked as online before being used
+	srv.isProbing = lb.warmup
+
+	// Adding a primary server shifts the position of the backup ones, so keep the cursor on the same server
+	currServer := lb.cursorServer()
+
 	if !opts.IsBackup {
 		// Set server index
 		srv.index = len(lb.primaryGroup.srvList)
@@ -94,7 +310,9 @@ func (lb *LoadBalancer) Add(opts ServerOptions, userData interface{}) error {
 		lb.primaryGroup.srvList = append(lb.primaryGroup.srvList, srv)
 
 		// Assume the server is initially online
-		lb.primaryOnlineCount += 1
+		if !srv.isProbing {
+			atomic.AddInt32(&lb.primaryOnlineCount, 1)
+		}
 
 	} else {
 		// Set server index
@@ -102,6 +320,63 @@ func (lb *LoadBalancer) Add(opts ServerOptions, userData interface{}) error {
 
 		// Add to the backup server list
 		lb.backupGroup.srvList = append(lb.backupGroup.srvList, srv)
+		lb.addBackupOrder(opts.BackupOrder)
+
+		if !srv.isProbing {
+			atomic.AddInt32(&lb.backupOnlineCount, 1)
+		}
+	}
+
+	lb.setCursorServer(currServer)
+
+	// Done
+	return srv, nil
+}
+
+// RemoveServer removes a server from the list. The round-robin cursor keeps pointing to the same server or, if the
+// removed server was the current one, moves to the next server, so the turn of the other servers is not disturbed.
+// The removed server must not be used anymore.
+func (lb *LoadBalancer) RemoveServer(srv *Server) error {
+	if srv == nil || srv.lb != lb {
+		return errors.New("invalid parameter")
+	}
+
+	// Lock access
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	if srv.isRemoved {
+		return errors.New("invalid parameter")
+	}
+
+	currServer := lb.cursorServer()
+	if currServer == srv {
+		// The server following the removed one takes its position
+		currServer = nil
+		lb.currServerWeight = 0
+	}
+
+	if !srv.opts.IsBackup {
+		lb.primaryGroup.remove(srv)
+		if !srv.isProbing && !srv.down() {
+			atomic.AddInt32(&lb.primaryOnlineCount, -1)
+		}
+	} else {
+		lb.backupGroup.remove(srv)
+		lb.rebuildBackupOrders()
+		if !srv.isProbing {
+			atomic.AddInt32(&lb.backupOnlineCount, -1)
+		}
+	}
+	srv.isRemoved = true
+	if lb.stickyServer == srv {
+		lb.stickyServer = nil
+	}
+
+	if currServer != nil {
+		lb.setCursorServer(currServer)
+	} else if lb.currServerIdx >= len(lb.primaryGroup.srvList)+len(lb.backupGroup.srvList) {
+		lb.currServerIdx = 0
 	}
 
 	// Done
@@ -110,85 +385,155 @@ func (lb *LoadBalancer) Add(opts ServerOptions, userData interface{}) error {
 
 // Next gets the next available server. It can return nil if no available server
 func (lb *LoadBalancer) Next() *Server {
+	srv, _ := lb.next(nil, false)
+	return srv
+}
+
+// NextWithFilter works like TryNext but also skips the servers rejected by the given filter, which is applied in
+// addition to the one set with SetSelectFilter. See SelectFilter for the restrictions.
+func (lb *LoadBalancer) NextWithFilter(filter SelectFilter) (*Server, error) {
+	return lb.tryNext(filter, false)
+}
+
+// NextExcluding works like Next but skips the given server, usually the previously selected one, unless it is the only
+// available server. Passing nil is the same as calling Next. Skipping a server ends its turn in the weighted
+// round-robin, so a server whose weight exceeds the sum of the weights of the other available servers receives less
+// than its share if NextExcluding is always used.
+func (lb *LoadBalancer) NextExcluding(prev *Server) *Server {
+	if prev == nil {
+		return lb.Next()
+	}
+
+	srv, _ := lb.NextForRequest(SelectCriteria{
+		Exclude:       []*Server{prev},
+		AllowExcluded: true,
+	})
+	return srv
+}
+
+// NextForRequest works like TryNext but applies all the routing hints in the given criteria. See SelectFilter for the
+// restrictions of the filters. Passes that select no server, like the ones for preferences no available server
+// matches, leave the weighted round-robin cursor untouched, so the weights are still honored.
+func (lb *LoadBalancer) NextForRequest(criteria SelectCriteria) (*Server, error) {
+	accept := func(srv *Server) bool {
+		return !isExcludedServer(srv, criteria.Exclude) && (criteria.Filter == nil || criteria.Filter(srv))
+	}
+
+	for _, prefer := range criteria.Prefer {
+		srv, _ := lb.next(func(srv *Server) bool {
+			return prefer(srv) && accept(srv)
+		}, true)
+		if srv != nil {
+			return srv, nil
+		}
+	}
+
+	allowExcluded := criteria.AllowExcluded && len(criteria.Exclude) > 0
+	srv, err := lb.tryNext(accept, allowExcluded)
+	if errors.Is(err, ErrAllVetoed) && allowExcluded {
+		// The excluded servers may be the only ones available
+		srv, err = lb.tryNext(criteria.Filter, false)
+	}
+
+	// Done
+	return srv, err
+}
+
+// next selects the next server accepted by the filter. If keepOnMiss is true and no server is selected, the cursor and
+// the pinned server are left as they were.
+func (lb *LoadBalancer) next(filter SelectFilter, keepOnMiss bool) (*Server, bool) {
 	var nextServer *Server
 
-	now := time.Now()
+	vetoed := false
+
+	now := lb.now()
 
 	notifyUp := make([]*Server, 0) // NOTE: We would use defer, but they are executed LIFO
 
 	// Lock access
 	lb.mtx.Lock()
 
+	savedServerIdx, savedServerWeight := lb.currServerIdx, lb.currServerWeight
+
 	// If all primary servers are offline, check if we can put someone up
 	if lb.primaryOnlineCount == 0 {
 		for idx := range lb.primaryGroup.srvList {
-			srv := &lb.primaryGroup.srvList[idx]
+			srv := lb.primaryGroup.srvList[idx]
 
-			if now.After(srv.failTimestamp) {
+			if srv.down() && now.After(srv.failTimestamp) {
 				// Put this server online again
-				srv.isDown = false
-				srv.failCounter = 0
-				lb.primaryOnlineCount += 1
+				srv.recover(now)
 
 				notifyUp = append(notifyUp, srv)
 			}
 		}
 	}
 
-	// If there is at least one primary server online, find the next
-	if lb.primaryOnlineCount > 0 {
-		for {
-			srv := &lb.primaryGroup.srvList[lb.primaryGroup.currServerIdx]
-
-			if srv.isDown && now.After(srv.failTimestamp) {
-				// Set this server online again
-				srv.isDown = false
-				srv.lb.primaryOnlineCount += 1
+	// Check if backup servers must be used
+	lb.updateBackupsEngaged(now)
 
-				notifyUp = append(notifyUp, srv)
-			}
+	// On sticky mode, keep using the pinned server while it is up. A backup server is only kept while backups are
+	// active.
+	if lb.stickyPrimary && lb.stickyServer != nil {
+		srv := lb.stickyServer
+		if lb.isEligible(srv) && lb.isAccepted(srv, filter) {
+			nextServer = srv
+		}
+	}
 
-			if !srv.isDown && lb.primaryGroup.currServerWeight < srv.opts.Weight {
-				// Got a server!
-				lb.primaryGroup.currServerWeight += 1
+	// If there is at least one eligible server, find the next one. Primary and backup servers share the same
+	// weighted round-robin cursor. A full pass over the servers is enough to find it unless all of them are vetoed.
+	// If backups are active, a pass is done for each backup order until a server is found.
+	if nextServer == nil && lb.hasEligible() {
+		srvCount := len(lb.primaryGroup.srvList) + len(lb.backupGroup.srvList)
+		for _, backupOrder := range lb.selectionOrders() {
+			for steps := 0; steps <= srvCount; steps++ {
+				srv := lb.serverAt(lb.currServerIdx)
 
-				// Select this server
-				nextServer = srv
-				break
-			}
+				if srv.down() && now.After(srv.failTimestamp) {
+					// Set this server online again
+					srv.recover(now)
 
-			// Advance to next server
-			lb.primaryGroup.currServerIdx += 1
-			if lb.primaryGroup.currServerIdx >= len(lb.primaryGroup.srvList) {
-				lb.primaryGroup.currServerIdx = 0
-			}
+					notifyUp = append(notifyUp, srv)
+				}
 
-			lb.primaryGroup.currServerWeight = 0
-		}
-	}
+				if lb.isEligible(srv) && isInBackupOrder(srv, backupOrder) && lb.currServerWeight < lb.weightOf(srv) {
+					if lb.isAccepted(srv, filter) {
+						// Got a server!
+						lb.currServerWeight += 1
 
-	// Look for backup servers if there is no primary available
-	if nextServer == nil && len(lb.backupGroup.srvList) > 0 {
-		for {
-			srv := &lb.backupGroup.srvList[lb.backupGroup.currServerIdx]
+						// Select this server
+						nextServer = srv
+						break
+					}
+					vetoed = true
+				}
 
-			if lb.backupGroup.currServerWeight < srv.opts.Weight {
-				// Got a server!
-				lb.backupGroup.currServerWeight += 1
+				// Advance to next server
+				lb.currServerIdx += 1
+				if lb.currServerIdx >= srvCount {
+					lb.currServerIdx = 0
+				}
 
-				// Select this server
-				nextServer = srv
+				lb.currServerWeight = 0
+			}
+			if nextServer != nil {
 				break
 			}
+		}
+	}
 
-			// Advance to next server
-			lb.backupGroup.currServerIdx += 1
-			if lb.backupGroup.currServerIdx >= len(lb.backupGroup.srvList) {
-				lb.backupGroup.currServerIdx = 0
-			}
+	if nextServer == nil && keepOnMiss {
+		// Undo the pass over the servers
+		lb.currServerIdx, lb.currServerWeight = savedServerIdx, savedServerWeight
+	} else if lb.stickyPrimary {
+		// Pin the selected server if sticky mode is enabled
+		lb.stickyServer = nextServer
+	}
 
-			lb.backupGroup.currServerWeight = 0
-		}
+	// Count the trial requests sent to recovering servers
+	if nextServer != nil && nextServer.isHalfOpen {
+		nextServer.trialCount += 1
 	}
 
 	// Unlock access
@@ -200,7 +545,31 @@ func (lb *LoadBalancer) Next() *Server {
 	}
 
 	// Done
-	return nextServer
+	return nextServer, nextServer == nil && vetoed
+}
+
+// TryNext gets the next available server. If no server is available, it returns a *NoServersError indicating how
+// long to wait before trying again, or ErrAllVetoed if all the available servers were rejected by the select filter.
+func (lb *LoadBalancer) TryNext() (*Server, error) {
+	return lb.tryNext(nil, false)
+}
+
+func (lb *LoadBalancer) tryNext(filter SelectFilter, keepOnMiss bool) (*Server, error) {
+	srv, vetoed := lb.next(filter, keepOnMiss)
+	if srv != nil {
+		return srv, nil
+	}
+	if vetoed {
+		return nil, ErrAllVetoed
+	}
+
+	lb.mtx.Lock()
+	retryAfter, _ := lb.nextRecoveryIn(lb.now())
+	lb.mtx.Unlock()
+
+	return nil, &NoServersError{
+		RetryAfter: retryAfter,
+	}
 }
 
 // WaitNext returns a channel that is fulfilled with the next available server
@@ -219,9 +588,6 @@ func (lb *LoadBalancer) WaitNext() (ch chan *Server) {
 				break
 			}
 
-			now := time.Now()
-			toWait := time.Duration(-1)
-
 			// Lock access
 			lb.mtx.Lock()
 
@@ -231,28 +597,17 @@ func (lb *LoadBalancer) WaitNext() (ch chan *Server) {
 				break
 			}
 
-			// Get the server that will become online sooner
-			srvCount := len(lb.primaryGroup.srvList)
-			for idx := 0; idx < srvCount; idx++ {
-				srv = &lb.primaryGroup.srvList[idx]
-
-				// Only consider offline servers
-				if srv.isDown {
-					diff := srv.failTimestamp.Sub(now)
-					if diff <= 0 {
-						// This server will immediately become online
-						break
-					}
-
-					if toWait < 0 || diff < toWait {
-						toWait = diff
-					}
-				}
-			}
+			// Get the time left for the server that will become online sooner
+			toWait, ok := lb.nextRecoveryIn(lb.now())
 
 			// Unlock access
 			lb.mtx.Unlock()
 
+			// If no server will become online by itself, poll until one is marked as online
+			if !ok {
+				toWait = waitPollInterval
+			}
+
 			// Wait some time until a new server can become available
 			if toWait > 0 {
 				time.Sleep(toWait)
@@ -267,13 +622,111 @@ func (lb *LoadBalancer) WaitNext() (ch chan *Server) {
 	return
 }
 
+// -----------------------------------------------------------------------------
+
+func (e *NoServersError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("no servers available [retry after %v]", e.RetryAfter)
+	}
+	return "no servers available"
+}
+
+func (e *NoServersError) Is(target error) bool {
+	return target == ErrNoServersAvailable
+}
+
+// -----------------------------------------------------------------------------
+
+// RoundRobinState returns the current position of the round-robin cursor so it can be restored later, for e.g. by a
+// new load balancer in a short-lived process, with SetRoundRobinState.
+func (lb *LoadBalancer) RoundRobinState() RoundRobinState {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	return RoundRobinState{
+		Index:  lb.currServerIdx,
+		Weight: lb.currServerWeight,
+	}
+}
+
+// SetRoundRobinState sets the position of the round-robin cursor. The servers should be added in the same order
+// as in the load balancer the state was taken from. If the index is beyond the amount of servers, it wraps around.
+func (lb *LoadBalancer) SetRoundRobinState(state RoundRobinState) error {
+	if state.Index < 0 || state.Weight < 0 {
+		return errors.New("invalid parameter")
+	}
+
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	srvCount := len(lb.primaryGroup.srvList) + len(lb.backupGroup.srvList)
+	if srvCount == 0 {
+		lb.currServerIdx = 0
+		lb.currServerWeight = 0
+		return nil
+	}
+	lb.currServerIdx = state.Index % srvCount
+	lb.currServerWeight = state.Weight
+
+	// Done
+	return nil
+}
+
+// Len returns the total amount of servers, primary and backup, regardless of their state
+func (lb *LoadBalancer) Len() int {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+	return len(lb.primaryGroup.srvList) + len(lb.backupGroup.srvList)
+}
+
+// IsEmpty returns true if no server was added
+func (lb *LoadBalancer) IsEmpty() bool {
+	return lb.Len() == 0
+}
+
+// HasPrimary returns true if at least one primary server was added, regardless of its state. A load balancer with
+// only backup servers keeps them engaged and uses them as if they were primary servers.
+func (lb *LoadBalancer) HasPrimary() bool {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+	return len(lb.primaryGroup.srvList) > 0
+}
+
 // OnlineCount gets the total amount of online servers
 func (lb *LoadBalancer) OnlineCount(includeBackup bool) int {
-	lb.mtx.Lock()
-	count := lb.primaryOnlineCount
-	lb.mtx.Unlock()
+	count := int(atomic.LoadInt32(&lb.primaryOnlineCount))
 	if includeBackup {
-		count += len(lb.backupGroup.srvList)
+		count += int(atomic.LoadInt32(&lb.backupOnlineCount))
 	}
 	return count
 }
+
+// Snapshot returns a consistent copy of the state of all servers, primary servers first
+func (lb *LoadBalancer) Snapshot() []ServerState {
+	now := lb.now()
+
+	// Lock access
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	states := make([]ServerState, 0, len(lb.primaryGroup.srvList)+len(lb.backupGroup.srvList))
+	for _, group := range []*ServerGroup{&lb.primaryGroup, &lb.backupGroup} {
+		for _, srv := range group.srvList {
+			state := ServerState{
+				Server:      srv,
+				Weight:      srv.opts.Weight,
+				IsBackup:    srv.opts.IsBackup,
+				IsDown:      srv.down(),
+				IsProbing:   srv.isProbing,
+				FailCounter: srv.failCounter,
+			}
+			if srv.down() && now.Before(srv.failTimestamp) {
+				state.RecoversIn = srv.failTimestamp.Sub(now)
+			}
+			states = append(states, state)
+		}
+	}
+
+	// Done
+	return states
+}
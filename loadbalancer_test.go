@@ -1,6 +1,7 @@
 package loadbalancer
 
 import (
+	"net"
 	"testing"
 	"time"
 
@@ -94,6 +95,805 @@ func TestWait(t *testing.T) {
 	require.Equal(t, srvName, serverTwoName)
 }
 
+func TestSetFailPolicy(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+
+	// Fail the first server twice, it must remain online
+	srv := lb.Next()
+	srv.SetOffline()
+	srv.SetOffline()
+	require.Equal(t, 2, lb.OnlineCount(false))
+
+	// Lower the maximum failures, the failure counter must be clamped, so the next failure puts it offline
+	err := srv.SetFailPolicy(1, 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, 2, lb.OnlineCount(false))
+
+	srv.SetOffline()
+	require.Equal(t, 1, lb.OnlineCount(false))
+
+	// Disabling failures must put the server online again
+	err = srv.SetFailPolicy(0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, lb.OnlineCount(false))
+
+	// Invalid policies are rejected
+	err = srv.SetFailPolicy(1, 0)
+	require.Error(t, err)
+}
+
+func TestStickyPrimary(t *testing.T) {
+	lb := createTestLoadBalancer(true)
+	lb.SetStickyPrimary(true)
+
+	// The same server must be returned until it goes down
+	srv := lb.Next()
+	for idx := 0; idx < serverTotalCount*2; idx++ {
+		require.Equal(t, srv, lb.Next())
+	}
+
+	for idx := 0; idx < 3; idx++ {
+		srv.SetOffline()
+	}
+
+	nextSrv := lb.Next()
+	require.NotEqual(t, srv, nextSrv)
+	require.Equal(t, nextSrv, lb.Next())
+
+	// Unstick must force a new selection
+	srvName, _ := nextSrv.UserData().(string)
+	require.Equal(t, serverTwoName, srvName)
+	lb.Unstick()
+	srvName, _ = lb.Next().UserData().(string)
+	require.Equal(t, serverTwoName, srvName)
+}
+
+func TestBreakerState(t *testing.T) {
+	lb := Create()
+	_ = lb.Add(ServerOptions{
+		MaxFails:    1,
+		FailTimeout: 50 * time.Millisecond,
+	}, serverOneName)
+
+	srv := lb.Next()
+	require.Equal(t, BreakerClosed, srv.BreakerState().State)
+
+	srv.SetOffline()
+	require.Equal(t, BreakerOpen, srv.BreakerState().State)
+	require.Equal(t, (*Server)(nil), lb.Next())
+
+	// After the fail timeout, the server is half-open and a single failure puts it offline again
+	time.Sleep(60 * time.Millisecond)
+	require.Equal(t, srv, lb.Next())
+	state := srv.BreakerState()
+	require.Equal(t, BreakerHalfOpen, state.State)
+	require.Equal(t, 1, state.TrialRequests)
+
+	srv.SetOffline()
+	require.Equal(t, BreakerOpen, srv.BreakerState().State)
+
+	// A successful trial request closes the breaker
+	time.Sleep(60 * time.Millisecond)
+	require.Equal(t, srv, lb.Next())
+	srv.SetOnline()
+	require.Equal(t, BreakerClosed, srv.BreakerState().State)
+}
+
+func TestMinPrimary(t *testing.T) {
+	lb := Create()
+	for _, name := range []string{"primary 1", "primary 2", "primary 3"} {
+		_ = lb.Add(ServerOptions{
+			Weight:      1,
+			MaxFails:    1,
+			FailTimeout: 5 * time.Second,
+		}, name)
+	}
+	_ = lb.Add(ServerOptions{
+		Weight:   2,
+		IsBackup: true,
+	}, backupServerName)
+	err := lb.SetMinPrimary(2)
+	require.NoError(t, err)
+
+	countPicks := func() map[string]int {
+		picks := make(map[string]int)
+		for idx := 0; idx < 12; idx++ {
+			srvName, _ := lb.Next().UserData().(string)
+			picks[srvName] += 1
+		}
+		return picks
+	}
+
+	// All primaries online, backup is not used
+	require.Equal(t, map[string]int{"primary 1": 4, "primary 2": 4, "primary 3": 4}, countPicks())
+
+	// Two primaries online, still at the threshold
+	srv := lb.Next()
+	srv.SetOffline()
+	picks := countPicks()
+	require.Equal(t, 0, picks[backupServerName])
+	require.Equal(t, 2, len(picks))
+
+	// One primary online, the backup joins the round-robin honoring its weight
+	srv = lb.Next()
+	srv.SetOffline()
+	picks = countPicks()
+	require.Equal(t, 2, len(picks))
+	require.Equal(t, 8, picks[backupServerName])
+
+	// No primaries online, only the backup is used
+	srv = lb.Next()
+	for srv.opts.IsBackup {
+		srv = lb.Next()
+	}
+	srv.SetOffline()
+	require.Equal(t, map[string]int{backupServerName: 12}, countPicks())
+}
+
+func TestWarmup(t *testing.T) {
+	lb := Create()
+	lb.SetWarmup(true)
+
+	srv1, err := lb.AddServer(ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Second,
+	}, serverOneName)
+	require.NoError(t, err)
+	srv2, err := lb.AddServer(ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Second,
+	}, serverTwoName)
+	require.NoError(t, err)
+
+	// Probing servers are never selected
+	require.True(t, srv1.IsProbing())
+	require.Nil(t, lb.Next())
+	require.Equal(t, 0, lb.OnlineCount(true))
+
+	// Failures do not affect probing servers
+	srv2.SetOffline()
+	require.True(t, srv2.IsProbing())
+
+	// Once marked as online, the server is used
+	srv1.SetOnline()
+	require.False(t, srv1.IsProbing())
+	for idx := 0; idx < 4; idx++ {
+		require.Equal(t, srv1, lb.Next())
+	}
+	require.Equal(t, 1, lb.OnlineCount(false))
+}
+
+func TestBackupHysteresis(t *testing.T) {
+	lb := Create()
+	primaries := make([]*Server, 0)
+	for _, name := range []string{"primary 1", "primary 2", "primary 3"} {
+		srv, err := lb.AddServer(ServerOptions{
+			Weight:      1,
+			MaxFails:    1,
+			FailTimeout: time.Hour,
+		}, name)
+		require.NoError(t, err)
+		primaries = append(primaries, srv)
+	}
+	_ = lb.Add(ServerOptions{
+		IsBackup: true,
+	}, backupServerName)
+	require.NoError(t, lb.SetMinPrimary(2))
+	require.NoError(t, lb.SetBackupHysteresis(1, 200*time.Millisecond))
+
+	backupUsed := func() bool {
+		for idx := 0; idx < 8; idx++ {
+			if lb.Next().UserData().(string) == backupServerName {
+				return true
+			}
+		}
+		return false
+	}
+
+	require.False(t, backupUsed())
+
+	// Two primaries down, backups are engaged
+	primaries[0].SetOffline()
+	primaries[1].SetOffline()
+	require.True(t, backupUsed())
+
+	// Back to the minimum but not above the margin, backups are kept
+	primaries[0].SetOnline()
+	require.True(t, backupUsed())
+
+	// Above the margin, backups are kept until the hold time elapses
+	primaries[1].SetOnline()
+	require.True(t, backupUsed())
+	time.Sleep(250 * time.Millisecond)
+	require.False(t, backupUsed())
+
+	// Invalid parameters
+	require.Error(t, lb.SetBackupHysteresis(-1, 0))
+}
+
+func TestTryNext(t *testing.T) {
+	lb := Create()
+	srv, err := lb.AddServer(ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Hour,
+	}, serverOneName)
+	require.NoError(t, err)
+
+	next, err := lb.TryNext()
+	require.NoError(t, err)
+	require.Equal(t, srv, next)
+
+	// Once offline, the error reports when the server will be online again
+	srv.SetOffline()
+	next, err = lb.TryNext()
+	require.Nil(t, next)
+	require.ErrorIs(t, err, ErrNoServersAvailable)
+
+	var noServersErr *NoServersError
+	require.ErrorAs(t, err, &noServersErr)
+	require.Greater(t, noServersErr.RetryAfter, 59*time.Minute)
+	require.LessOrEqual(t, noServersErr.RetryAfter, time.Hour)
+}
+
+func TestSetOfflineFor(t *testing.T) {
+	lb := Create()
+	srv1, err := lb.AddServer(ServerOptions{}, serverOneName)
+	require.NoError(t, err)
+	srv2, err := lb.AddServer(ServerOptions{}, serverTwoName)
+	require.NoError(t, err)
+
+	// Works even if the server never goes offline by itself
+	require.NoError(t, srv1.SetOfflineFor(200*time.Millisecond))
+	require.Equal(t, BreakerOpen, srv1.BreakerState().State)
+
+	// Marking it as online does not end the window
+	srv1.SetOnline()
+	for idx := 0; idx < 4; idx++ {
+		require.Equal(t, srv2, lb.Next())
+	}
+
+	// Once expired, the server is used again
+	time.Sleep(250 * time.Millisecond)
+	picks := make(map[*Server]int)
+	for idx := 0; idx < 4; idx++ {
+		picks[lb.Next()] += 1
+	}
+	require.Equal(t, 2, picks[srv1])
+	require.Equal(t, BreakerClosed, srv1.BreakerState().State)
+
+	require.Error(t, srv1.SetOfflineFor(0))
+}
+
+func TestRoundRobinState(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+	for idx := 0; idx < serverOneCount+1; idx++ {
+		_ = lb.Next()
+	}
+	state := lb.RoundRobinState()
+
+	// A new load balancer continues where the previous one left
+	lb2 := createTestLoadBalancer(false)
+	require.NoError(t, lb2.SetRoundRobinState(state))
+	for idx := 0; idx < serverOneCount+serverTwoCount; idx++ {
+		require.Equal(t, lb.Next().UserData(), lb2.Next().UserData())
+	}
+
+	require.Error(t, lb2.SetRoundRobinState(RoundRobinState{Index: -1}))
+}
+
+func TestIgnoreWeights(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+	lb.SetIgnoreWeights(true)
+
+	picks := make(map[string]int)
+	for idx := 0; idx < 100; idx++ {
+		srvName, _ := lb.Next().UserData().(string)
+		picks[srvName] += 1
+	}
+	require.Equal(t, map[string]int{serverOneName: 50, serverTwoName: 50}, picks)
+}
+
+func TestSelectFilter(t *testing.T) {
+	lb := createTestLoadBalancer(true)
+
+	// Veto the first server
+	lb.SetSelectFilter(func(srv *Server) bool {
+		return srv.UserData().(string) != serverOneName
+	})
+	for idx := 0; idx < 10; idx++ {
+		require.Equal(t, serverTwoName, lb.Next().UserData().(string))
+	}
+
+	// Veto all servers
+	lb.SetSelectFilter(func(srv *Server) bool {
+		return false
+	})
+	srv, err := lb.TryNext()
+	require.Nil(t, srv)
+	require.ErrorIs(t, err, ErrAllVetoed)
+
+	lb.SetSelectFilter(nil)
+	require.NotNil(t, lb.Next())
+}
+
+func TestBackupOrder(t *testing.T) {
+	lb := Create()
+
+	primary, _ := lb.AddServer(ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	}, "primary")
+	_ = lb.Add(ServerOptions{
+		IsBackup:    true,
+		BackupOrder: 2,
+	}, "far")
+	_ = lb.Add(ServerOptions{
+		IsBackup:    true,
+		BackupOrder: 1,
+		Weight:      2,
+	}, "near-1")
+	_ = lb.Add(ServerOptions{
+		IsBackup:    true,
+		BackupOrder: 1,
+	}, "near-2")
+
+	primary.SetOffline()
+
+	// Backups with the lowest order share the load according to their weights
+	picks := make(map[string]int)
+	for idx := 0; idx < 30; idx++ {
+		srvName, _ := lb.Next().UserData().(string)
+		picks[srvName] += 1
+	}
+	require.Equal(t, map[string]int{"near-1": 20, "near-2": 10}, picks)
+
+	// The next order is only used when the preferred backups are unavailable
+	srv, err := lb.NextWithFilter(func(srv *Server) bool {
+		return srv.UserData().(string) == "far"
+	})
+	require.NoError(t, err)
+	require.Equal(t, "far", srv.UserData().(string))
+
+	err = lb.Add(ServerOptions{
+		IsBackup:    true,
+		BackupOrder: -1,
+	}, "invalid")
+	require.Error(t, err)
+}
+
+func TestIsDown(t *testing.T) {
+	lb := createTestLoadBalancer(false)
+	srv := lb.Next()
+
+	require.False(t, srv.IsDown())
+	require.NoError(t, srv.SetOfflineFor(time.Minute))
+	require.True(t, srv.IsDown())
+	require.Equal(t, 1, lb.OnlineCount(false))
+}
+
+func TestLen(t *testing.T) {
+	lb := Create()
+	require.True(t, lb.IsEmpty())
+
+	lb = createTestLoadBalancer(true)
+	require.Equal(t, 3, lb.Len())
+	require.False(t, lb.IsEmpty())
+}
+
+func TestPromoteAndDemote(t *testing.T) {
+	lb := Create()
+	primary, err := lb.AddServer(ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	}, 1)
+	require.NoError(t, err)
+	backup, err := lb.AddServer(ServerOptions{
+		IsBackup: true,
+	}, 2)
+	require.NoError(t, err)
+
+	require.Error(t, primary.PromoteToPrimary())
+	require.Error(t, backup.DemoteToBackup())
+
+	// The promoted server shares the load with the other primary
+	require.NoError(t, backup.PromoteToPrimary())
+	require.False(t, backup.IsBackup())
+	require.Equal(t, 2, lb.OnlineCount(false))
+	require.Equal(t, 0, lb.OnlineCount(true)-lb.OnlineCount(false))
+
+	used := make(map[interface{}]int)
+	for i := 0; i < 4; i++ {
+		used[lb.Next().UserData()] += 1
+	}
+	require.Equal(t, 2, used[1])
+	require.Equal(t, 2, used[2])
+
+	// An offline server is put online when demoted and only used as a backup
+	primary.SetOffline()
+	require.True(t, primary.IsDown())
+	require.NoError(t, primary.DemoteToBackup())
+	require.True(t, primary.IsBackup())
+	require.False(t, primary.IsDown())
+	require.Equal(t, 1, lb.OnlineCount(false))
+	require.Equal(t, 2, lb.OnlineCount(true))
+	for i := 0; i < 3; i++ {
+		require.Equal(t, 2, lb.Next().UserData())
+	}
+}
+
+func BenchmarkStateReads(b *testing.B) {
+	lb := createTestLoadBalancer(true)
+	srv := lb.Next()
+
+	// State reads do not take the lock, so they do not contend with the selection done by other goroutines
+	b.RunParallel(func(pb *testing.PB) {
+		idx := 0
+		for pb.Next() {
+			if idx%4 == 0 {
+				_ = lb.Next()
+			} else {
+				_ = lb.OnlineCount(true)
+				_ = srv.IsDown()
+			}
+			idx += 1
+		}
+	})
+}
+
+func BenchmarkStateChangesWithSelection(b *testing.B) {
+	lb := Create()
+	failing, _ := lb.AddServer(ServerOptions{
+		MaxFails:    1000000,
+		FailTimeout: time.Hour,
+	}, serverOneName)
+	_ = lb.Add(ServerOptions{}, serverTwoName)
+
+	// Failures reported on one server while other goroutines select servers
+	b.RunParallel(func(pb *testing.PB) {
+		idx := 0
+		for pb.Next() {
+			if idx%2 == 0 {
+				failing.SetOffline()
+			} else {
+				_ = lb.Next()
+			}
+			idx += 1
+		}
+	})
+}
+
+func TestBackupOnly(t *testing.T) {
+	lb := Create()
+	require.False(t, lb.HasPrimary())
+
+	backup, err := lb.AddServer(ServerOptions{
+		IsBackup: true,
+	}, 1)
+	require.NoError(t, err)
+	require.False(t, lb.HasPrimary())
+
+	// Backups are used when there are no primary servers at all
+	for i := 0; i < 3; i++ {
+		require.Equal(t, 1, lb.Next().UserData())
+	}
+
+	require.NoError(t, backup.PromoteToPrimary())
+	require.True(t, lb.HasPrimary())
+}
+
+func TestSetWeight(t *testing.T) {
+	lb := Create()
+	srv1, err := lb.AddServer(ServerOptions{}, 1)
+	require.NoError(t, err)
+	_, err = lb.AddServer(ServerOptions{}, 2)
+	require.NoError(t, err)
+
+	require.Error(t, srv1.SetWeight(0))
+	require.NoError(t, srv1.SetWeight(3))
+	require.Equal(t, 3, srv1.Weight())
+
+	used := make(map[interface{}]int)
+	for i := 0; i < 8; i++ {
+		used[lb.Next().UserData()] += 1
+	}
+	require.Equal(t, 6, used[1])
+	require.Equal(t, 2, used[2])
+}
+
+func TestClock(t *testing.T) {
+	clock := &testClock{
+		now: time.Now(),
+	}
+
+	lb := Create()
+	lb.SetClock(clock)
+	srv, err := lb.AddServer(ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Hour,
+	}, 1)
+	require.NoError(t, err)
+
+	srv.SetOffline()
+	_, err = lb.TryNext()
+	require.ErrorIs(t, err, ErrNoServersAvailable)
+
+	// The server recovers once the fail timeout elapses on the clock
+	clock.advance(time.Hour + time.Second)
+	require.Equal(t, srv, lb.Next())
+}
+
+func TestAddRemoveDuringCycle(t *testing.T) {
+	lb := Create()
+	_, err := lb.AddServer(ServerOptions{
+		Weight: 2,
+	}, "A")
+	require.NoError(t, err)
+	srvB, err := lb.AddServer(ServerOptions{}, "B")
+	require.NoError(t, err)
+
+	// An added server joins the cycle without cutting the turn of the current one
+	require.Equal(t, "A", lb.Next().UserData())
+	srvC, err := lb.AddServer(ServerOptions{}, "C")
+	require.NoError(t, err)
+	for _, name := range []string{"A", "B", "C", "A", "A", "B"} {
+		require.Equal(t, name, lb.Next().UserData())
+	}
+
+	// Removing the current server moves to the next one
+	require.NoError(t, lb.RemoveServer(srvB))
+	require.Error(t, lb.RemoveServer(srvB))
+	for _, name := range []string{"C", "A", "A", "C"} {
+		require.Equal(t, name, lb.Next().UserData())
+	}
+
+	// Removing another server keeps the current one
+	require.Equal(t, "A", lb.Next().UserData())
+	_, err = lb.AddServer(ServerOptions{}, "D")
+	require.NoError(t, err)
+	require.NoError(t, lb.RemoveServer(srvC))
+	for _, name := range []string{"A", "D", "A", "A", "D"} {
+		require.Equal(t, name, lb.Next().UserData())
+	}
+	require.Equal(t, 2, lb.OnlineCount(false))
+
+	// Adding a primary server keeps the cursor on the current backup server
+	lb = Create()
+	require.NoError(t, lb.SetMinPrimary(2))
+	_, _ = lb.AddServer(ServerOptions{}, "P")
+	_, _ = lb.AddServer(ServerOptions{
+		IsBackup: true,
+	}, "X")
+	_, _ = lb.AddServer(ServerOptions{
+		IsBackup: true,
+	}, "Y")
+	require.Equal(t, "P", lb.Next().UserData())
+	require.Equal(t, "X", lb.Next().UserData())
+	_, _ = lb.AddServer(ServerOptions{}, "Q")
+	for _, name := range []string{"P", "Q", "P"} {
+		require.Equal(t, name, lb.Next().UserData())
+	}
+}
+
+func TestTCPHealthCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() {
+		_ = ln.Close()
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	// Get a port nobody listens on
+	closedLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := closedLn.Addr().String()
+	_ = closedLn.Close()
+
+	lb := Create()
+	lb.SetWarmup(true)
+	upSrv, err := lb.AddServer(ServerOptions{}, ln.Addr().String())
+	require.NoError(t, err)
+	lb.SetWarmup(false)
+	downSrv, err := lb.AddServer(ServerOptions{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	}, closedAddr)
+	require.NoError(t, err)
+
+	require.Error(t, lb.EnableTCPHealthCheck(nil, time.Second))
+	require.NoError(t, lb.EnableTCPHealthCheck(func(userData interface{}) string {
+		return userData.(string)
+	}, 20*time.Millisecond))
+	defer lb.DisableTCPHealthCheck()
+
+	require.Eventually(t, func() bool {
+		return !upSrv.IsProbing() && downSrv.IsDown()
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, upSrv, lb.Next())
+}
+
+func TestNextExcluding(t *testing.T) {
+	lb := Create()
+	srvA, err := lb.AddServer(ServerOptions{
+		Weight: 2,
+	}, "A")
+	require.NoError(t, err)
+	srvB, err := lb.AddServer(ServerOptions{
+		Weight:      2,
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	}, "B")
+	require.NoError(t, err)
+	_, err = lb.AddServer(ServerOptions{
+		Weight: 2,
+	}, "C")
+	require.NoError(t, err)
+
+	// Consecutive picks always differ and the load is still evenly spread
+	used := make(map[interface{}]int)
+	var prev *Server
+	for i := 0; i < 30; i++ {
+		srv := lb.NextExcluding(prev)
+		require.NotEqual(t, prev, srv)
+		used[srv.UserData()] += 1
+		prev = srv
+	}
+	require.Equal(t, 10, used["A"])
+	require.Equal(t, 10, used["B"])
+	require.Equal(t, 10, used["C"])
+
+	// The excluded server is used if it is the only one available
+	srvB.SetOffline()
+	require.NoError(t, lb.RemoveServer(srvA))
+	prev = lb.Next()
+	require.Equal(t, "C", prev.UserData())
+	require.Equal(t, prev, lb.NextExcluding(prev))
+}
+
+func TestRecoverAll(t *testing.T) {
+	lb := Create()
+	ups := 0
+	lb.SetEventHandler(func(eventType int, srv *Server) {
+		if eventType == ServerUpEvent {
+			ups += 1
+		}
+	})
+	srv1, err := lb.AddServer(ServerOptions{MaxFails: 1, FailTimeout: time.Hour}, serverOneName)
+	require.NoError(t, err)
+	srv2, err := lb.AddServer(ServerOptions{MaxFails: 2, FailTimeout: time.Hour}, serverTwoName)
+	require.NoError(t, err)
+	srv3, err := lb.AddServer(ServerOptions{}, "server 3")
+	require.NoError(t, err)
+
+	srv1.SetOffline()
+	srv2.SetOffline()
+	require.NoError(t, srv3.SetOfflineFor(time.Hour))
+	require.True(t, srv1.IsDown())
+	require.Equal(t, 1, srv2.BreakerState().FailCounter)
+	require.Equal(t, 1, lb.OnlineCount(false))
+
+	lb.RecoverAll()
+	require.Equal(t, 3, lb.OnlineCount(false))
+	require.Equal(t, 2, ups)
+	for _, srv := range []*Server{srv1, srv2, srv3} {
+		state := srv.BreakerState()
+		require.Equal(t, BreakerClosed, state.State)
+		require.Equal(t, 0, state.FailCounter)
+	}
+
+	picks := make(map[*Server]int)
+	for idx := 0; idx < 6; idx++ {
+		picks[lb.Next()] += 1
+	}
+	require.Equal(t, 2, picks[srv1])
+	require.Equal(t, 2, picks[srv2])
+	require.Equal(t, 2, picks[srv3])
+}
+
+func TestNextForRequest(t *testing.T) {
+	lb := Create()
+	srvA, err := lb.AddServer(ServerOptions{
+		Weight:      1,
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	}, "A")
+	require.NoError(t, err)
+	srvB, err := lb.AddServer(ServerOptions{
+		Weight:      1,
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	}, "B")
+	require.NoError(t, err)
+	srvC, err := lb.AddServer(ServerOptions{
+		Weight:      1,
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	}, "C")
+	require.NoError(t, err)
+
+	isB := func(srv *Server) bool {
+		return srv == srvB
+	}
+	notA := func(srv *Server) bool {
+		return srv != srvA
+	}
+
+	// The preferred server is used while it is available
+	for i := 0; i < 3; i++ {
+		srv, err := lb.NextForRequest(SelectCriteria{
+			Filter: notA,
+			Prefer: []SelectFilter{isB},
+		})
+		require.NoError(t, err)
+		require.Equal(t, srvB, srv)
+	}
+
+	// Excluding the preferred server falls back to the other accepted ones
+	for i := 0; i < 3; i++ {
+		srv, err := lb.NextForRequest(SelectCriteria{
+			Filter:  notA,
+			Prefer:  []SelectFilter{isB},
+			Exclude: []*Server{srvB},
+		})
+		require.NoError(t, err)
+		require.Equal(t, srvC, srv)
+	}
+
+	// Excluded servers are only used if allowed and no other server is accepted
+	_, err = lb.NextForRequest(SelectCriteria{
+		Filter:  notA,
+		Exclude: []*Server{srvB, srvC},
+	})
+	require.ErrorIs(t, err, ErrAllVetoed)
+	srv, err := lb.NextForRequest(SelectCriteria{
+		Filter:        notA,
+		Exclude:       []*Server{srvB, srvC},
+		AllowExcluded: true,
+	})
+	require.NoError(t, err)
+	require.NotEqual(t, srvA, srv)
+
+	// Without available servers, the error says when to retry
+	srvA.SetOffline()
+	srvB.SetOffline()
+	srvC.SetOffline()
+	_, err = lb.NextForRequest(SelectCriteria{})
+	require.ErrorIs(t, err, ErrNoServersAvailable)
+}
+
+func TestNextForRequestKeepsWeights(t *testing.T) {
+	lb := Create()
+	_, err := lb.AddServer(ServerOptions{
+		Weight: 3,
+	}, "A")
+	require.NoError(t, err)
+	_, err = lb.AddServer(ServerOptions{
+		Weight: 1,
+	}, "B")
+	require.NoError(t, err)
+
+	// A preference no server matches must not cancel the weights
+	used := make(map[interface{}]int)
+	for i := 0; i < 400; i++ {
+		srv, err := lb.NextForRequest(SelectCriteria{
+			Prefer: []SelectFilter{func(srv *Server) bool {
+				return false
+			}},
+		})
+		require.NoError(t, err)
+		used[srv.UserData()] += 1
+	}
+	require.Equal(t, 300, used["A"])
+	require.Equal(t, 100, used["B"])
+}
+
 // -----------------------------------------------------------------------------
 // Private functions
 
@@ -120,3 +920,15 @@ func createTestLoadBalancer(addBackup bool) *LoadBalancer {
 
 	return lb
 }
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
@@ -1,6 +1,8 @@
 package loadbalancer
 
 import (
+	"errors"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,8 +13,14 @@ type Server struct {
 	lb          *LoadBalancer // NOTE: Go's Mark & Sweep plays well with this circular reference
 	opts        ServerOptions
 	index       int
-	isDown      bool
+	isDown      int32 // NOTE: Written atomically while the load balancer lock is held, so it can be read without it
+	isHalfOpen  bool
+	isProbing   bool
+	isForced    bool
+	isRemoved   bool
 	failCounter int
+	trialCount  int
+	stateSince  time.Time
 	// NOTE: failTimestamp has two uses:
 	//       1. Marks the timestamp of the first access failure
 	//       2. Marks the timestamp to put it again online when down
@@ -37,17 +45,44 @@ type ServerOptions struct {
 
 	// Indicates if this server must be used as a backup fail over. Backup servers never goes offline.
 	IsBackup bool
+
+	// BackupOrder sets the failover order among backup servers. Backups with the lowest order are used first and the
+	// next ones are only used if none of them is available, for e.g. because they are warming up or rejected by a
+	// select filter. Backups with the same order share the load according to their weights.
+	BackupOrder int
+}
+
+// BreakerState contains the circuit breaker state of a server.
+type BreakerState struct {
+	// State is one of BreakerClosed, BreakerOpen or BreakerHalfOpen.
+	State int
+	// Since indicates the time when the breaker entered the current state.
+	Since time.Time
+	// FailCounter is the amount of failures accumulated in the current fail timeout period.
+	FailCounter int
+	// TrialRequests is the amount of requests sent to the server while half-open.
+	TrialRequests int
 }
 
 // ServerGroup is a group of servers. Used to classify and track primary and backup servers.
 type ServerGroup struct {
-	srvList          []Server
-	currServerIdx    int
-	currServerWeight int
+	srvList []*Server
 }
 
 // -----------------------------------------------------------------------------
 
+const (
+	// BreakerClosed indicates the server is online.
+	BreakerClosed int = iota + 1
+	// BreakerOpen indicates the server is offline waiting for the fail timeout to expire.
+	BreakerOpen
+	// BreakerHalfOpen indicates the server recovered after the fail timeout and the first request result will
+	// determine if it is put online or offline again.
+	BreakerHalfOpen
+)
+
+// -----------------------------------------------------------------------------
+
 // UserData returns the server user data
 func (srv *Server) UserData() interface{} {
 	return srv.userData
@@ -55,25 +90,55 @@ func (srv *Server) UserData() interface{} {
 
 // SetOnline marks a server as available
 func (srv *Server) SetOnline() {
-	// We only can change the online/offline status on primary servers
-	if srv.opts.MaxFails == 0 || srv.opts.IsBackup {
-		return
-	}
-
 	notifyUp := false
 
 	// Lock access
 	srv.lb.mtx.Lock()
 
+	if srv.isRemoved {
+		srv.lb.mtx.Unlock()
+		return
+	}
+
+	// Promote the server if it is being probed
+	if srv.isProbing {
+		srv.isProbing = false
+		srv.stateSince = srv.lb.now()
+		if srv.opts.IsBackup {
+			atomic.AddInt32(&srv.lb.backupOnlineCount, 1)
+		} else {
+			atomic.AddInt32(&srv.lb.primaryOnlineCount, 1)
+		}
+
+		// Unlock access
+		srv.lb.mtx.Unlock()
+
+		// Call event callback
+		srv.lb.raiseEvent(ServerUpEvent, srv)
+		return
+	}
+
+	// We only can change the online/offline status on primary servers. Servers put offline for a specific duration
+	// remain offline until it expires.
+	if srv.opts.MaxFails == 0 || srv.opts.IsBackup || srv.isForced {
+		srv.lb.mtx.Unlock()
+		return
+	}
+
 	// Reset the failure counter
 	srv.failCounter = 0
 
 	// If the server was marked as down, put it online again
-	if srv.isDown {
-		srv.isDown = false
-		srv.lb.primaryOnlineCount += 1
+	if srv.down() {
+		srv.setDownFlag(false)
+		srv.stateSince = srv.lb.now()
+		atomic.AddInt32(&srv.lb.primaryOnlineCount, 1)
 
 		notifyUp = true
+	} else if srv.isHalfOpen {
+		// A successful trial request closes the breaker
+		srv.isHalfOpen = false
+		srv.stateSince = srv.lb.now()
 	}
 
 	// Unlock access
@@ -87,19 +152,26 @@ func (srv *Server) SetOnline() {
 
 // SetOffline marks a server as unavailable
 func (srv *Server) SetOffline() {
-	// We only can change the online/offline status on primary servers
-	if srv.opts.MaxFails == 0 || srv.opts.IsBackup {
-		return
-	}
-
 	notifyDown := false
 
 	// Lock access
 	srv.lb.mtx.Lock()
 
-	// If server is up
-	if !srv.isDown && srv.failCounter < srv.opts.MaxFails {
-		now := time.Now()
+	// We only can change the online/offline status on primary servers. Probing servers remain in that state.
+	if srv.opts.MaxFails == 0 || srv.opts.IsBackup || srv.isProbing || srv.isRemoved {
+		srv.lb.mtx.Unlock()
+		return
+	}
+
+	if srv.isHalfOpen {
+		// A failed trial request puts the server offline again
+		srv.setDown(srv.lb.now())
+
+		notifyDown = true
+
+	} else if !srv.down() && srv.failCounter < srv.opts.MaxFails {
+		// If server is up
+		now := srv.lb.now()
 
 		// Increment the failure counter
 		srv.failCounter += 1
@@ -118,9 +190,7 @@ func (srv *Server) SetOffline() {
 
 		// If we reach to the maximum failure count, put this server offline
 		if srv.failCounter == srv.opts.MaxFails {
-			srv.isDown = true
-			srv.failTimestamp = now.Add(srv.opts.FailTimeout)
-			srv.lb.primaryOnlineCount -= 1
+			srv.setDown(now)
 
 			notifyDown = true
 		}
@@ -134,3 +204,288 @@ func (srv *Server) SetOffline() {
 		srv.lb.raiseEvent(ServerDownEvent, srv)
 	}
 }
+
+// SetOfflineFor puts a primary server offline for the specified duration regardless of its fail policy. The server is
+// put online again once the duration expires and, meanwhile, calls to SetOnline are ignored. If the server is already
+// offline, the time to put it online again is replaced. Servers being probed are not affected.
+func (srv *Server) SetOfflineFor(d time.Duration) error {
+	// Check options
+	if d <= 0 {
+		return errors.New("invalid parameter")
+	}
+
+	notifyDown := false
+
+	// Lock access
+	srv.lb.mtx.Lock()
+
+	if srv.opts.IsBackup || srv.isRemoved {
+		srv.lb.mtx.Unlock()
+		return errors.New("invalid parameter")
+	}
+
+	if !srv.isProbing {
+		now := srv.lb.now()
+
+		if !srv.down() {
+			srv.setDown(now)
+
+			notifyDown = true
+		}
+		srv.failTimestamp = now.Add(d)
+		srv.isForced = true
+	}
+
+	// Unlock access
+	srv.lb.mtx.Unlock()
+
+	// Call event callback
+	if notifyDown {
+		srv.lb.raiseEvent(ServerDownEvent, srv)
+	}
+
+	// Done
+	return nil
+}
+
+// SetFailPolicy changes the maximum amount of failures and the fail timeout of a primary server.
+//
+// If the server is online and the failure counter already reached the new maximum, the counter is clamped so the
+// next failure puts the server offline. If the server is offline, it will remain offline until the current fail
+// timeout expires unless maxFails is zero, in that case, the server is put online immediately.
+func (srv *Server) SetFailPolicy(maxFails int, failTimeout time.Duration) error {
+	// Check options
+	if !isValidFailPolicy(maxFails, failTimeout) {
+		return errors.New("invalid parameter")
+	}
+
+	notifyUp := false
+
+	// Lock access
+	srv.lb.mtx.Lock()
+
+	if srv.opts.IsBackup || srv.isRemoved {
+		srv.lb.mtx.Unlock()
+		return errors.New("invalid parameter")
+	}
+
+	if maxFails == 0 {
+		failTimeout = time.Duration(0)
+
+		// The server will never go offline, so put it online if it was marked as down
+		srv.failCounter = 0
+		if (srv.down() && !srv.isForced) || srv.isHalfOpen {
+			if srv.down() {
+				atomic.AddInt32(&srv.lb.primaryOnlineCount, 1)
+
+				notifyUp = true
+			}
+			srv.setDownFlag(false)
+			srv.isHalfOpen = false
+			srv.stateSince = srv.lb.now()
+		}
+	} else if !srv.down() && srv.failCounter >= maxFails {
+		srv.failCounter = maxFails - 1
+	}
+
+	srv.opts.MaxFails = maxFails
+	srv.opts.FailTimeout = failTimeout
+
+	// Unlock access
+	srv.lb.mtx.Unlock()
+
+	// Call event callback
+	if notifyUp {
+		srv.lb.raiseEvent(ServerUpEvent, srv)
+	}
+
+	// Done
+	return nil
+}
+
+// PromoteToPrimary turns a backup server into a primary one, keeping its state and the position of the round-robin
+// cursor. Like a backup server, it never goes offline until a fail policy is set with SetFailPolicy.
+func (srv *Server) PromoteToPrimary() error {
+	lb := srv.lb
+
+	// Lock access
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	if !srv.opts.IsBackup || srv.isRemoved {
+		return errors.New("invalid parameter")
+	}
+
+	currServer := lb.cursorServer()
+
+	// Move to the primary server list
+	lb.backupGroup.remove(srv)
+	srv.opts.IsBackup = false
+	srv.index = len(lb.primaryGroup.srvList)
+	lb.primaryGroup.srvList = append(lb.primaryGroup.srvList, srv)
+	lb.rebuildBackupOrders()
+
+	if !srv.isProbing {
+		atomic.AddInt32(&lb.backupOnlineCount, -1)
+		atomic.AddInt32(&lb.primaryOnlineCount, 1)
+	}
+
+	lb.setCursorServer(currServer)
+
+	// Done
+	return nil
+}
+
+// DemoteToBackup turns a primary server into a backup one, keeping the position of the round-robin cursor. As backup
+// servers never go offline, its fail policy is removed and, if it was offline, it is put online.
+func (srv *Server) DemoteToBackup() error {
+	lb := srv.lb
+
+	notifyUp := false
+
+	// Lock access
+	lb.mtx.Lock()
+
+	if srv.opts.IsBackup || srv.isRemoved {
+		lb.mtx.Unlock()
+		return errors.New("invalid parameter")
+	}
+
+	currServer := lb.cursorServer()
+
+	if !srv.isProbing {
+		if srv.down() {
+			notifyUp = true
+		} else {
+			atomic.AddInt32(&lb.primaryOnlineCount, -1)
+		}
+		atomic.AddInt32(&lb.backupOnlineCount, 1)
+	}
+	if srv.down() || srv.isHalfOpen {
+		srv.setDownFlag(false)
+		srv.isHalfOpen = false
+		srv.stateSince = srv.lb.now()
+	}
+	srv.isForced = false
+	srv.failCounter = 0
+	srv.opts.MaxFails = 0
+	srv.opts.FailTimeout = time.Duration(0)
+
+	// Move to the backup server list
+	lb.primaryGroup.remove(srv)
+	srv.opts.IsBackup = true
+	srv.index = len(lb.backupGroup.srvList)
+	lb.backupGroup.srvList = append(lb.backupGroup.srvList, srv)
+	lb.addBackupOrder(srv.opts.BackupOrder)
+
+	lb.setCursorServer(currServer)
+
+	// Unlock access
+	lb.mtx.Unlock()
+
+	// Call event callback
+	if notifyUp {
+		lb.raiseEvent(ServerUpEvent, srv)
+	}
+
+	// Done
+	return nil
+}
+
+// SetWeight changes the weight of the server. The new weight applies from the next selection.
+func (srv *Server) SetWeight(weight int) error {
+	if weight <= 0 {
+		return errors.New("invalid parameter")
+	}
+
+	// Lock access
+	srv.lb.mtx.Lock()
+	defer srv.lb.mtx.Unlock()
+
+	srv.opts.Weight = weight
+
+	// Done
+	return nil
+}
+
+// Weight returns the current weight of the server
+func (srv *Server) Weight() int {
+	srv.lb.mtx.Lock()
+	defer srv.lb.mtx.Unlock()
+	return srv.opts.Weight
+}
+
+// IsBackup returns true if the server is a backup server
+func (srv *Server) IsBackup() bool {
+	srv.lb.mtx.Lock()
+	defer srv.lb.mtx.Unlock()
+	return srv.opts.IsBackup
+}
+
+// IsDown returns true if the server is offline because of failures or because it was put offline for a duration. It
+// does not take the load balancer lock, so it is cheap to call frequently. Servers whose fail timeout expired are
+// reported as offline until they are considered again for selection.
+func (srv *Server) IsDown() bool {
+	return atomic.LoadInt32(&srv.isDown) != 0
+}
+
+// IsProbing returns true if the server was added on warmup mode and was not marked as online yet
+func (srv *Server) IsProbing() bool {
+	srv.lb.mtx.Lock()
+	defer srv.lb.mtx.Unlock()
+	return srv.isProbing
+}
+
+// BreakerState returns the current circuit breaker state of the server
+func (srv *Server) BreakerState() BreakerState {
+	// Lock access
+	srv.lb.mtx.Lock()
+	defer srv.lb.mtx.Unlock()
+
+	state := BreakerState{
+		State:         BreakerClosed,
+		Since:         srv.stateSince,
+		FailCounter:   srv.failCounter,
+		TrialRequests: srv.trialCount,
+	}
+	if srv.down() {
+		state.State = BreakerOpen
+	} else if srv.isHalfOpen {
+		state.State = BreakerHalfOpen
+	}
+
+	// Done
+	return state
+}
+
+// NOTE: The following methods must be called while the load balancer lock is held.
+
+func (srv *Server) down() bool {
+	return srv.isDown != 0
+}
+
+func (srv *Server) setDownFlag(down bool) {
+	if down {
+		atomic.StoreInt32(&srv.isDown, 1)
+	} else {
+		atomic.StoreInt32(&srv.isDown, 0)
+	}
+}
+
+func (srv *Server) setDown(now time.Time) {
+	srv.setDownFlag(true)
+	srv.isHalfOpen = false
+	srv.failTimestamp = now.Add(srv.opts.FailTimeout)
+	srv.stateSince = now
+	atomic.AddInt32(&srv.lb.primaryOnlineCount, -1)
+}
+
+func (srv *Server) recover(now time.Time) {
+	srv.setDownFlag(false)
+	srv.isForced = false
+	srv.isHalfOpen = srv.opts.MaxFails > 0
+	srv.failCounter = 0
+	srv.trialCount = 0
+	srv.stateSince = now
+	atomic.AddInt32(&srv.lb.primaryOnlineCount, 1)
+}